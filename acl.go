@@ -1,10 +1,104 @@
 package aclsrv
 
+import (
+	"errors"
+	"strings"
+)
+
+// errDotSegment refuses paths the upstream would resolve to another path than the rules see,
+// eg. "/public/../admin" matching "/public/**"
+var errDotSegment = errors.New("path must not contain . or .. segments")
+
+// ACLRule narrows the required permission of a service down to a HTTP method and
+// a path pattern. The path is matched against the request path after the service
+// prefix has been stripped, eg. "/api/jolie-deployer/list" is matched as "/list".
+//
+// Path patterns are split into segments on '/':
+//   - a literal segment must match exactly
+//   - "*" matches any single segment
+//   - "**" as the last segment matches zero or more remaining segments
+//
+// An empty method or "*" matches every method.
+type ACLRule struct {
+	Method            string     `json:"method,omitempty"`
+	Path              string     `json:"path"`
+	MinimumPermission Permission `json:"min_permission"`
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// hasDotSegment checks for "." and ".." segments, which are left in catch-all parameters
+func hasDotSegment(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// match checks if the rule applies to the given method and path. When it does, a
+// specificity score is returned; a higher score means a more specific match.
+func (r *ACLRule) match(method, path string) (score int, ok bool) {
+	if r.Method != "" && r.Method != "*" {
+		if !strings.EqualFold(r.Method, method) {
+			return 0, false
+		}
+		score++
+	}
+
+	pattern := splitPath(r.Path)
+	segments := splitPath(path)
+
+	var literals int
+	for i := range pattern {
+		if pattern[i] == "**" && i == len(pattern)-1 {
+			// prefix match. Always ranked below a pattern of fixed length
+			return score + literals*4, true
+		}
+		if i >= len(segments) {
+			return 0, false
+		}
+		if pattern[i] == "*" {
+			continue
+		}
+		if pattern[i] != segments[i] {
+			return 0, false
+		}
+		literals++
+	}
+	if len(pattern) != len(segments) {
+		return 0, false
+	}
+
+	return score + literals*4 + 2, true
+}
+
+// enforcement modes of an ACL entry
+const (
+	ACLModeEnforce    = "enforce"     // denied requests are rejected, the default
+	ACLModeReportOnly = "report-only" // denied requests are counted as would-deny, but still proxied
+	ACLModeDisabled   = "disabled"    // the ACL entry is not checked
+)
+
+func validACLMode(mode string) bool {
+	return mode == "" || mode == ACLModeEnforce || mode == ACLModeReportOnly || mode == ACLModeDisabled
+}
+
 type ACLEntry struct {
 	Service           string     `json:"service"`
+	Mode              string     `json:"mode,omitempty"` // see ACLModeEnforce
 	MinimumPermission Permission `json:"min_permission"`
-	AllowedUserIDs    []UserID   `json:"-"` //`json:"whitelisted_users"`
-	BlockedUserIDs    []UserID   `json:"-"` //`json:"blacklisted_users"`
+	Rules             []*ACLRule `json:"rules,omitempty"`
+	AllowedUserIDs    UserIDSet  `json:"allowed_users,omitempty"`
+	BlockedUserIDs    UserIDSet  `json:"blocked_users,omitempty"`
+	Quotas            []*Quota   `json:"quotas,omitempty"`
 	LastUpdated       int64      `json:"-"` // unix
 }
 
@@ -12,20 +106,76 @@ func (e *ACLEntry) Empty() bool {
 	return e.Service == ""
 }
 
-func (e *ACLEntry) HasAccess(user *User) bool {
-	// check if explicitly blocked
-	for _, blocked := range e.BlockedUserIDs {
-		if user.ID == blocked {
-			return false
+// Rule finds the most specific rule for the given method and path. On equally specific
+// matches, the first rule in the list wins. Nil is returned when no rule applies.
+func (e *ACLEntry) Rule(method, path string) (rule *ACLRule) {
+	best := -1
+	for _, r := range e.Rules {
+		if r == nil {
+			continue
+		}
+		if score, ok := r.match(method, path); ok && score > best {
+			best = score
+			rule = r
 		}
 	}
 
+	return rule
+}
+
+// RequiredPermission returns the permission flags needed for the given method and path.
+// Falls back to the service wide minimum permission when no rule matches.
+func (e *ACLEntry) RequiredPermission(method, path string) Permission {
+	if rule := e.Rule(method, path); rule != nil {
+		return rule.MinimumPermission
+	}
+
+	return e.MinimumPermission
+}
+
+// String describes the rule in audit records, eg. "DELETE /undeploy/*"
+func (r *ACLRule) String() string {
+	method := r.Method
+	if method == "" {
+		method = "*"
+	}
+	return method + " " + r.Path
+}
+
+// AccessDecision explains why a user has access to a service path or not
+type AccessDecision struct {
+	Allowed  bool
+	Required Permission
+	Rule     string // the matched rule, or min_permission, allowed_users or blocked_users
+	Reason   string
+}
+
+// Decide checks if the user has access to the given method and path
+func (e *ACLEntry) Decide(user *User, method, path string) *AccessDecision {
+	// check if explicitly blocked
+	if user.ID != "" && e.BlockedUserIDs.Contains(user.ID) {
+		return &AccessDecision{Rule: "blocked_users", Reason: "user is blocked"}
+	}
+
 	// check if explicitly whitelisted
-	for _, allowed := range e.AllowedUserIDs {
-		if user.ID == allowed {
-			return true
-		}
+	if user.ID != "" && e.AllowedUserIDs.Contains(user.ID) {
+		return &AccessDecision{Allowed: true, Rule: "allowed_users", Reason: "user is allowed"}
+	}
+
+	decision := &AccessDecision{Required: e.MinimumPermission, Rule: "min_permission"}
+	if rule := e.Rule(method, path); rule != nil {
+		decision.Required = rule.MinimumPermission
+		decision.Rule = rule.String()
+	}
+	decision.Allowed = (user.Permission & decision.Required) == decision.Required
+	if decision.Allowed {
+		decision.Reason = "user has the required permission"
+	} else {
+		decision.Reason = "user is missing permission " + (decision.Required &^ user.Permission).Str()
 	}
+	return decision
+}
 
-	return (user.Permission & e.MinimumPermission) == e.MinimumPermission
+func (e *ACLEntry) HasAccess(user *User, method, path string) bool {
+	return e.Decide(user, method, path).Allowed
 }
@@ -0,0 +1,147 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestACLEntryRule(t *testing.T) {
+	entry := &ACLEntry{
+		Service:           "jolie-deployer",
+		MinimumPermission: PFlagSeeJolieAll,
+		Rules: []*ACLRule{
+			{Path: "/**", MinimumPermission: PFlagSeeUserSafeSrv},
+			{Method: "GET", Path: "/list", MinimumPermission: PFlagSeeJolieAll},
+			{Path: "/list", MinimumPermission: PFlagSeeSrvAll},
+			{Method: "DELETE", Path: "/undeploy/*", MinimumPermission: PFlagManageJolieAll},
+			{Path: "/undeploy/*", MinimumPermission: PFlagManageJolieSelf},
+			{Path: "/undeploy/*", MinimumPermission: PFlagManageSrvAll}, // shadowed by the previous rule
+			{Path: "/logs/**", MinimumPermission: PFlagSrvLogsAll},
+		},
+	}
+
+	testcases := []struct {
+		method string
+		path   string
+		wants  Permission
+	}{
+		{"GET", "/list", PFlagSeeJolieAll},
+		{"POST", "/list", PFlagSeeSrvAll},
+		{"GET", "/list/", PFlagSeeJolieAll},
+		{"DELETE", "/undeploy/my-script", PFlagManageJolieAll},
+		{"delete", "/undeploy/my-script", PFlagManageJolieAll},
+		{"POST", "/undeploy/my-script", PFlagManageJolieSelf},
+		{"POST", "/undeploy", PFlagSeeUserSafeSrv},
+		{"GET", "/logs", PFlagSrvLogsAll},
+		{"GET", "/logs/a/b/c", PFlagSrvLogsAll},
+		{"GET", "/", PFlagSeeUserSafeSrv},
+	}
+
+	for _, tc := range testcases {
+		if got := entry.RequiredPermission(tc.method, tc.path); got != tc.wants {
+			t.Errorf("%s %s: incorrect permission. Got %d, wants %d", tc.method, tc.path, got, tc.wants)
+		}
+	}
+
+	// no rules falls back to the service minimum
+	entry.Rules = entry.Rules[1:]
+	if got := entry.RequiredPermission("GET", "/unknown"); got != entry.MinimumPermission {
+		t.Errorf("expected fallback to minimum permission. Got %d, wants %d", got, entry.MinimumPermission)
+	}
+}
+
+func TestACLEntryHasAccess(t *testing.T) {
+	entry := &ACLEntry{
+		Service:           "jolie-deployer",
+		MinimumPermission: PFlagSeeJolieAll,
+		Rules: []*ACLRule{
+			{Method: "DELETE", Path: "/undeploy", MinimumPermission: PFlagManageJolieAll},
+		},
+	}
+
+	usr := &User{ID: "andersfylling", Permission: PermissionLvlUsr}
+	if !entry.HasAccess(usr, "GET", "/list") {
+		t.Error("user should have access to /list")
+	}
+	if entry.HasAccess(usr, "DELETE", "/undeploy") {
+		t.Error("user should not be able to undeploy")
+	}
+
+	dev := &User{ID: "dev", Permission: PermissionLvlDev}
+	if !entry.HasAccess(dev, "DELETE", "/undeploy") {
+		t.Error("developer should be able to undeploy")
+	}
+}
+
+func TestACLEntryUserLists(t *testing.T) {
+	entry := &ACLEntry{
+		Service:           "jolie-deployer",
+		MinimumPermission: PFlagDeployJolie,
+		AllowedUserIDs:    NewUserIDSet("guest"),
+		BlockedUserIDs:    NewUserIDSet("abuser"),
+	}
+
+	if entry.HasAccess(&User{ID: "abuser", Permission: PermissionLvlAdm}, "GET", "/") {
+		t.Error("blocked user should not have access")
+	}
+	if !entry.HasAccess(&User{ID: "guest"}, "GET", "/") {
+		t.Error("allowed user should have access")
+	}
+	if entry.HasAccess(&User{}, "GET", "/") {
+		t.Error("anonymous user should not have access")
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded *ACLEntry
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.BlockedUserIDs.Contains("abuser") || !decoded.AllowedUserIDs.Contains("guest") {
+		t.Errorf("user lists were lost in json. Got %s", string(data))
+	}
+}
+
+func TestParseUserIDs(t *testing.T) {
+	for _, value := range []string{`["a","b", "c"]`, "a,b,c", "a\nb\nc\n", " a, b c"} {
+		set, err := parseUserIDs(value)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := set.List(); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+			t.Errorf("incorrect user IDs for %q. Got %v", value, got)
+		}
+	}
+
+	if _, err := parseUserIDs(`["a",`); err == nil {
+		t.Error("expected an error for invalid json")
+	}
+}
+
+func TestAPIHandlerDotSegments(t *testing.T) {
+	backend := backendAddress(newJSONBackend(t))
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{{Name: "docs", Addresses: []string{backend}}}
+		snap.ACL = []*ACLEntry{{
+			Service:           "docs",
+			MinimumPermission: PFlagManageSrvAll,
+			Rules:             []*ACLRule{{Path: "/public/**", MinimumPermission: PermissionLvlNobody}},
+		}}
+	})
+	gateway := newTestGateway(t, state)
+
+	// the backend would resolve these to /admin
+	for _, path := range []string{"/api/docs/public/../admin", "/api/docs/public/%2e%2e/admin", "/api/docs/./public/../admin"} {
+		if resp, _ := getJSend(t, http.MethodGet, gateway.URL+path, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected dot segments to be refused. Got %s", path, resp.Status)
+		}
+	}
+	if resp, response := getJSend(t, http.MethodGet, gateway.URL+"/api/docs/public/..x/list", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected segments starting with dots to pass. Got %s %+v", resp.Status, response)
+	}
+}
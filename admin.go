@@ -0,0 +1,454 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// authorize verifies that the request holds a valid JWT with every permission flag in required.
+// The response is filled in and nil is returned if not.
+func (s *State) authorize(r *http.Request, required Permission, response *JSend) *User {
+	user, err := s.authenticate(r.Header)
+	if err != nil {
+		response.Status = JSendFail
+		response.Message = err.Error()
+		response.HTTPCode = http.StatusUnauthorized
+		return nil
+	}
+	if user.Permission&required != required {
+		response.Status = JSendFail
+		response.Message = "You do not have access to this resource"
+		response.HTTPCode = http.StatusForbidden
+		return nil
+	}
+	return user
+}
+
+func setupAdminRoutes(router *httprouter.Router, ACLState *State) {
+	// load balancer state of every service and user script
+	router.GET("/admin/upstreams", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ACLState.setupResponse(&w, r)
+
+		response := &JSend{
+			HTTPCode: http.StatusOK,
+		}
+		defer func(response *JSend) {
+			response.write(w)
+		}(response)
+
+		if ACLState.authorize(r, PFlagSeeClusterInfo, response) == nil {
+			return
+		}
+
+		data, err := json.Marshal(ACLState.upstreamStatus())
+		if err != nil {
+			response.Status = JSendError
+			response.Message = err.Error()
+			response.HTTPCode = http.StatusInternalServerError
+			return
+		}
+
+		response.Status = JSendSuccess
+		response.Data = data
+	})
+
+	setupConfigRoutes(router, ACLState)
+	setupWouldDenyRoutes(router, ACLState)
+	setupLockdownRoutes(router, ACLState)
+	setupHistoryRoutes(router, ACLState)
+}
+
+const adminMaxBody = 1 << 20
+
+// adminHandle wraps an admin endpoint. Only callers holding every flag in required get through,
+// and the response is written once handle returns.
+func (s *State) adminHandle(required Permission, handle func(r *http.Request, ps httprouter.Params, response *JSend)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		s.setupResponse(&w, r)
+
+		response := &JSend{
+			HTTPCode: http.StatusOK,
+		}
+		defer func(response *JSend) {
+			response.write(w)
+		}(response)
+
+		if s.authorize(r, required, response) == nil {
+			return
+		}
+		handle(r, ps, response)
+	}
+}
+
+// adminUser is the user making a change, empty when unknown
+func (s *State) adminUser(r *http.Request) UserID {
+	if user, err := s.authenticate(r.Header); err == nil {
+		return user.ID
+	}
+	return ""
+}
+
+func adminData(response *JSend, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		adminError(response, err)
+		return
+	}
+	response.Status = JSendSuccess
+	response.Data = data
+}
+
+func adminError(response *JSend, err error) {
+	response.Status = JSendError
+	response.Message = err.Error()
+	response.HTTPCode = http.StatusInternalServerError
+
+	switch err {
+	case errKVConflict, errPinned:
+		response.Status = JSendFail
+		response.HTTPCode = http.StatusConflict
+	case errNoConfigStore:
+		response.HTTPCode = http.StatusServiceUnavailable
+	}
+}
+
+func adminBadRequest(response *JSend, err error) {
+	response.Status = JSendFail
+	response.Message = err.Error()
+	response.HTTPCode = http.StatusBadRequest
+}
+
+func adminNotFound(response *JSend, what string) {
+	response.Status = JSendFail
+	response.Message = what + " not found"
+	response.HTTPCode = http.StatusNotFound
+}
+
+// adminWrite reads the cas parameter and the json body of a change, and returns the store to
+// write it to. The response is filled in and nil is returned on failure.
+func (s *State) adminWrite(r *http.Request, body interface{}, response *JSend) (configStore, uint64) {
+	store := s.configStore()
+	if store == nil {
+		adminError(response, errNoConfigStore)
+		return nil, 0
+	}
+	cas, err := parseCAS(r)
+	if err != nil {
+		adminBadRequest(response, err)
+		return nil, 0
+	}
+	if body != nil {
+		if err = json.NewDecoder(io.LimitReader(r.Body, adminMaxBody)).Decode(body); err != nil {
+			adminBadRequest(response, errors.New("invalid json body: "+err.Error()))
+			return nil, 0
+		}
+	}
+	return store, cas
+}
+
+// kvVersion is the version of a resource stored in the given keys, 0 if it does not exist
+func (s *State) kvVersion(keys ...string) uint64 {
+	store := s.configStore()
+	if store == nil {
+		return 0
+	}
+	return maxIndex(kvIndex(store.pairs(), keys...))
+}
+
+// adminACLEntry is an ACL entry with the index to pass as cas when changing it
+type adminACLEntry struct {
+	*ACLEntry
+	Index uint64 `json:"index"`
+}
+
+type adminRole struct {
+	*UserLevel
+	Index uint64 `json:"index"`
+}
+
+type adminConfig struct {
+	ACLConfigEntry
+	Index uint64 `json:"index"`
+}
+
+// adminACLEntry finds the ACL entry of a service. The allowed and blocked users are left out
+// unless showUsers is set.
+func (s *State) adminACLEntry(service string, showUsers bool) *adminACLEntry {
+	entry, ok := s.Snapshot().acl[service]
+	if !ok {
+		return nil
+	}
+	if !showUsers {
+		entry = withoutUsers(entry)
+	}
+	return &adminACLEntry{ACLEntry: entry}
+}
+
+// showUsers tells whether the caller may see who is explicitly allowed or blocked, which is only
+// for user managers, as at /configuration
+func (s *State) showUsers(r *http.Request) bool {
+	user, err := s.authenticate(r.Header)
+	return err == nil && user.Permission&PFlagUsersAll == PFlagUsersAll
+}
+
+// withoutUsers is a copy of an ACL entry without the allowed and blocked users
+func withoutUsers(entry *ACLEntry) *ACLEntry {
+	e := *entry
+	e.AllowedUserIDs = nil
+	e.BlockedUserIDs = nil
+	return &e
+}
+
+func (s *State) adminRole(role string) *adminRole {
+	for _, level := range s.Snapshot().PermissionDefaults {
+		if level.Role == role {
+			return &adminRole{UserLevel: level}
+		}
+	}
+	return nil
+}
+
+func (s *State) adminConfig(key string) *adminConfig {
+	for _, entry := range s.Snapshot().Config {
+		if entry.Key == key {
+			return &adminConfig{ACLConfigEntry: entry}
+		}
+	}
+	return nil
+}
+
+// setupConfigRoutes manages the ACL entries, role defaults and config keys. Changes are written to
+// the KV store, and require the index of the version they replace as cas query parameter, 0 when
+// creating. A 409 is returned when someone else changed it in the meantime, or while a version is
+// pinned, as the change would be held back.
+func setupConfigRoutes(router *httprouter.Router, ACLState *State) {
+	handle := func(method, path string, h func(r *http.Request, ps httprouter.Params, response *JSend)) {
+		if method != http.MethodGet {
+			change := h
+			h = func(r *http.Request, ps httprouter.Params, response *JSend) {
+				if ACLState.pinned() != "" {
+					adminError(response, errPinned)
+					return
+				}
+				change(r, ps, response)
+			}
+		}
+		router.Handle(method, path, ACLState.adminHandle(PFlagManageSrvAll, h))
+	}
+
+	// ACL entries
+	handle(http.MethodGet, "/admin/acl", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		acl := ACLState.Snapshot().ACL
+		showUsers := ACLState.showUsers(r)
+		entries := make([]*adminACLEntry, len(acl))
+		for i, entry := range acl {
+			if !showUsers {
+				entry = withoutUsers(entry)
+			}
+			entries[i] = &adminACLEntry{ACLEntry: entry}
+		}
+
+		for _, entry := range entries {
+			entry.Index = ACLState.kvVersion(aclEntryKeys(entry.Service)...)
+		}
+		adminData(response, entries)
+	})
+	handle(http.MethodGet, "/admin/acl/:service", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		entry := ACLState.adminACLEntry(ps.ByName("service"), ACLState.showUsers(r))
+		if entry == nil {
+			adminNotFound(response, "ACL entry")
+			return
+		}
+		entry.Index = ACLState.kvVersion(aclEntryKeys(entry.Service)...)
+		adminData(response, entry)
+	})
+	handle(http.MethodPut, "/admin/acl/:service", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		entry := &ACLEntry{}
+		store, cas := ACLState.adminWrite(r, entry, response)
+		if store == nil {
+			return
+		}
+		entry.Service = ps.ByName("service")
+		if err := entry.validate(); err != nil {
+			adminBadRequest(response, err)
+			return
+		}
+
+		// managers who can't see the users keep them as they are, see showUsers
+		var keep []string
+		if !ACLState.showUsers(r) {
+			if len(entry.AllowedUserIDs) > 0 || len(entry.BlockedUserIDs) > 0 {
+				response.Status = JSendFail
+				response.Message = "allowed_users and blocked_users require the PFlagUsersAll permission flag"
+				response.HTTPCode = http.StatusForbidden
+				return
+			}
+			keep = []string{KVACLAllow + entry.Service, KVACLBlock + entry.Service}
+		}
+		values, err := aclEntryValues(entry)
+		if err == nil {
+			err = kvWrite(store, values, cas, keep...)
+		}
+		if err != nil {
+			adminError(response, err)
+			return
+		}
+
+		adminData(response, &adminACLEntry{ACLEntry: entry, Index: ACLState.kvVersion(aclEntryKeys(entry.Service)...)})
+	})
+	handle(http.MethodDelete, "/admin/acl/:service", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		store, cas := ACLState.adminWrite(r, nil, response)
+		if store == nil {
+			return
+		}
+		keys := aclEntryKeys(ps.ByName("service"))
+		if ACLState.kvVersion(keys...) == 0 {
+			adminNotFound(response, "ACL entry")
+			return
+		}
+		values := map[string][]byte{}
+		for _, key := range keys {
+			values[key] = nil
+		}
+		if err := kvWrite(store, values, cas); err != nil {
+			adminError(response, err)
+			return
+		}
+		response.Status = JSendSuccess
+	})
+
+	// default permissions of roles
+	handle(http.MethodGet, "/admin/roles", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		levels := ACLState.Snapshot().PermissionDefaults
+		roles := make([]*adminRole, len(levels))
+		for i, level := range levels {
+			roles[i] = &adminRole{UserLevel: level}
+		}
+
+		for _, role := range roles {
+			role.Index = ACLState.kvVersion(KVRoles + role.Role)
+		}
+		adminData(response, roles)
+	})
+	handle(http.MethodGet, "/admin/roles/:role", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		role := ACLState.adminRole(ps.ByName("role"))
+		if role == nil {
+			adminNotFound(response, "role")
+			return
+		}
+		role.Index = ACLState.kvVersion(KVRoles + role.Role)
+		adminData(response, role)
+	})
+	handle(http.MethodPut, "/admin/roles/:role", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		level := &UserLevel{}
+		store, cas := ACLState.adminWrite(r, level, response)
+		if store == nil {
+			return
+		}
+		level.Role = ps.ByName("role")
+		if !validName(level.Role) {
+			adminBadRequest(response, errInvalidKVName)
+			return
+		}
+		key := KVRoles + level.Role
+		if err := kvWrite(store, map[string][]byte{key: []byte(level.Permission.Str())}, cas); err != nil {
+			adminError(response, err)
+			return
+		}
+
+		adminData(response, &adminRole{UserLevel: level, Index: ACLState.kvVersion(key)})
+	})
+	handle(http.MethodDelete, "/admin/roles/:role", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		store, cas := ACLState.adminWrite(r, nil, response)
+		if store == nil {
+			return
+		}
+		key := KVRoles + ps.ByName("role")
+		if ACLState.kvVersion(key) == 0 {
+			adminNotFound(response, "role")
+			return
+		}
+		if err := kvWrite(store, map[string][]byte{key: nil}, cas); err != nil {
+			adminError(response, err)
+			return
+		}
+		response.Status = JSendSuccess
+	})
+
+	// config keys
+	handle(http.MethodGet, "/admin/config", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		entries := ACLState.Snapshot().Config
+		config := make([]*adminConfig, len(entries))
+		for i, entry := range entries {
+			config[i] = &adminConfig{ACLConfigEntry: entry}
+		}
+
+		for _, entry := range config {
+			entry.Index = ACLState.kvVersion(KVConfig + entry.Key)
+		}
+		adminData(response, config)
+	})
+	handle(http.MethodGet, "/admin/config/:key", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		entry := ACLState.adminConfig(ps.ByName("key"))
+		if entry == nil {
+			adminNotFound(response, "config key")
+			return
+		}
+		entry.Index = ACLState.kvVersion(KVConfig + entry.Key)
+		adminData(response, entry)
+	})
+	handle(http.MethodPut, "/admin/config/:key", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		entry := &ACLConfigEntry{}
+		store, cas := ACLState.adminWrite(r, entry, response)
+		if store == nil {
+			return
+		}
+		entry.Key = ps.ByName("key")
+		if !validName(entry.Key) {
+			adminBadRequest(response, errInvalidKVName)
+			return
+		}
+		if entry.Val == nil {
+			adminBadRequest(response, errors.New("missing val"))
+			return
+		}
+
+		// strings are stored as is, other values as json
+		value, ok := entry.Val.(string)
+		if !ok {
+			data, err := json.Marshal(entry.Val)
+			if err != nil {
+				adminBadRequest(response, err)
+				return
+			}
+			value = string(data)
+		}
+		key := KVConfig + entry.Key
+		if err := kvWrite(store, map[string][]byte{key: []byte(value)}, cas); err != nil {
+			adminError(response, err)
+			return
+		}
+
+		adminData(response, &adminConfig{ACLConfigEntry: *entry, Index: ACLState.kvVersion(key)})
+	})
+	handle(http.MethodDelete, "/admin/config/:key", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		store, cas := ACLState.adminWrite(r, nil, response)
+		if store == nil {
+			return
+		}
+		key := KVConfig + ps.ByName("key")
+		if ACLState.kvVersion(key) == 0 {
+			adminNotFound(response, "config key")
+			return
+		}
+		if err := kvWrite(store, map[string][]byte{key: nil}, cas); err != nil {
+			adminError(response, err)
+			return
+		}
+		response.Status = JSendSuccess
+	})
+}
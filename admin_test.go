@@ -0,0 +1,161 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestAdminConfigAPI(t *testing.T) {
+	idp := newTestIssuer(t)
+	issuer, _ := json.Marshal(idp.config(AlgRS256))
+
+	consul := newFakeConsul()
+	consul.putKV(KVIssuers+"test", string(issuer))
+	state, _ := startFakeConsulDiscovery(t, consul)
+	eventually(t, "issuer", func() bool {
+		return len(state.Snapshot().Issuers) == 1
+	})
+	gateway := newTestGateway(t, state)
+
+	admin := idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}})
+	developer := idp.sign(t, AlgRS256, nil)
+	call := func(token, method, path, body string) (int, uint64) {
+		t.Helper()
+		req, _ := http.NewRequest(method, gateway.URL+path, strings.NewReader(body))
+		req.Header = authHeader(token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		response := &JSend{}
+		if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+		var version struct {
+			Index uint64 `json:"index"`
+		}
+		_ = json.Unmarshal(response.Data, &version)
+		return resp.StatusCode, version.Index
+	}
+	entry := func() *ACLEntry {
+		return state.ServiceACL(&Service{Name: "users"})
+	}
+
+	if status, _ := call(developer, http.MethodGet, "/admin/acl", ""); status != http.StatusForbidden {
+		t.Errorf("expected developers to be refused. Got %d", status)
+	}
+	if status, _ := call(admin, http.MethodPut, "/admin/acl/users", `{"min_permission":2}`); status != http.StatusBadRequest {
+		t.Errorf("expected missing cas to be refused. Got %d", status)
+	}
+	if status, _ := call(admin, http.MethodPut, "/admin/acl/users?cas=0", `{"rules":[{"path":"users"}]}`); status != http.StatusBadRequest {
+		t.Errorf("expected invalid rule to be refused. Got %d", status)
+	}
+	if status, _ := call(admin, http.MethodPut, "/admin/acl/users?cas=0", `{"mode":"audit"}`); status != http.StatusBadRequest {
+		t.Errorf("expected unknown mode to be refused. Got %d", status)
+	}
+
+	// created and applied right away
+	status, index := call(admin, http.MethodPut, "/admin/acl/users?cas=0",
+		`{"mode":"report-only","min_permission":2,"rules":[{"method":"DELETE","path":"/*","min_permission":4}],"blocked_users":["mallory"]}`)
+	if status != http.StatusOK || index == 0 {
+		t.Fatalf("expected entry to be created. Got %d %d", status, index)
+	}
+	if e := entry(); e == nil || e.Mode != ACLModeReportOnly || e.MinimumPermission != 2 || len(e.Rules) != 1 || !e.BlockedUserIDs.Contains("mallory") {
+		t.Fatalf("expected entry to be applied. Got %+v", e)
+	}
+	if status, _ = call(admin, http.MethodPut, "/admin/acl/users?cas=0", `{"min_permission":4}`); status != http.StatusConflict {
+		t.Errorf("expected existing entry not to be created again. Got %d", status)
+	}
+
+	// service managers only see who is allowed or blocked when they may manage users
+	manager := idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + strconv.FormatUint(uint64(PFlagManageSrvAll), 10)}})
+	for _, token := range []string{manager, admin} {
+		for _, path := range []string{"/admin/acl", "/admin/acl/users"} {
+			req, _ := http.NewRequest(http.MethodGet, gateway.URL+path, nil)
+			req.Header = authHeader(token)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if shown := strings.Contains(string(data), "mallory"); resp.StatusCode != http.StatusOK || shown != (token == admin) {
+				t.Errorf("%s: expected blocked users to be shown only to user managers. Got %d %s", path, resp.StatusCode, data)
+			}
+		}
+	}
+
+	// and keep them when replacing the entry, without changing them
+	if status, _ = call(manager, http.MethodPut, "/admin/acl/users?cas="+strconv.FormatUint(index, 10), `{"min_permission":2,"blocked_users":["eve"]}`); status != http.StatusForbidden {
+		t.Errorf("expected managers not to change blocked users. Got %d", status)
+	}
+	_, index = call(manager, http.MethodGet, "/admin/acl/users", "")
+	status, index = call(manager, http.MethodPut, "/admin/acl/users?cas="+strconv.FormatUint(index, 10), `{"min_permission":8}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected managers to replace the entry. Got %d", status)
+	}
+	eventually(t, "manager update", func() bool {
+		return entry().MinimumPermission == 8
+	})
+	if e := entry(); !e.BlockedUserIDs.Contains("mallory") {
+		t.Errorf("expected blocked users to be kept. Got %+v", e)
+	}
+
+	// removed fields delete their key
+	status, index = call(admin, http.MethodPut, "/admin/acl/users?cas="+strconv.FormatUint(index, 10), `{"min_permission":4}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected entry to be updated. Got %d", status)
+	}
+	consul.Lock()
+	_, blocked := consul.kv[KVACLBlock+"users"]
+	consul.Unlock()
+	if e := entry(); blocked || e.MinimumPermission != 4 || len(e.BlockedUserIDs) != 0 {
+		t.Errorf("expected blocked users to be removed. Got %+v", e)
+	}
+
+	// someone else changed the entry in the meantime
+	consul.putKV(KVACLEntry+"users", "8")
+	stale := "/admin/acl/users?cas=" + strconv.FormatUint(index, 10)
+	if status, _ = call(admin, http.MethodPut, stale, `{"min_permission":16}`); status != http.StatusConflict {
+		t.Errorf("expected stale update to conflict. Got %d", status)
+	}
+	if status, _ = call(admin, http.MethodDelete, stale, ""); status != http.StatusConflict {
+		t.Errorf("expected stale delete to conflict. Got %d", status)
+	}
+	eventually(t, "external change", func() bool {
+		return entry().MinimumPermission == 8
+	})
+	_, index = call(admin, http.MethodGet, "/admin/acl/users", "")
+	if status, _ = call(admin, http.MethodDelete, "/admin/acl/users?cas="+strconv.FormatUint(index, 10), ""); status != http.StatusOK {
+		t.Fatalf("expected entry to be deleted. Got %d", status)
+	}
+	if entry() != nil {
+		t.Error("expected entry to be removed from the state")
+	}
+
+	// roles and config
+	if status, _ = call(admin, http.MethodPut, "/admin/roles/support?cas=0", `{"permission":5}`); status != http.StatusOK {
+		t.Errorf("expected role to be created. Got %d", status)
+	}
+	if status, _ = call(admin, http.MethodPut, "/admin/config/retries?cas=0", `{"val":3}`); status != http.StatusOK {
+		t.Errorf("expected config key to be created. Got %d", status)
+	}
+	roles := state.Snapshot().PermissionDefaults
+	if len(roles) != 1 || roles[0].Role != "support" || roles[0].Permission != 5 {
+		t.Errorf("expected role to be applied. Got %+v", roles)
+	}
+	if got := state.lookupConfig("retries"); got != "3" {
+		t.Errorf("expected config key to be applied. Got %s", got)
+	}
+	if status, _ = call(admin, http.MethodDelete, "/admin/config/missing?cas=0", ""); status != http.StatusNotFound {
+		t.Errorf("expected unknown key not to be found. Got %d", status)
+	}
+}
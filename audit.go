@@ -0,0 +1,336 @@
+package aclsrv
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	auditGenesisHash     = "0000000000000000000000000000000000000000000000000000000000000000"
+	auditCheckpointEvery = 100 // records between two checkpoints
+)
+
+var errAudit = errors.New("unable to record the access decision, try again later")
+
+// AuditRecord is an access decision. Records are hash-chained: Hash covers the record, including
+// the hash of the previous record, such that edited, removed or reordered records are detected.
+type AuditRecord struct {
+	Seq        uint64     `json:"seq"`
+	Time       time.Time  `json:"time"`
+	IP         string     `json:"ip"`
+	UserID     UserID     `json:"uid,omitempty"`
+	Permission Permission `json:"permission"`
+	Service    string     `json:"service"`
+	Method     string     `json:"method"`
+	Path       string     `json:"path"`
+	Decision   string     `json:"decision"` // see DecisionAllowed
+	Rule       string     `json:"rule,omitempty"`
+	Reason     string     `json:"reason"`
+	PrevHash   string     `json:"prev_hash"`
+	Hash       string     `json:"hash,omitempty"`
+}
+
+// hash of the record without its own hash
+func (r *AuditRecord) hash() (string, error) {
+	record := *r
+	record.Hash = ""
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditCheckpoint is the head of the audit log at some point. The log is truncated when it no
+// longer holds the checkpoint record.
+type AuditCheckpoint struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+func (c *AuditCheckpoint) String() string {
+	data, _ := json.Marshal(struct {
+		Audit *AuditCheckpoint `json:"audit_checkpoint"`
+	}{c})
+	return string(data)
+}
+
+// AuditLog is an append-only file of hash-chained access decisions, one json record per line.
+// Every record is synced to disk before the request continues. A checkpoint of the head is kept in
+// <path>.head, which is rewritten every 100 records and when closing, so that truncation is detected.
+type AuditLog struct {
+	path string
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64 // of the verified records, a partially written record is cut off
+	head   AuditCheckpoint
+	closed bool
+
+	// checkpoint is called with every new checkpoint, eg. to copy it to the request logs
+	checkpoint func(c *AuditCheckpoint)
+
+	records uint64 // atomic
+	errors  uint64 // atomic
+}
+
+// OpenAuditLog opens or creates an audit log. An existing log is verified first, as records are
+// not appended to a broken chain.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	anchor, err := ReadAuditCheckpoint(path + ".head")
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	head, err := VerifyAuditLog(file, anchor)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("audit log %s: %v", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &AuditLog{
+		path: path,
+		file: file,
+		size: info.Size(),
+		head: *head,
+	}, nil
+}
+
+// ReadAuditCheckpoint reads a checkpoint file. Nil is returned if it does not exist.
+func ReadAuditCheckpoint(path string) (*AuditCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &AuditCheckpoint{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("audit checkpoint %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// writeCheckpoint replaces the checkpoint file. Must be called while holding a.mu
+func (a *AuditLog) writeCheckpoint() error {
+	data, err := json.Marshal(&a.head)
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".head.tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, a.path+".head"); err != nil {
+		return err
+	}
+
+	if a.checkpoint != nil {
+		c := a.head
+		a.checkpoint(&c)
+	}
+	return nil
+}
+
+// Record appends a record, and fills in its sequence number, time and hashes
+func (a *AuditLog) Record(r *AuditRecord) (err error) {
+	defer func() {
+		if err != nil {
+			atomic.AddUint64(&a.errors, 1)
+		}
+	}()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errLogSinkClosed
+	}
+
+	r.Seq = a.head.Seq + 1
+	r.Time = time.Now().UTC()
+	r.PrevHash = a.head.Hash
+	if r.Hash, err = r.hash(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	if _, err = a.file.Write(line); err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		// keep the chain intact for the next record
+		_ = a.file.Truncate(a.size)
+		return err
+	}
+	a.size += int64(len(line))
+	a.head = AuditCheckpoint{Seq: r.Seq, Hash: r.Hash}
+	atomic.AddUint64(&a.records, 1)
+
+	// the record is safe, a missing checkpoint only weakens truncation detection
+	if r.Seq%auditCheckpointEvery == 0 {
+		if err := a.writeCheckpoint(); err != nil {
+			log.Print("audit checkpoint: ", err)
+		}
+	}
+	return nil
+}
+
+// Head returns the last record
+func (a *AuditLog) Head() AuditCheckpoint {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.head
+}
+
+// Close writes a final checkpoint and closes the file
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+
+	err := a.writeCheckpoint()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// VerifyAuditLog checks the hash chain of every record, and that the log still holds every
+// anchor, such as the checkpoint file or a checkpoint copied from the request logs. The last
+// record is returned.
+func VerifyAuditLog(r io.Reader, anchors ...*AuditCheckpoint) (*AuditCheckpoint, error) {
+	expected := map[uint64]string{}
+	var last uint64
+	for _, anchor := range anchors {
+		if anchor == nil || anchor.Seq == 0 {
+			continue
+		}
+		expected[anchor.Seq] = anchor.Hash
+		if anchor.Seq > last {
+			last = anchor.Seq
+		}
+	}
+
+	head := &AuditCheckpoint{Hash: auditGenesisHash}
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("record %d is incomplete", head.Seq+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		record := &AuditRecord{}
+		if err = json.Unmarshal([]byte(strings.TrimSuffix(line, "\n")), record); err != nil {
+			return nil, fmt.Errorf("record %d: %v", head.Seq+1, err)
+		}
+		if record.Seq != head.Seq+1 {
+			return nil, fmt.Errorf("record %d: found sequence number %d", head.Seq+1, record.Seq)
+		}
+		if record.PrevHash != head.Hash {
+			return nil, fmt.Errorf("record %d: does not follow the previous record", record.Seq)
+		}
+		hash, err := record.hash()
+		if err != nil {
+			return nil, err
+		}
+		if hash != record.Hash {
+			return nil, fmt.Errorf("record %d: has been modified", record.Seq)
+		}
+		if anchor, ok := expected[record.Seq]; ok && anchor != record.Hash {
+			return nil, fmt.Errorf("record %d: does not match checkpoint", record.Seq)
+		}
+
+		head = &AuditCheckpoint{Seq: record.Seq, Hash: record.Hash}
+	}
+
+	if head.Seq < last {
+		return nil, fmt.Errorf("log is truncated: ends at record %d, but record %d was checkpointed", head.Seq, last)
+	}
+	return head, nil
+}
+
+// SetAuditLog records every access decision of /api in the audit log
+func (s *State) SetAuditLog(a *AuditLog) {
+	a.mu.Lock()
+	a.checkpoint = func(c *AuditCheckpoint) {
+		s.log(LogLvlINFO, c)
+	}
+	a.mu.Unlock()
+
+	s.Lock()
+	defer s.Unlock()
+	s.audit = a
+}
+
+func (s *State) auditLog() *AuditLog {
+	s.RLock()
+	defer s.RUnlock()
+	return s.audit
+}
+
+// recordDecision records an access decision in the audit log, if there is one. The response is
+// filled in and false is returned when it could not be recorded, as requests must not be allowed
+// without record.
+func (s *State) recordDecision(r *http.Request, user *User, service, path, decision, rule, reason string, response *JSend) bool {
+	a := s.auditLog()
+	if a == nil {
+		return true
+	}
+
+	err := a.Record(&AuditRecord{
+		IP:         clientIP(r),
+		UserID:     user.ID,
+		Permission: user.Permission,
+		Service:    service,
+		Method:     r.Method,
+		Path:       path,
+		Decision:   decision,
+		Rule:       rule,
+		Reason:     reason,
+	})
+	if err != nil {
+		log.Print("audit: ", err)
+		response.Status = JSendError
+		response.Message = errAudit.Error()
+		response.HTTPCode = http.StatusServiceUnavailable
+		return false
+	}
+	return true
+}
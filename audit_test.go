@@ -0,0 +1,184 @@
+package aclsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestAuditLog(t *testing.T) (*AuditLog, string) {
+	dir, err := ioutil.TempDir("", "acl-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	path := filepath.Join(dir, "audit.log")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return audit, path
+}
+
+func readAuditLines(t *testing.T, path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	return lines[:len(lines)-1]
+}
+
+func TestAuditLogChain(t *testing.T) {
+	audit, path := newTestAuditLog(t)
+	for _, decision := range []string{DecisionAllowed, DecisionDenied, DecisionAllowed} {
+		if err := audit.Record(&AuditRecord{Service: "users", Decision: decision}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chain continues after a restart
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = audit.Record(&AuditRecord{Service: "users", Decision: DecisionDenied}); err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+
+	lines := readAuditLines(t, path)
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 records. Got %d", len(lines))
+	}
+	verify := func(lines []string) error {
+		anchor, err := ReadAuditCheckpoint(path + ".head")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = VerifyAuditLog(strings.NewReader(strings.Join(lines, "")), anchor)
+		return err
+	}
+	if err = verify(lines); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := append([]string{}, lines...)
+	edited[1] = strings.Replace(edited[1], DecisionDenied, DecisionAllowed, 1)
+	if err = verify(edited); err == nil || !strings.Contains(err.Error(), "record 2: has been modified") {
+		t.Errorf("expected edit to be detected. Got %v", err)
+	}
+
+	removed := append([]string{lines[0]}, lines[2:]...)
+	if err = verify(removed); err == nil {
+		t.Error("expected removed record to be detected")
+	}
+
+	if err = verify(lines[:3]); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected truncation to be detected. Got %v", err)
+	}
+	if err = verify(append(lines[:3:3], `{"seq":4`)); err == nil {
+		t.Error("expected incomplete record to be detected")
+	}
+
+	// records are not appended to a broken log
+	if err = ioutil.WriteFile(path, []byte(strings.Join(lines[:2], "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenAuditLog(path); err == nil {
+		t.Error("expected truncated log to be refused")
+	}
+}
+
+// lockedBuffer can be read while the gateway writes request logs to it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAPIHandlerAudit(t *testing.T) {
+	idp := newTestIssuer(t)
+	audit, path := newTestAuditLog(t)
+
+	logs := &lockedBuffer{}
+	state := NewState()
+	state.SetLogOutputs(LogOutput{Sink: NewJSONSink(logs, "test"), MinLevel: LogLvlINFO})
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Config = []ACLConfigEntry{{Key: "jwt", Val: "true"}}
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backendAddress(newJSONBackend(t))}},
+		}
+		snap.ACL = []*ACLEntry{
+			{Service: "users", Rules: []*ACLRule{{Method: http.MethodDelete, Path: "/*", MinimumPermission: PFlagUsersAll}}},
+		}
+	})
+	state.SetAuditLog(audit)
+	gateway := newTestGateway(t, state)
+
+	send := func(method, path string, header http.Header) *http.Response {
+		req, _ := http.NewRequest(method, gateway.URL+path, nil)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	token := authHeader(idp.sign(t, AlgRS256, nil))
+	send(http.MethodGet, "/api/users/list", token)
+	send(http.MethodDelete, "/api/users/42", token)
+	send(http.MethodGet, "/api/users/list", nil)
+
+	audit.Close()
+	head, err := VerifyAuditLog(strings.NewReader(strings.Join(readAuditLines(t, path), "")))
+	if err != nil || head.Seq != 3 {
+		t.Fatalf("expected 3 valid records. Got %+v %v", head, err)
+	}
+	lines := readAuditLines(t, path)
+	expected := []string{
+		`"method":"GET","path":"/list","decision":"allowed","rule":"min_permission","reason":"user has the required permission"`,
+		`"method":"DELETE","path":"/42","decision":"denied","rule":"DELETE /*","reason":"user is missing permission 4"`,
+		`"method":"GET","path":"/list","decision":"no-jwt","rule":"jwt"`,
+	}
+	for i, wants := range expected {
+		if !strings.Contains(lines[i], wants) || !strings.Contains(lines[i], `"service":"users"`) {
+			t.Errorf("incorrect record %d. Got %s", i+1, lines[i])
+		}
+	}
+	// the request logs are written in the background
+	eventually(t, "checkpoint in the request logs", func() bool {
+		return strings.Contains(logs.String(), `"audit_checkpoint":{"seq":3,`)
+	})
+
+	// requests are rejected when their decision cannot be recorded
+	if resp := send(http.MethodGet, "/api/users/list", token); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected request to be rejected. Got %s", resp.Status)
+	}
+}
@@ -0,0 +1,83 @@
+package aclsrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var errMissingJWT = errors.New("Missing JWT in header. Supported fields: 'Authorization: Bearer <JWT>', 'jwt: <jwt>', 'JWT: <jwt>'")
+
+// authenticate verifies the JWT found in the request header and extracts the user info.
+// A user is always returned, but it is anonymous unless err is nil.
+func (s *State) authenticate(header http.Header) (user *User, err error) {
+	user = &User{}
+
+	tokenStr := getJWT(header)
+	if tokenStr == "" {
+		return user, errMissingJWT
+	}
+
+	var issuer *Issuer
+	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		iss, _ := claims["iss"].(string)
+		if issuer = s.issuer(iss); issuer == nil {
+			return nil, fmt.Errorf("untrusted issuer: %s", iss)
+		}
+
+		// Don't forget to validate the alg is what you expect:
+		if !issuer.allowsAlgorithm(token.Method.Alg()) {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, errors.New("unable to convert kid to string")
+		}
+
+		return s.getJWK(issuer, kid)
+	})
+	if token == nil {
+		return user, err
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if err == nil && !token.Valid {
+		err = errors.New("invalid token")
+	}
+	if err == nil {
+		err = issuer.verifyClaims(claims)
+	}
+	// claims of a token that failed verification can be forged, the user stays anonymous
+	if err == nil {
+		userFromClaims(user, claims)
+	}
+
+	return user, err
+}
+
+// userFromClaims extracts the username and the permission group ("p:<permission>")
+// from cognito claims
+func userFromClaims(user *User, claims jwt.MapClaims) {
+	if usrname, ok := claims["cognito:username"].(string); ok {
+		user.ID = UserID(usrname)
+	}
+
+	groups, _ := claims["cognito:groups"].([]interface{})
+	for i := range groups {
+		group, ok := groups[i].(string)
+		if !ok || !strings.HasPrefix(group, "p:") {
+			continue
+		}
+
+		if lvl, err := strconv.ParseUint(group[2:], 10, 32); err == nil {
+			user.Permission = Permission(lvl)
+		}
+		break
+	}
+}
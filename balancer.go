@@ -0,0 +1,288 @@
+package aclsrv
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// load balancing strategies
+const (
+	BalancerRoundRobin       = "round-robin"
+	BalancerLeastOutstanding = "least-outstanding"
+	BalancerPowerOfTwo       = "p2c" // power of two choices, on outstanding requests
+)
+
+const (
+	ejectThreshold  = 3 // consecutive failures before an address is ejected
+	ejectBackoff    = 5 * time.Second
+	ejectMaxBackoff = 2 * time.Minute
+	latencyWeight   = 0.3 // weight of the newest sample in the latency average
+)
+
+// endpoint tracks the outcome of requests to a single address of a service
+type endpoint struct {
+	address string
+
+	outstanding         int
+	requests            uint64
+	failures            uint64
+	consecutiveFailures int
+	latency             time.Duration // moving average
+
+	ejected      bool
+	ejectedUntil time.Time
+	backoff      time.Duration
+	probing      bool // a request is testing whether an ejected address has recovered
+}
+
+// available checks if the endpoint can receive requests. Ejected endpoints become available
+// for a single probe request once their backoff has passed.
+func (e *endpoint) available(now time.Time) bool {
+	return !e.ejected || (!e.probing && now.After(e.ejectedUntil))
+}
+
+// balancer spreads requests over the addresses of a service. Addresses that keep failing are
+// ejected for a backoff period, after which a single request probes if they have recovered.
+// A failed probe doubles the backoff.
+type balancer struct {
+	sync.Mutex
+	endpoints map[string]*endpoint // by address
+	rri       int                  // round robin index
+	rand      *rand.Rand
+}
+
+func newBalancer() *balancer {
+	return &balancer{
+		endpoints: map[string]*endpoint{},
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// pick selects an address using the given strategy. Addresses in exclude are skipped. When every
+// address is ejected, the one closest to the end of its backoff is used. Every picked address must
+// be reported back through done. Returns nil if there are no addresses left to pick from.
+func (b *balancer) pick(addresses []string, strategy string, exclude map[string]bool) *endpoint {
+	b.Lock()
+	defer b.Unlock()
+
+	// keep the stats of known addresses, and forget the ones that left
+	known := make(map[string]*endpoint, len(addresses))
+	for _, adr := range addresses {
+		if e, ok := b.endpoints[adr]; ok {
+			known[adr] = e
+		} else {
+			known[adr] = &endpoint{address: adr}
+		}
+	}
+	b.endpoints = known
+
+	now := time.Now()
+	var candidates, fallback []*endpoint
+	for _, adr := range addresses {
+		e := b.endpoints[adr]
+		if exclude[adr] {
+			continue
+		}
+		fallback = append(fallback, e)
+		if e.available(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(fallback) == 0 {
+		return nil
+	}
+	if len(candidates) == 0 {
+		// fail open rather than rejecting everything
+		sort.Slice(fallback, func(i, j int) bool {
+			return fallback[i].ejectedUntil.Before(fallback[j].ejectedUntil)
+		})
+		candidates = fallback[:1]
+	}
+
+	var e *endpoint
+	switch strategy {
+	case BalancerLeastOutstanding:
+		e = candidates[0]
+		for _, c := range candidates[1:] {
+			if c.outstanding < e.outstanding || (c.outstanding == e.outstanding && c.latency < e.latency) {
+				e = c
+			}
+		}
+	case BalancerPowerOfTwo:
+		i := b.rand.Intn(len(candidates))
+		e = candidates[i]
+		if len(candidates) > 1 {
+			// a second, distinct choice
+			j := b.rand.Intn(len(candidates) - 1)
+			if j >= i {
+				j++
+			}
+			if other := candidates[j]; other.outstanding < e.outstanding || (other.outstanding == e.outstanding && other.latency < e.latency) {
+				e = other
+			}
+		}
+	default:
+		b.rri = (b.rri + 1) % len(candidates)
+		e = candidates[b.rri]
+	}
+
+	if e.ejected {
+		e.probing = true
+	}
+	e.outstanding++
+	return e
+}
+
+// done reports the outcome of a request to an address picked by the balancer
+func (b *balancer) done(e *endpoint, failed bool, latency time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	e.outstanding--
+	e.requests++
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(e.latency))
+	}
+
+	if !failed {
+		e.consecutiveFailures = 0
+		e.ejected = false
+		e.probing = false
+		e.backoff = 0
+		return
+	}
+
+	e.failures++
+	e.consecutiveFailures++
+	switch {
+	case e.probing:
+		// still failing, wait longer before the next probe
+		e.probing = false
+		e.backoff *= 2
+		if e.backoff > ejectMaxBackoff {
+			e.backoff = ejectMaxBackoff
+		}
+		e.ejectedUntil = time.Now().Add(e.backoff)
+	case !e.ejected && e.consecutiveFailures >= ejectThreshold:
+		e.ejected = true
+		e.backoff = ejectBackoff
+		e.ejectedUntil = time.Now().Add(e.backoff)
+	}
+}
+
+// EndpointStatus is the state of a single address, as shown at /admin/upstreams
+type EndpointStatus struct {
+	Address             string     `json:"address"`
+	Outstanding         int        `json:"outstanding"`
+	Requests            uint64     `json:"requests"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LatencyMS           float64    `json:"latency_ms"`
+	Ejected             bool       `json:"ejected"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+}
+
+// status lists the given addresses. Addresses that have not been picked yet show up without stats.
+func (b *balancer) status(addresses []string) (endpoints []*EndpointStatus) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, adr := range addresses {
+		e, ok := b.endpoints[adr]
+		if !ok {
+			e = &endpoint{address: adr}
+		}
+		status := &EndpointStatus{
+			Address:             e.address,
+			Outstanding:         e.outstanding,
+			Requests:            e.requests,
+			Failures:            e.failures,
+			ConsecutiveFailures: e.consecutiveFailures,
+			LatencyMS:           float64(e.latency) / float64(time.Millisecond),
+			Ejected:             e.ejected,
+		}
+		if e.ejected {
+			until := e.ejectedUntil
+			status.EjectedUntil = &until
+		}
+		endpoints = append(endpoints, status)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Address < endpoints[j].Address
+	})
+	return endpoints
+}
+
+// failedStatus checks if a response status means the address is unhealthy
+func failedStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// upstreamPick is an address picked for a single request. done must be called once the
+// request has finished.
+type upstreamPick struct {
+	balancer *balancer
+	endpoint *endpoint
+	started  time.Time
+	latency  time.Duration // until the response headers arrived
+	observed bool
+	failed   bool
+	status   int // http status of the response, 0 if there is none
+
+	// set when the outcome is reported to the circuit breaker, see State.pickStream
+	breaker    *breaker
+	breakerCfg *Breaker
+	probe      bool
+}
+
+func (p *upstreamPick) address() string {
+	return p.endpoint.address
+}
+
+// observe records the response of the service, or the error if it could not be reached.
+// Errors caused by the client going away say nothing about the service and are ignored.
+func (p *upstreamPick) observe(r *http.Request, resp *http.Response, err error) {
+	if err != nil && r.Context().Err() == context.Canceled {
+		return
+	}
+	p.latency = time.Since(p.started)
+	p.observed = true
+	p.status = statusCode(resp)
+	p.failed = err != nil || failedStatus(p.status)
+}
+
+func (p *upstreamPick) done() {
+	if p.latency == 0 {
+		p.latency = time.Since(p.started)
+	}
+	p.balancer.done(p.endpoint, p.failed, p.latency)
+
+	switch {
+	case p.breaker == nil:
+	case p.observed:
+		p.breaker.record(p.breakerCfg, p.probe, p.failed)
+	default:
+		p.breaker.release(p.probe)
+	}
+}
+
+// transport observes every round trip made through base
+func (p *upstreamPick) transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp, err := base.RoundTrip(r)
+		p.observe(r, resp, err)
+		return resp, err
+	})
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
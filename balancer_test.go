@@ -0,0 +1,187 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestBalancerEjection(t *testing.T) {
+	addresses := []string{"a", "b", "c"}
+	b := newBalancer()
+
+	b.pick(addresses, BalancerRoundRobin, nil)
+
+	// b fails until ejected
+	for i := 0; i < ejectThreshold; i++ {
+		e := b.endpoints["b"]
+		e.outstanding++
+		b.done(e, true, time.Millisecond)
+	}
+	if !b.endpoints["b"].ejected {
+		t.Fatal("expected b to be ejected")
+	}
+	for i := 0; i < 10; i++ {
+		e := b.pick(addresses, BalancerRoundRobin, nil)
+		if e.address == "b" {
+			t.Fatal("ejected address was picked")
+		}
+		b.done(e, false, time.Millisecond)
+	}
+
+	// a single probe once the backoff has passed
+	b.endpoints["b"].ejectedUntil = time.Now().Add(-time.Second)
+	var probe *endpoint
+	for i := 0; i < 3; i++ {
+		e := b.pick(addresses, BalancerRoundRobin, nil)
+		if e.address == "b" {
+			if probe != nil {
+				t.Fatal("expected a single probe at a time")
+			}
+			probe = e
+		}
+	}
+	if probe == nil {
+		t.Fatal("expected b to be probed")
+	}
+
+	// a failed probe doubles the backoff
+	b.done(probe, true, time.Millisecond)
+	if e := b.endpoints["b"]; !e.ejected || e.backoff != 2*ejectBackoff {
+		t.Errorf("expected doubled backoff. Got %s", e.backoff)
+	}
+
+	// a successful probe brings it back
+	b.endpoints["b"].ejectedUntil = time.Now().Add(-time.Second)
+	for {
+		e := b.pick(addresses, BalancerRoundRobin, nil)
+		if e.address == "b" {
+			b.done(e, false, time.Millisecond)
+			break
+		}
+	}
+	if e := b.endpoints["b"]; e.ejected || e.consecutiveFailures != 0 {
+		t.Errorf("expected b to be healthy. Got %+v", e)
+	}
+}
+
+func TestBalancerEveryAddressEjected(t *testing.T) {
+	b := newBalancer()
+	b.pick([]string{"a", "b"}, BalancerRoundRobin, nil)
+	b.endpoints["a"].ejected, b.endpoints["a"].ejectedUntil = true, time.Now().Add(time.Hour)
+	b.endpoints["b"].ejected, b.endpoints["b"].ejectedUntil = true, time.Now().Add(time.Minute)
+
+	if e := b.pick([]string{"a", "b"}, BalancerRoundRobin, nil); e == nil || e.address != "b" {
+		t.Errorf("expected the address closest to recovery. Got %+v", e)
+	}
+	if e := b.pick([]string{"a"}, BalancerRoundRobin, map[string]bool{"a": true}); e != nil {
+		t.Errorf("expected no address. Got %+v", e)
+	}
+}
+
+func TestBalancerStrategies(t *testing.T) {
+	addresses := []string{"a", "b", "c"}
+
+	b := newBalancer()
+	busy := b.pick(addresses, BalancerLeastOutstanding, nil)
+	for i := 0; i < 10; i++ {
+		if e := b.pick(addresses, BalancerLeastOutstanding, nil); e == busy {
+			t.Fatal("expected the address with the fewest outstanding requests")
+		} else {
+			b.done(e, false, time.Millisecond)
+		}
+	}
+
+	// two choices never pick the busiest of three addresses
+	b = newBalancer()
+	b.pick(addresses, BalancerRoundRobin, nil)
+	busiest := b.endpoints["a"]
+	busiest.outstanding = 100
+	b.endpoints["b"].outstanding = 1
+	for i := 0; i < 50; i++ {
+		e := b.pick(addresses, BalancerPowerOfTwo, nil)
+		if e == busiest {
+			t.Fatal("busiest address was picked")
+		}
+		b.done(e, false, time.Millisecond)
+	}
+}
+
+func TestAPIHandlerEjectsDeadAddress(t *testing.T) {
+	idp := newTestIssuer(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backendAddress(backend), backendAddress(dead)}},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	var failures int
+	for i := 0; i < 20; i++ {
+		resp, err := http.Get(gateway.URL + "/api/users/list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := &JSend{}
+		err = json.NewDecoder(resp.Body).Decode(response)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != JSendSuccess {
+			failures++
+		}
+	}
+	if failures != ejectThreshold {
+		t.Errorf("expected requests to stop failing once the address is ejected. Got %d failures", failures)
+	}
+
+	// stats
+	req, _ := http.NewRequest(http.MethodGet, gateway.URL+"/admin/upstreams", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected stats to require a JWT. Got %s", resp.Status)
+	}
+
+	req.Header = authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var upstreams []*UpstreamStatus
+	response := &JSend{}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(response.Data, &upstreams); err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 1 || len(upstreams[0].Endpoints) != 2 {
+		t.Fatalf("unexpected upstreams: %+v", upstreams)
+	}
+	for _, e := range upstreams[0].Endpoints {
+		if ejected := e.Address == backendAddress(dead); e.Ejected != ejected {
+			t.Errorf("%s: got ejected %t, wants %t", e.Address, e.Ejected, ejected)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package aclsrv
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var errCircuitOpen = errors.New("service is failing, circuit breaker is open")
+
+// defaults when not configured
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+	defaultBreakerProbes   = 1
+)
+
+// Breaker holds the circuit breaker settings of a service or user script
+type Breaker struct {
+	// Failures is the number of consecutive failed requests that opens the breaker
+	Failures int `json:"failures,omitempty"`
+
+	// Cooldown is how long the breaker stays open before requests are let through again
+	Cooldown Duration `json:"cooldown,omitempty"`
+
+	// Probes is the number of concurrent requests let through while half-open
+	Probes int `json:"probes,omitempty"`
+}
+
+func (b *Breaker) failures() int {
+	if b.Failures > 0 {
+		return b.Failures
+	}
+	return defaultBreakerFailures
+}
+
+func (b *Breaker) cooldown() time.Duration {
+	if b.Cooldown > 0 {
+		return time.Duration(b.Cooldown)
+	}
+	return defaultBreakerCooldown
+}
+
+func (b *Breaker) probes() int {
+	if b.Probes > 0 {
+		return b.Probes
+	}
+	return defaultBreakerProbes
+}
+
+// breaker fails requests fast while a service keeps failing. After the cooldown it becomes
+// half-open and lets a few probe requests through: a successful probe closes the breaker,
+// while a failed probe opens it again.
+type breaker struct {
+	sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probes              int // in flight while half-open
+}
+
+func newBreaker() *breaker {
+	return &breaker{state: BreakerClosed}
+}
+
+// allow checks if a request may be sent to the service. Every allowed request must be reported
+// back through record or release, with the returned probe value.
+func (b *breaker) allow(cfg *Breaker) (probe bool, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= cfg.cooldown() {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return false, false
+	case BreakerHalfOpen:
+		if b.probes >= cfg.probes() {
+			return false, false
+		}
+		b.probes++
+		return true, true
+	}
+	return false, true
+}
+
+// record reports the outcome of an allowed request
+func (b *breaker) record(cfg *Breaker, probe, failed bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if probe && b.state == BreakerHalfOpen {
+		b.probes--
+	}
+
+	if !failed {
+		b.consecutiveFailures = 0
+		if b.state == BreakerHalfOpen {
+			b.state = BreakerClosed
+		}
+		return
+	}
+
+	b.consecutiveFailures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.consecutiveFailures >= cfg.failures()) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives back an allowed request whose outcome says nothing about the service,
+// such as when the client went away
+func (b *breaker) release(probe bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if probe && b.state == BreakerHalfOpen {
+		b.probes--
+	}
+}
+
+// BreakerStatus is the state of a circuit breaker, as shown at /admin/upstreams
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *breaker) status() *BreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	status := &BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
@@ -0,0 +1,112 @@
+package aclsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerHalfOpen(t *testing.T) {
+	cfg := &Breaker{Failures: 2, Cooldown: Duration(time.Millisecond), Probes: 1}
+	b := newBreaker()
+
+	for i := 0; i < cfg.Failures; i++ {
+		probe, ok := b.allow(cfg)
+		if !ok {
+			t.Fatal("expected closed breaker to allow requests")
+		}
+		b.record(cfg, probe, true)
+	}
+	if _, ok := b.allow(cfg); ok {
+		t.Fatal("expected open breaker to reject requests")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	probe, ok := b.allow(cfg)
+	if !ok || !probe {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if _, ok = b.allow(cfg); ok {
+		t.Error("expected a single probe at a time")
+	}
+
+	// a released probe frees the slot
+	b.release(probe)
+	if probe, ok = b.allow(cfg); !ok {
+		t.Fatal("expected the probe slot to be freed")
+	}
+	b.record(cfg, probe, false)
+	if status := b.status(); status.State != BreakerClosed {
+		t.Errorf("expected closed breaker. Got %s", status.State)
+	}
+}
+
+func TestAPIHandlerBreaker(t *testing.T) {
+	var failing int32
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{
+			{
+				Name:      "jolie-deployer",
+				Addresses: []string{backendAddress(backend)},
+				Upstream: Upstream{
+					Breaker: Breaker{Failures: 3, Cooldown: Duration(200 * time.Millisecond)},
+				},
+			},
+		}
+	})
+	gateway := newTestGateway(t, state)
+	breakerState := func() string {
+		return state.upstream(streamRouteAPI, "jolie-deployer").breaker.status().State
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < 3; i++ {
+		_, response := getJSend(t, http.MethodGet, gateway.URL+"/api/jolie-deployer/list", "")
+		if response.InternalHTTPCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected service response. Got %+v", response)
+		}
+	}
+	if got := breakerState(); got != BreakerOpen {
+		t.Fatalf("expected open breaker. Got %s", got)
+	}
+
+	// fail fast
+	resp, response := getJSend(t, http.MethodGet, gateway.URL+"/api/jolie-deployer/list", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || response.ErrorCode != ErrCodeCircuitOpen {
+		t.Errorf("expected circuit open error. Got %s %+v", resp.Status, response)
+	}
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Errorf("expected no request to reach the service. Got %d", got)
+	}
+
+	// a failed probe opens it again
+	time.Sleep(250 * time.Millisecond)
+	getJSend(t, http.MethodGet, gateway.URL+"/api/jolie-deployer/list", "")
+	if got := breakerState(); got != BreakerOpen {
+		t.Fatalf("expected breaker to open after a failed probe. Got %s", got)
+	}
+
+	// recovered
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(250 * time.Millisecond)
+	if _, response = getJSend(t, http.MethodGet, gateway.URL+"/api/jolie-deployer/list", ""); response.Status != JSendSuccess {
+		t.Errorf("expected probe to succeed. Got %+v", response)
+	}
+	if got := breakerState(); got != BreakerClosed {
+		t.Errorf("expected closed breaker. Got %s", got)
+	}
+}
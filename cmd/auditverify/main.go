@@ -0,0 +1,63 @@
+// Command auditverify checks the hash chain of an ACL audit log, and that it has not been
+// truncated since the last checkpoint.
+//
+//	auditverify [-head audit.log.head] [-seq N -hash H] audit.log
+//
+// The checkpoint file next to the log is used by default. A checkpoint copied from the request
+// logs can be given with -seq and -hash. Exits with status 1 when the log is broken.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"aclsrv"
+)
+
+func main() {
+	head := flag.String("head", "", "checkpoint file (default <log>.head)")
+	seq := flag.Uint64("seq", 0, "sequence number of a checkpoint")
+	hash := flag.String("hash", "", "hash of the checkpoint record")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	var anchors []*aclsrv.AuditCheckpoint
+	if *seq > 0 {
+		anchors = append(anchors, &aclsrv.AuditCheckpoint{Seq: *seq, Hash: *hash})
+	}
+
+	headPath := *head
+	if headPath == "" {
+		headPath = path + ".head"
+	}
+	checkpoint, err := aclsrv.ReadAuditCheckpoint(headPath)
+	if err != nil {
+		fail(err)
+	}
+	if checkpoint == nil && *head != "" {
+		fail(fmt.Errorf("checkpoint %s does not exist", *head))
+	}
+	anchors = append(anchors, checkpoint)
+
+	file, err := os.Open(path)
+	if err != nil {
+		fail(err)
+	}
+	defer file.Close()
+
+	last, err := aclsrv.VerifyAuditLog(file, anchors...)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("ok: %d records, last hash %s\n", last.Seq, last.Hash)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "audit log is broken:", err)
+	os.Exit(1)
+}
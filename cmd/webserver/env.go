@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt reads an integer from the environment, or returns fallback when it is not set
+func envInt(env string, fallback int) int {
+	value := os.Getenv(env)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		panic(env + ": " + err.Error())
+	}
+	return n
+}
+
+// envDuration reads a duration, eg. 24h, from the environment, or returns fallback when it is not set
+func envDuration(env string, fallback time.Duration) time.Duration {
+	value := os.Getenv(env)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(env + ": " + err.Error())
+	}
+	return d
+}
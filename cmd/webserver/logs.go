@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+	"os"
+
+	"aclsrv"
+)
+
+const (
+	defaultLogFileMaxSize = 100 // MB
+	defaultLogFileBackups = 5
+)
+
+// logLevel reads the minimum level of a sink. OFF disables the sink.
+func logLevel(env string) int {
+	value := os.Getenv(env)
+	if value == "" {
+		return aclsrv.LogLvlINFO
+	}
+	level, err := aclsrv.ParseLogLevel(value)
+	if err != nil {
+		panic(env + ": " + err.Error())
+	}
+	return level
+}
+
+// logOutputs configures the request log sinks from the environment:
+//   - stdout: LOG_STDOUT_LEVEL
+//   - the logging service: LOGGER_URL, LOGGER_LEVEL
+//   - a rotated file: LOG_FILE, LOG_FILE_LEVEL, LOG_FILE_MAX_SIZE (MB), LOG_FILE_BACKUPS
+//   - syslog: LOG_SYSLOG (eg. udp://syslog:514), LOG_SYSLOG_LEVEL
+func logOutputs() (outputs []aclsrv.LogOutput) {
+	add := func(sink aclsrv.LogSink, level int) {
+		outputs = append(outputs, aclsrv.LogOutput{Sink: sink, MinLevel: level})
+	}
+
+	if level := logLevel("LOG_STDOUT_LEVEL"); level != aclsrv.LogLvlOff {
+		add(aclsrv.NewStdoutSink(), level)
+	}
+
+	if level := logLevel("LOGGER_LEVEL"); level != aclsrv.LogLvlOff {
+		loggerURL := os.Getenv("LOGGER_URL")
+		if loggerURL == "" {
+			loggerURL = aclsrv.DefaultLoggerURL
+		}
+		add(aclsrv.NewLogShipper(loggerURL), level)
+	}
+
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		if level := logLevel("LOG_FILE_LEVEL"); level != aclsrv.LogLvlOff {
+			maxSize := int64(envInt("LOG_FILE_MAX_SIZE", defaultLogFileMaxSize)) << 20
+			file, err := aclsrv.NewFileSink(path, maxSize, envInt("LOG_FILE_BACKUPS", defaultLogFileBackups))
+			if err != nil {
+				panic(err)
+			}
+			add(file, level)
+		}
+	}
+
+	if address := os.Getenv("LOG_SYSLOG"); address != "" {
+		if level := logLevel("LOG_SYSLOG_LEVEL"); level != aclsrv.LogLvlOff {
+			u, err := url.Parse(address)
+			if err != nil {
+				panic("LOG_SYSLOG: " + err.Error())
+			}
+			syslog, err := aclsrv.NewSyslogSink(u.Scheme, u.Host, "acl")
+			if err != nil {
+				panic("LOG_SYSLOG: " + err.Error())
+			}
+			add(syslog, level)
+		}
+	}
+
+	return outputs
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"aclsrv"
 	"github.com/julienschmidt/httprouter"
@@ -20,18 +24,80 @@ func main() {
 	// ACL state to hold all configs and such
 	ACLState := aclsrv.NewState()
 
+	ACLState.SetLogOutputs(logOutputs()...)
+
+	// versions of the configuration kept for rollback through /admin/history
+	ACLState.SetHistorySize(envInt("ACL_HISTORY_SIZE", aclsrv.DefaultHistorySize))
+
+	// record every access decision
+	var audit *aclsrv.AuditLog
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		var err error
+		if audit, err = aclsrv.OpenAuditLog(path); err != nil {
+			panic(err)
+		}
+		ACLState.SetAuditLog(audit)
+	}
+
+	// share rate limits and quotas with the other replicas
+	if address := os.Getenv("REDIS_ADDRESS"); address != "" {
+		ACLState.SetRateLimitStore(aclsrv.NewRedisStore(address, os.Getenv("REDIS_PASSWORD")))
+	}
+
 	router := httprouter.New()
 
 	consul, err := aclsrv.NewConsul(nil, "./service.json")
 	if err != nil {
 		panic(err)
 	}
-	consul.HealthCheck(router)
-	consul.Register()
+	consul.HealthCheck(router, ACLState)
 
 	aclsrv.SetupRoutes(router, ACLState)
 
+	// serve the last known state while consul is unavailable
+	if path := os.Getenv("STATE_FILE"); path != "" {
+		if err := ACLState.LoadStateFile(path, envDuration("STATE_FILE_MAX_AGE", aclsrv.DefaultStateFileMaxAge)); err != nil {
+			log.Print("state file: ", err)
+		}
+	}
 
+	// keep services, user scripts and ACL entries up to date. DISCOVERY_FILE reads them from
+	// a json or yaml file instead of consul, to run without any outside services
+	var discovery aclsrv.Discovery
+	if path := os.Getenv("DISCOVERY_FILE"); path != "" {
+		discovery = aclsrv.NewFileDiscovery(path, ACLState)
+	} else {
+		consul.RegisterInBackground()
+		discovery = aclsrv.NewConsulDiscovery(nil, aclsrv.ConsulAddress, ACLState)
+	}
+	discovery.Start()
 
-	log.Fatal(http.ListenAndServe(":" + port, router))
+
+
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// finish requests and ship the remaining logs before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	discovery.Stop()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Print("shutdown: ", err)
+	}
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			log.Print("audit: ", err)
+		}
+	}
+	if err := ACLState.CloseLogs(ctx); err != nil {
+		log.Print("logs: ", err)
+	}
 }
@@ -3,16 +3,21 @@ package aclsrv
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/julienschmidt/httprouter"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 const ConsulAddress = "http://consul-node:8500"
 
+// consulRegisterRetry is the pause after a failed registration
+const consulRegisterRetry = 5 * time.Second
+
 type ConsulCheck struct {
 	HTTP     string   `json:"HTTP,omitempty"`
 	Interval string   `json:"interval,omitempty"`
@@ -117,17 +122,31 @@ func (c *consul) LoadSrvDef(file string) (err error) {
 	return
 }
 
-func (c *consul) HealthCheck(router *httprouter.Router) {
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded" // serving, but see Health.Reason
+)
+
+type Health struct {
+	Status string        `json:"status"`
+	Reason string        `json:"reason,omitempty"`
+	JWKS   []*JWKSStatus `json:"jwks,omitempty"`
+}
+
+func (c *consul) HealthCheck(router *httprouter.Router, state *State) {
 	router.GET("/health", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		response := &JSend{}
 		response.Status = JSendSuccess
 		response.Data = []byte(`{"status":"ok"}`)
+		if data, err := json.Marshal(state.Health()); err == nil {
+			response.Data = data
+		}
 
 		response.write(w)
 	})
 }
 
-func (c *consul) Register() {
+func (c *consul) Register() error {
 	if c.srv.Name == "" {
 		panic("have not loaded service definition from file")
 	}
@@ -140,16 +159,36 @@ func (c *consul) Register() {
 	const url = "http://consul-node:8500/v1/agent/service/register"
 	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	req.Header.Add("Content-Type", "application/json")
 	resp, err := c.client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	resp.Body.Close()
 
 	c.registerred = resp.StatusCode == http.StatusOK
+	if !c.registerred {
+		return errors.New("consul responded " + resp.Status)
+	}
+	return nil
+}
+
+// RegisterInBackground registers the service, retrying until consul accepts it, so requests are
+// served from the state file while consul is unavailable
+func (c *consul) RegisterInBackground() {
+	go func() {
+		for {
+			err := c.Register()
+			if err == nil {
+				return
+			}
+			log.Print("consul register: ", err)
+			time.Sleep(consulRegisterRetry)
+		}
+	}()
 }
 func (c *consul) Deregister() {
 	if c.srv.Name == "" {
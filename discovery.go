@@ -0,0 +1,547 @@
+package aclsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consul tags that exposes a service through the ACL
+const (
+	TagPlatformEndpoint = "platform-endpoint" // reachable at /api/<service>
+	TagUserEndpoint     = "user-endpoint"     // reachable at /script/<token>
+	TagProxyStream      = "proxy-stream"      // use ProxyModeStream for the service
+)
+
+// consul KV keys, suffixed by a service name, role or config key
+const (
+	KVACLEntry  = ConsulKVPrefix + "ACLEntry_"
+	KVACLRules  = ConsulKVPrefix + "ACLEntry-rules_"
+	KVACLAllow  = ConsulKVPrefix + "ACLEntry-allow_"
+	KVACLBlock  = ConsulKVPrefix + "ACLEntry-block_"
+	KVConfig    = ConsulKVPrefix + "ACLEntry-config_"
+	KVRoles     = ConsulKVPrefix + "ACLEntry-plvl_"
+	KVIssuers   = ConsulKVPrefix + "ACLEntry-issuer_"
+	KVProxy     = ConsulKVPrefix + "ACLEntry-proxy_"
+	KVUpstream  = ConsulKVPrefix + "ACLEntry-upstream_"
+	KVRateLimit = ConsulKVPrefix + "ACLEntry-ratelimit_"
+	KVQuota     = ConsulKVPrefix + "ACLEntry-quota_"
+	KVACLMode   = ConsulKVPrefix + "ACLEntry-mode_"
+	KVLockdown  = ConsulKVPrefix + "ACLEntry-lockdown_"
+)
+
+// user scripts are assumed to listen on this port
+const userScriptPort = 8080
+
+type consulKVPair struct {
+	Key         string `json:"Key"`
+	Value       []byte `json:"Value"` // base64 encoded by consul, decoded by encoding/json
+	ModifyIndex uint64 `json:"ModifyIndex"`
+}
+
+type consulHealthEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+func (e *consulHealthEntry) address(port int) string {
+	adr := e.Service.Address
+	if adr == "" {
+		adr = e.Node.Address
+	}
+	if port == 0 {
+		port = e.Service.Port
+	}
+
+	return adr + ":" + strconv.Itoa(port)
+}
+
+// Discovery keeps the services, user scripts and ACL configuration of a state up to date,
+// see ConsulDiscovery and FileDiscovery
+type Discovery interface {
+	Start()
+	Stop()
+}
+
+// NewConsulDiscovery creates a service discovery watcher that fills the given state
+// using blocking queries against the consul HTTP API found at address.
+func NewConsulDiscovery(client *http.Client, address string, state *State) *ConsulDiscovery {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &ConsulDiscovery{
+		address:  strings.TrimRight(address, "/"),
+		client:   client,
+		state:    state,
+		wait:     5 * time.Minute,
+		retry:    time.Second,
+		ctx:      ctx,
+		cancel:   cancel,
+		catalog:  map[string][]string{},
+		health:   map[string][]*consulHealthEntry{},
+		watchers: map[string]context.CancelFunc{},
+	}
+	// admin changes are written back to the KV store
+	state.setConfigStore(d)
+	return d
+}
+
+// ConsulDiscovery watches the consul catalog, the health of every service tagged as
+// an endpoint and the srv-acl_ KV prefix. Whenever one of them changes, the services,
+// user scripts, ACL entries, roles and config of the state are rebuilt.
+type ConsulDiscovery struct {
+	address string
+	client  *http.Client
+	state   *State
+	wait    time.Duration // max duration of a blocking query
+	retry   time.Duration // pause after a failed query
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	catalog  map[string][]string // service name => tags
+	health   map[string][]*consulHealthEntry
+	watchers map[string]context.CancelFunc
+	kv       []*consulKVPair
+	kvLoaded bool // nothing is applied before, as services would be open without their ACL entries
+}
+
+// Start begins watching consul in the background
+func (d *ConsulDiscovery) Start() {
+	d.wg.Add(2)
+	go d.watchCatalog()
+	go d.watchKV()
+}
+
+// Stop cancels every blocking query and waits for the watchers to exit
+func (d *ConsulDiscovery) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// blockingQuery runs a consul blocking query and decodes the json response into v.
+// The returned index should be passed on to the next query.
+func (d *ConsulDiscovery) blockingQuery(path string, params url.Values, index uint64, v interface{}) (uint64, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("index", strconv.FormatUint(index, 10))
+	params.Set("wait", strconv.FormatInt(int64(d.wait/time.Millisecond), 10)+"ms")
+
+	req, err := http.NewRequest(http.MethodGet, d.address+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return index, err
+	}
+	resp, err := d.client.Do(req.WithContext(d.ctx))
+	if err != nil {
+		return index, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return index, err
+	}
+
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return index, errors.New("missing X-Consul-Index in consul response for " + path)
+	}
+	if newIndex < index {
+		// the index went backwards, consul suggests starting over
+		newIndex = 0
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return newIndex, json.Unmarshal(body, v)
+	case http.StatusNotFound:
+		// KV lookups without any keys. Leave v empty
+		return newIndex, nil
+	default:
+		return index, errors.New("unexpected consul response for " + path + ": " + resp.Status)
+	}
+}
+
+// pause sleeps after a failed query. Returns false if the discovery was stopped.
+func (d *ConsulDiscovery) pause(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d.retry):
+		return true
+	}
+}
+
+func (d *ConsulDiscovery) watchCatalog() {
+	defer d.wg.Done()
+
+	var index uint64
+	for {
+		var services map[string][]string
+		newIndex, err := d.blockingQuery("/v1/catalog/services", nil, index, &services)
+		if d.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Print("consul catalog: ", err)
+			if !d.pause(d.ctx) {
+				return
+			}
+			continue
+		}
+		if newIndex == index {
+			continue
+		}
+		index = newIndex
+
+		d.mu.Lock()
+		d.catalog = map[string][]string{}
+		for name, tags := range services {
+			if hasTag(tags, TagPlatformEndpoint) || hasTag(tags, TagUserEndpoint) {
+				d.catalog[name] = tags
+			}
+		}
+
+		// start watching the health of new endpoints, and stop watching removed ones
+		for name := range d.catalog {
+			if _, ok := d.watchers[name]; !ok {
+				ctx, cancel := context.WithCancel(d.ctx)
+				d.watchers[name] = cancel
+				d.wg.Add(1)
+				go d.watchHealth(ctx, name)
+			}
+		}
+		for name, cancel := range d.watchers {
+			if _, ok := d.catalog[name]; !ok {
+				cancel()
+				delete(d.watchers, name)
+				delete(d.health, name)
+			}
+		}
+		d.apply()
+		d.mu.Unlock()
+	}
+}
+
+func (d *ConsulDiscovery) watchHealth(ctx context.Context, name string) {
+	defer d.wg.Done()
+
+	params := url.Values{}
+	params.Set("passing", "1")
+
+	var index uint64
+	for {
+		var entries []*consulHealthEntry
+		newIndex, err := d.blockingQuery("/v1/health/service/"+url.PathEscape(name), params, index, &entries)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Print("consul health of "+name+": ", err)
+			if !d.pause(ctx) {
+				return
+			}
+			continue
+		}
+		if newIndex == index {
+			continue
+		}
+		index = newIndex
+
+		d.mu.Lock()
+		if ctx.Err() == nil {
+			d.health[name] = entries
+			d.apply()
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (d *ConsulDiscovery) watchKV() {
+	defer d.wg.Done()
+
+	params := url.Values{}
+	params.Set("recurse", "1")
+
+	var index uint64
+	for {
+		var pairs []*consulKVPair
+		newIndex, err := d.blockingQuery("/v1/kv/"+ConsulKVPrefix, params, index, &pairs)
+		if d.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Print("consul kv: ", err)
+			if !d.pause(d.ctx) {
+				return
+			}
+			continue
+		}
+		if newIndex == index {
+			continue
+		}
+		index = newIndex
+
+		d.mu.Lock()
+		d.kv, d.kvLoaded = pairs, true
+		d.apply()
+		d.mu.Unlock()
+	}
+}
+
+// apply rebuilds the discovered data and replaces it in the state, once the KV store was read.
+// Must be called while holding d.mu
+func (d *ConsulDiscovery) apply() {
+	if !d.kvLoaded {
+		return
+	}
+	services, scripts := d.buildServices()
+	kv, err := buildKV(d.kv)
+	if err != nil {
+		d.state.metrics.observeSnapshot(SnapshotSourceConsul, SnapshotRejected)
+		log.Print("consul: keeping the previous state, as the update is invalid: ", err)
+		return
+	}
+	for _, srv := range services {
+		if mode, ok := kv.Proxy[srv.Name]; ok {
+			srv.Proxy = mode
+		}
+		if upstream, ok := kv.Upstream[srv.Name]; ok {
+			srv.Upstream = *upstream
+		}
+	}
+	for _, srv := range scripts {
+		if upstream, ok := kv.Upstream[srv.Name]; ok {
+			srv.Upstream = *upstream
+		}
+	}
+
+	_, err = d.state.applySnapshot(SnapshotSourceConsul, &Snapshot{
+		Services:           services,
+		ACL:                kv.ACL,
+		UserScripts:        scripts,
+		PermissionDefaults: kv.Roles,
+		Config:             kv.Config,
+		Issuers:            kv.Issuers,
+		RateLimits:         kv.RateLimits,
+		Lockdowns:          kv.Lockdowns,
+	})
+	if err != nil {
+		log.Print("consul: keeping the previous state, as the update is invalid: ", err)
+	}
+}
+
+func (d *ConsulDiscovery) buildServices() (services, scripts []*Service) {
+	names := make([]string, 0, len(d.catalog))
+	for name := range d.catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entries := d.health[name]
+		if len(entries) == 0 {
+			continue
+		}
+
+		tags := d.catalog[name]
+		if hasTag(tags, TagPlatformEndpoint) {
+			srv := &Service{
+				Name: strings.Replace(name, "--", "-", -1),
+			}
+			if hasTag(tags, TagProxyStream) {
+				srv.Proxy = ProxyModeStream
+			}
+			for _, entry := range entries {
+				srv.Addresses = append(srv.Addresses, entry.address(0))
+			}
+			services = append(services, srv)
+		}
+		if hasTag(tags, TagUserEndpoint) {
+			srv := &Service{
+				Name: strings.Replace(name, "deployment", "", -1),
+			}
+			for _, entry := range entries {
+				srv.Addresses = append(srv.Addresses, entry.address(userScriptPort))
+			}
+			scripts = append(scripts, srv)
+		}
+	}
+
+	return services, scripts
+}
+
+// kvData is everything configured through the srv-acl_ KV prefix
+type kvData struct {
+	ACL        []*ACLEntry
+	Roles      []*UserLevel
+	Config     []ACLConfigEntry
+	Issuers    []*Issuer
+	RateLimits []*RateLimit
+	Lockdowns  []*Lockdown
+	Proxy      map[string]string // service => proxy mode
+	Upstream   map[string]*Upstream
+}
+
+// buildKV converts the srv-acl_ KV pairs into ACL entries, roles, config entries and such.
+// Any invalid value fails the whole update, as skipping an ACL entry would allow everyone.
+func buildKV(pairs []*consulKVPair) (*kvData, error) {
+	kv := &kvData{
+		Proxy:    map[string]string{},
+		Upstream: map[string]*Upstream{},
+	}
+	entries := map[string]*ACLEntry{}
+	entry := func(service string) *ACLEntry {
+		if e, ok := entries[service]; ok {
+			return e
+		}
+		e := &ACLEntry{Service: service}
+		entries[service] = e
+		kv.ACL = append(kv.ACL, e)
+		return e
+	}
+
+	for _, pair := range pairs {
+		value := strings.TrimSpace(string(pair.Value))
+
+		var err error
+		switch {
+		case strings.HasPrefix(pair.Key, KVACLEntry):
+			var p Permission
+			if p, err = parsePermission(value); err == nil {
+				entry(strings.TrimPrefix(pair.Key, KVACLEntry)).MinimumPermission = p
+			}
+		case strings.HasPrefix(pair.Key, KVACLRules):
+			var rules []*ACLRule
+			if value != "" {
+				err = json.Unmarshal([]byte(value), &rules)
+			}
+			if err == nil {
+				entry(strings.TrimPrefix(pair.Key, KVACLRules)).Rules = rules
+			}
+		case strings.HasPrefix(pair.Key, KVQuota):
+			var quotas []*Quota
+			if value != "" {
+				err = json.Unmarshal([]byte(value), &quotas)
+			}
+			if err == nil {
+				entry(strings.TrimPrefix(pair.Key, KVQuota)).Quotas = quotas
+			}
+		case strings.HasPrefix(pair.Key, KVACLMode):
+			if validACLMode(value) {
+				entry(strings.TrimPrefix(pair.Key, KVACLMode)).Mode = value
+			} else {
+				err = errors.New("unknown ACL mode " + value)
+			}
+		case strings.HasPrefix(pair.Key, KVACLAllow):
+			var users UserIDSet
+			if users, err = parseUserIDs(value); err == nil {
+				entry(strings.TrimPrefix(pair.Key, KVACLAllow)).AllowedUserIDs = users
+			}
+		case strings.HasPrefix(pair.Key, KVACLBlock):
+			var users UserIDSet
+			if users, err = parseUserIDs(value); err == nil {
+				entry(strings.TrimPrefix(pair.Key, KVACLBlock)).BlockedUserIDs = users
+			}
+		case strings.HasPrefix(pair.Key, KVRoles):
+			var p Permission
+			if p, err = parsePermission(value); err == nil {
+				kv.Roles = append(kv.Roles, &UserLevel{
+					Role:       strings.TrimPrefix(pair.Key, KVRoles),
+					Permission: p,
+				})
+			}
+		case strings.HasPrefix(pair.Key, KVProxy):
+			if value == ProxyModeJSend || value == ProxyModeStream {
+				kv.Proxy[strings.TrimPrefix(pair.Key, KVProxy)] = value
+			} else {
+				err = errors.New("unknown proxy mode " + value)
+			}
+		case strings.HasPrefix(pair.Key, KVUpstream):
+			upstream := &Upstream{}
+			if err = json.Unmarshal([]byte(value), upstream); err == nil {
+				if err = upstream.validate(); err == nil {
+					kv.Upstream[strings.TrimPrefix(pair.Key, KVUpstream)] = upstream
+				}
+			}
+		case strings.HasPrefix(pair.Key, KVRateLimit):
+			limit := &RateLimit{}
+			if err = json.Unmarshal([]byte(value), limit); err == nil {
+				limit.Key = strings.TrimPrefix(pair.Key, KVRateLimit)
+				if err = limit.validate(); err == nil {
+					kv.RateLimits = append(kv.RateLimits, limit)
+				}
+			}
+		case strings.HasPrefix(pair.Key, KVLockdown):
+			lockdown := &Lockdown{}
+			if err = json.Unmarshal([]byte(value), lockdown); err == nil {
+				lockdown.Service = strings.TrimPrefix(pair.Key, KVLockdown)
+				if err = lockdown.validate(); err == nil {
+					kv.Lockdowns = append(kv.Lockdowns, lockdown)
+				}
+			}
+		case strings.HasPrefix(pair.Key, KVIssuers):
+			issuer := &Issuer{}
+			if err = json.Unmarshal([]byte(value), issuer); err == nil {
+				if err = issuer.validate(); err == nil {
+					kv.Issuers = append(kv.Issuers, issuer)
+				}
+			}
+		case strings.HasPrefix(pair.Key, KVConfig):
+			// values are json when possible, such that "true" and true are the same
+			var val interface{}
+			if json.Unmarshal([]byte(value), &val) != nil {
+				val = value
+			}
+			kv.Config = append(kv.Config, ACLConfigEntry{
+				Key: strings.TrimPrefix(pair.Key, KVConfig),
+				Val: val,
+			})
+		}
+
+		if err != nil {
+			return nil, errors.New("invalid value for " + pair.Key + ": " + err.Error())
+		}
+	}
+
+	for _, e := range kv.ACL {
+		if err := e.validate(); err != nil {
+			return nil, errors.New("invalid ACL entry " + e.Service + ": " + err.Error())
+		}
+	}
+
+	return kv, nil
+}
+
+func parsePermission(value string) (Permission, error) {
+	p, err := strconv.ParseUint(value, 10, 32)
+	return Permission(p), err
+}
+
+func hasTag(tags []string, tag string) bool {
+	for i := range tags {
+		if tags[i] == tag {
+			return true
+		}
+	}
+	return false
+}
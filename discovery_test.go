@@ -0,0 +1,379 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeConsulInstance struct {
+	Address string
+	Port    int
+}
+
+// fakeConsul implements the parts of the consul HTTP API used by the ACL,
+// including blocking queries through the index and wait parameters.
+type fakeConsul struct {
+	sync.Mutex
+	index   uint64
+	changed chan struct{}
+
+	tags      map[string][]string
+	instances map[string][]fakeConsulInstance
+	kv        map[string]*consulKVPair
+	kvDown    bool // KV lookups fail
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:     1,
+		changed:   make(chan struct{}),
+		tags:      map[string][]string{},
+		instances: map[string][]fakeConsulInstance{},
+		kv:        map[string]*consulKVPair{},
+	}
+}
+
+// update modifies the fake data and wakes up every blocking query
+func (c *fakeConsul) update(cb func()) {
+	c.Lock()
+	defer c.Unlock()
+
+	cb()
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) setService(name string, tags []string, instances ...fakeConsulInstance) {
+	c.update(func() {
+		c.tags[name] = tags
+		c.instances[name] = instances
+	})
+}
+
+func (c *fakeConsul) removeService(name string) {
+	c.update(func() {
+		delete(c.tags, name)
+		delete(c.instances, name)
+	})
+}
+
+func (c *fakeConsul) putKV(key, value string) {
+	c.update(func() {
+		c.kv[key] = &consulKVPair{Key: key, Value: []byte(value), ModifyIndex: c.index + 1}
+	})
+}
+
+func (c *fakeConsul) deleteKV(key string) {
+	c.update(func() {
+		delete(c.kv, key)
+	})
+}
+
+// txn implements PUT /v1/txn for the KV operations used by the admin API
+func (c *fakeConsul) txn(w http.ResponseWriter, r *http.Request) {
+	var ops []*consulTxnOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, op := range ops {
+		var current uint64
+		if pair, ok := c.kv[op.KV.Key]; ok {
+			current = pair.ModifyIndex
+		}
+		if current != op.KV.Index {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"Results":null,"Errors":[{"OpIndex":0,"What":"failed to set key"}]}`))
+			return
+		}
+	}
+
+	c.index++
+	result := &consulTxnResponse{}
+	for _, op := range ops {
+		if op.KV.Verb == kvVerbDeleteCAS {
+			delete(c.kv, op.KV.Key)
+			continue
+		}
+		pair := &consulKVPair{Key: op.KV.Key, Value: op.KV.Value, ModifyIndex: c.index}
+		c.kv[op.KV.Key] = pair
+		result.Results = append(result.Results, struct {
+			KV *consulKVPair `json:"KV"`
+		}{&consulKVPair{Key: pair.Key, ModifyIndex: pair.ModifyIndex}})
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/txn" && r.Method == http.MethodPut {
+		c.txn(w, r)
+		return
+	}
+
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		wait = time.Second
+	}
+
+	// block until something changes or the wait time has passed
+	c.Lock()
+	if index >= c.index {
+		changed := c.changed
+		c.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+		c.Lock()
+	}
+	defer c.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	w.Header().Set("Content-Type", "application/json")
+
+	var data interface{}
+	switch {
+	case r.URL.Path == "/v1/catalog/services":
+		data = c.tags
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		var entries []*consulHealthEntry
+		for _, instance := range c.instances[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")] {
+			entry := &consulHealthEntry{}
+			entry.Node.Address = "10.0.0.1"
+			entry.Service.Address = instance.Address
+			entry.Service.Port = instance.Port
+			entries = append(entries, entry)
+		}
+		data = entries
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/") && c.kvDown:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		var pairs []*consulKVPair
+		for key, pair := range c.kv {
+			if strings.HasPrefix(key, prefix) {
+				pairs = append(pairs, pair)
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i].Key < pairs[j].Key
+		})
+		data = pairs
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+// eventually retries the condition until it succeeds or a timeout is reached
+func eventually(t *testing.T, msg string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for: " + msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func startFakeConsulDiscovery(t *testing.T, consul *fakeConsul) (*State, *ConsulDiscovery) {
+	server := httptest.NewServer(consul)
+	t.Cleanup(server.Close)
+
+	state := NewState()
+	discovery := NewConsulDiscovery(server.Client(), server.URL, state)
+	discovery.wait = 200 * time.Millisecond
+	discovery.retry = 10 * time.Millisecond
+	discovery.Start()
+	t.Cleanup(discovery.Stop)
+
+	return state, discovery
+}
+
+func TestConsulDiscoveryServices(t *testing.T) {
+	consul := newFakeConsul()
+	consul.setService("jolie--deployer", []string{TagPlatformEndpoint},
+		fakeConsulInstance{Address: "10.1.0.1", Port: 8000},
+		fakeConsulInstance{Address: "10.1.0.2", Port: 8000},
+	)
+	consul.setService("abcdeploymentxyz", []string{TagUserEndpoint}, fakeConsulInstance{Address: "10.2.0.1", Port: 1234})
+	consul.setService("consul", nil, fakeConsulInstance{Port: 8500})
+
+	state, _ := startFakeConsulDiscovery(t, consul)
+
+	eventually(t, "platform service", func() bool {
+		srv := state.Service("jolie-deployer")
+		return srv != nil && len(srv.Addresses) == 2 && srv.Addresses[1] == "10.1.0.2:8000"
+	})
+	eventually(t, "user script", func() bool {
+		srv := state.UserScript("abcxyz")
+		return srv != nil && len(srv.Addresses) == 1 && srv.Addresses[0] == "10.2.0.1:8080"
+	})
+	if state.Service("consul") != nil {
+		t.Error("services without an endpoint tag must not be exposed")
+	}
+
+	// instances failing their health check are removed
+	consul.setService("jolie--deployer", []string{TagPlatformEndpoint}, fakeConsulInstance{Address: "10.1.0.2", Port: 8000})
+	eventually(t, "removed instance", func() bool {
+		srv := state.Service("jolie-deployer")
+		return srv != nil && len(srv.Addresses) == 1
+	})
+
+	// node address is used when the service has none
+	consul.setService("logger", []string{TagPlatformEndpoint}, fakeConsulInstance{Port: 8888})
+	eventually(t, "node address", func() bool {
+		srv := state.Service("logger")
+		return srv != nil && srv.Addresses[0] == "10.0.0.1:8888"
+	})
+
+	consul.removeService("jolie--deployer")
+	eventually(t, "deregistered service", func() bool {
+		return state.Service("jolie-deployer") == nil
+	})
+
+	consul.setService("logger", []string{TagPlatformEndpoint})
+	eventually(t, "service without passing instances", func() bool {
+		return state.Service("logger") == nil
+	})
+}
+
+func TestConsulDiscoveryWaitsForKV(t *testing.T) {
+	consul := newFakeConsul()
+	consul.setService("logger", []string{TagPlatformEndpoint}, fakeConsulInstance{Address: "10.1.0.1", Port: 8000})
+	consul.putKV(KVACLEntry+"logger", "64")
+	consul.update(func() {
+		consul.kvDown = true
+	})
+
+	state, discovery := startFakeConsulDiscovery(t, consul)
+	eventually(t, "health of the service", func() bool {
+		discovery.mu.Lock()
+		defer discovery.mu.Unlock()
+		return len(discovery.health["logger"]) == 1
+	})
+	if state.Service("logger") != nil {
+		t.Error("expected services to be held back until the ACL entries are read")
+	}
+
+	consul.update(func() {
+		consul.kvDown = false
+	})
+	eventually(t, "service with its ACL entry", func() bool {
+		return state.Service("logger") != nil && state.ServiceACL(&Service{Name: "logger"}) != nil
+	})
+}
+
+func TestConsulDiscoveryKV(t *testing.T) {
+	consul := newFakeConsul()
+	consul.putKV(KVACLEntry+"jolie-deployer", "64")
+	consul.putKV(KVACLRules+"jolie-deployer", `[{"method":"DELETE","path":"/undeploy","min_permission":1024}]`)
+	consul.putKV(KVACLBlock+"jolie-deployer", "abuser, spammer")
+	consul.putKV(KVACLAllow+"logger", `["guest"]`)
+	consul.putKV(KVRoles+"usr", PermissionLvlUsr.Str())
+	consul.putKV(KVConfig+"jwt", "true")
+	consul.putKV(KVConfig+"name", "not json")
+	consul.putKV(KVRateLimit+"role:usr", `{"requests": 10, "per": "1m"}`)
+	consul.putKV(KVQuota+"jolie-deployer", `[{"method":"POST","path":"/deploy","daily":100}]`)
+
+	state, _ := startFakeConsulDiscovery(t, consul)
+
+	eventually(t, "kv", func() bool {
+		return state.lookupConfig("name") != ""
+	})
+
+	srv := &Service{Name: "jolie-deployer"}
+	entry := state.ServiceACL(srv)
+	if entry == nil {
+		t.Fatal("missing ACL entry")
+	}
+	if entry.MinimumPermission != 64 {
+		t.Errorf("incorrect minimum permission. Got %d, wants %d", entry.MinimumPermission, 64)
+	}
+	if len(entry.Rules) != 1 || entry.RequiredPermission("DELETE", "/undeploy") != 1024 {
+		t.Errorf("incorrect rules. Got %+v", entry.Rules)
+	}
+	if q := entry.Quota("POST", "/deploy"); q == nil || q.Daily != 100 || entry.Quota("GET", "/deploy") != nil {
+		t.Errorf("incorrect quotas. Got %+v", entry.Quotas)
+	}
+	if !entry.BlockedUserIDs.Contains("abuser") || !entry.BlockedUserIDs.Contains("spammer") {
+		t.Errorf("incorrect blocked users. Got %v", entry.BlockedUserIDs.List())
+	}
+	if logger := state.ServiceACL(&Service{Name: "logger"}); logger == nil || !logger.AllowedUserIDs.Contains("guest") {
+		t.Error("missing ACL entry with allowed users")
+	}
+	if got := state.lookupConfig("jwt"); got != "true" {
+		t.Errorf("incorrect config value. Got %s, wants %s", got, "true")
+	}
+	if got := state.lookupConfig("name"); got != "not json" {
+		t.Errorf("incorrect config value. Got %s, wants %s", got, "not json")
+	}
+	snap := state.Snapshot()
+	if len(snap.PermissionDefaults) != 1 || snap.PermissionDefaults[0].Permission != PermissionLvlUsr {
+		t.Errorf("incorrect roles. Got %+v", snap.PermissionDefaults)
+	}
+	if len(snap.RateLimits) != 1 || snap.RateLimits[0].Key != "role:usr" || snap.RateLimits[0].per() != time.Minute {
+		t.Errorf("incorrect rate limits. Got %+v", snap.RateLimits)
+	}
+
+	// an invalid value rejects the whole update, as a missing ACL entry would allow everyone
+	updates := func(result string) uint64 {
+		state.metrics.mu.Lock()
+		defer state.metrics.mu.Unlock()
+		return state.metrics.snapshots[snapshotLabels{source: SnapshotSourceConsul, result: result}]
+	}
+	for _, pair := range [][2]string{
+		{KVACLEntry + "broken", "-1"},
+		{KVRateLimit + "anonymous", `{"requests": 0}`},
+		{KVRateLimit + "anonymous", `{"requests": 1e10, "per": "1s"}`},
+		{KVUpstream + "jolie-deployer", `{"retries": -1}`},
+		{KVACLRules + "jolie-deployer", `[{"path":"undeploy"}]`},
+	} {
+		rejected := updates(SnapshotRejected)
+		consul.putKV(pair[0], pair[1])
+		eventually(t, "rejected "+pair[0], func() bool {
+			return updates(SnapshotRejected) > rejected
+		})
+		if entry = state.ServiceACL(srv); entry == nil || len(entry.Rules) != 1 || len(state.Snapshot().RateLimits) != 1 {
+			t.Errorf("expected %s to leave the state as it was. Got %+v", pair[0], entry)
+		}
+
+		applied := updates(SnapshotApplied)
+		consul.deleteKV(pair[0])
+		eventually(t, "removed "+pair[0], func() bool {
+			return updates(SnapshotApplied) > applied
+		})
+	}
+
+	consul.deleteKV(KVConfig + "name")
+	eventually(t, "deleted config", func() bool {
+		return state.lookupConfig("name") == ""
+	})
+}
@@ -44,6 +44,10 @@ func enforceJSONBodyParams(r io.Reader, user *User) (rc io.ReadCloser, length in
 	if err != nil {
 		return nil, 0, err
 	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// nothing to enforce
+		return ioutil.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
+	}
 
 	var parsed map[string]json.RawMessage
 	err = json.Unmarshal(body, &parsed)
@@ -74,3 +78,17 @@ func enforceJSONBodyParams(r io.Reader, user *User) (rc io.ReadCloser, length in
 
 	return ioutil.NopCloser(bytes.NewReader(body)), int64(len(body)),nil
 }
+
+// enforceStreamBodyParams enforces the body of a streamed request. Services may read it as json
+// whatever content type the caller declares, so it is buffered, and enforced when it looks like
+// json. Other bodies, such as file uploads, are passed on as they are.
+func enforceStreamBodyParams(r io.Reader, user *User) (rc io.ReadCloser, length int64, err error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return ioutil.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
+	}
+	return enforceJSONBodyParams(bytes.NewReader(body), user)
+}
@@ -0,0 +1,196 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var errServiceNotFound = errors.New("service was not found or does not exist as an endpoint yet")
+
+// apiAccess is the access decision of a request to /api
+type apiAccess struct {
+	Service  *Service
+	Path     string    // below the service, eg. /list
+	ACL      *ACLEntry // nil when the service has no ACL entry
+	Decision string    // see DecisionAllowed
+	Access   *AccessDecision
+}
+
+// decideAPI finds the service of an /api path and decides whether the user may access it.
+// authErr is the error of authenticating the user, if any. Both APIHandler and /explain rely on
+// this, such that an explanation always matches what the gateway does.
+func (s *State) decideAPI(user *User, authErr error, method, path string) (*apiAccess, error) {
+	srvName, err := getServiceName(path)
+	if err != nil {
+		return nil, errors.New("unable to get service name from your request. Error: " + err.Error())
+	}
+	if hasDotSegment(path) {
+		return nil, errDotSegment
+	}
+	srv := s.Service(srvName)
+	if srv == nil {
+		return nil, errServiceNotFound
+	}
+	api := &apiAccess{
+		Service:  srv,
+		Path:     path[len("/"+srvName):],
+		Decision: DecisionAllowed,
+	}
+
+	// the jolie-deployer is reachable without JWT, see APIHandler
+	if authErr != nil && s.lookupConfig("jwt") == "true" && srvName != "jolie-deployer" {
+		api.Decision = DecisionInvalidJWT
+		if authErr == errMissingJWT {
+			api.Decision = DecisionNoJWT
+		}
+		api.Access = &AccessDecision{Rule: "jwt", Reason: authErr.Error()}
+		return api, nil
+	}
+
+	// default: whitelist everyone if no ACL config is set for service
+	api.ACL = s.ServiceACL(srv)
+	api.Access = &AccessDecision{Allowed: true, Reason: "service has no ACL entry"}
+	if api.ACL != nil {
+		api.Access = api.ACL.Decide(user, method, api.Path)
+		if api.ACL.Mode == ACLModeDisabled {
+			api.Access = &AccessDecision{Allowed: true, Rule: "mode", Reason: "ACL entry is disabled"}
+		}
+	}
+	if !api.Access.Allowed {
+		api.Decision = DecisionDenied
+		if api.ACL.Mode == ACLModeReportOnly {
+			api.Decision = DecisionWouldDeny
+		}
+	}
+	return api, nil
+}
+
+// Explanation describes how a request to /api is decided
+type Explanation struct {
+	Method    string   `json:"method"`
+	Path      string   `json:"path"` // below the service
+	Service   string   `json:"service"`
+	Addresses []string `json:"addresses,omitempty"` // only shown to service managers
+
+	User     *User  `json:"user"`
+	JWTError string `json:"jwt_error,omitempty"`
+
+	ACLEntry    *ACLEntry  `json:"acl_entry"` // nil when the service has no ACL entry
+	Rule        string     `json:"rule,omitempty"`
+	Required    Permission `json:"required_permission"`
+	Flags       []string   `json:"required_flags"`
+	HeldFlags   []string   `json:"held_flags"`
+	Missing     []string   `json:"missing_flags"`
+	AllowedUser bool       `json:"allowed_user"` // the user is on the allowed users list
+	BlockedUser bool       `json:"blocked_user"` // the user is on the blocked users list
+
+	Decision string `json:"decision"` // see DecisionAllowed
+	Reason   string `json:"reason"`
+
+	// the lockdown that shuts the request off, regardless of the decision
+	Lockdown *Lockdown `json:"lockdown,omitempty"`
+}
+
+// ExplainHandler shows how a request to /api would be decided, without sending it. The query holds
+// the method (GET by default) and path, eg. /explain?method=DELETE&path=/jolie-deployer/undeploy/x.
+// The decision is made for the JWT of the request, or for the user and permission query parameters
+// when the caller holds PFlagManageSrvAll.
+func (s *State) ExplainHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.setupResponse(&w, r)
+
+	response := &JSend{
+		HTTPCode: http.StatusOK,
+	}
+	defer func(response *JSend) {
+		response.write(w)
+	}(response)
+
+	query := r.URL.Query()
+	method := strings.ToUpper(query.Get("method"))
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := query.Get("path")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	var user, caller *User
+	var authErr error
+	if query.Get("user") != "" || query.Get("permission") != "" {
+		if caller = s.authorize(r, PFlagManageSrvAll, response); caller == nil {
+			return
+		}
+		p, err := strconv.ParseUint(query.Get("permission"), 10, 32)
+		if err != nil {
+			adminBadRequest(response, errors.New("invalid permission: "+err.Error()))
+			return
+		}
+		user = &User{ID: UserID(query.Get("user")), Permission: Permission(p)}
+	} else {
+		user, authErr = s.authenticate(r.Header)
+		if authErr == nil {
+			caller = user
+		}
+	}
+
+	api, err := s.decideAPI(user, authErr, method, path)
+	if err != nil {
+		response.Status = JSendFail
+		response.Message = err.Error()
+		if err == errServiceNotFound {
+			response.HTTPCode = http.StatusNotFound
+		} else if err == errDotSegment {
+			response.HTTPCode = http.StatusBadRequest
+		}
+		return
+	}
+
+	explanation := &Explanation{
+		Method:    method,
+		Path:      api.Path,
+		Service:   api.Service.Name,
+		User:      user,
+		Rule:      api.Access.Rule,
+		Required:  api.Access.Required,
+		Flags:     api.Access.Required.Flags(),
+		HeldFlags: user.Permission.Flags(),
+		Missing:   (api.Access.Required &^ user.Permission).Flags(),
+		Decision:  api.Decision,
+		Reason:    api.Access.Reason,
+	}
+	if authErr != nil {
+		explanation.JWTError = authErr.Error()
+	}
+	if caller != nil && caller.Permission&PFlagManageSrvAll == PFlagManageSrvAll {
+		explanation.Addresses = api.Service.Addresses
+	}
+	explanation.Lockdown = s.lockdown(api.Service.Name, user, authErr == nil)
+	if api.ACL != nil {
+		explanation.AllowedUser = user.ID != "" && api.ACL.AllowedUserIDs.Contains(user.ID)
+		explanation.BlockedUser = user.ID != "" && api.ACL.BlockedUserIDs.Contains(user.ID)
+
+		// only user managers may see who is explicitly allowed or blocked, as at /configuration
+		entry := *api.ACL
+		if caller == nil || caller.Permission&PFlagUsersAll != PFlagUsersAll {
+			entry.AllowedUserIDs = nil
+			entry.BlockedUserIDs = nil
+		}
+		explanation.ACLEntry = &entry
+	}
+
+	data, err := json.Marshal(explanation)
+	if err != nil {
+		response.Status = JSendError
+		response.Message = err.Error()
+		response.HTTPCode = http.StatusInternalServerError
+		return
+	}
+	response.Status = JSendSuccess
+	response.Data = data
+}
@@ -0,0 +1,99 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestExplainHandler(t *testing.T) {
+	idp := newTestIssuer(t)
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Config = []ACLConfigEntry{{Key: "jwt", Val: "true"}}
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backendAddress(newJSONBackend(t))}},
+		}
+		snap.ACL = []*ACLEntry{{
+			Service:        "users",
+			Rules:          []*ACLRule{{Method: http.MethodDelete, Path: "/*", MinimumPermission: PFlagUsersAll | PFlagSeeUsers}},
+			BlockedUserIDs: NewUserIDSet("mallory"),
+		}}
+	})
+	gateway := newTestGateway(t, state)
+
+	developer := authHeader(idp.sign(t, AlgRS256, nil))
+	admin := authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}))
+	explain := func(header http.Header, query string) (int, *Explanation) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, gateway.URL+"/explain?"+query, nil)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		response := &JSend{}
+		if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+		explanation := &Explanation{}
+		_ = json.Unmarshal(response.Data, explanation)
+		return resp.StatusCode, explanation
+	}
+
+	status, e := explain(developer, "method=DELETE&path=/users/42")
+	if status != http.StatusOK || e.Decision != DecisionDenied || e.Rule != "DELETE /*" || e.Path != "/42" {
+		t.Fatalf("expected request to be denied by the rule. Got %d %+v", status, e)
+	}
+	if !reflect.DeepEqual(e.Missing, []string{"PFlagUsersAll"}) || len(e.Flags) != 2 {
+		t.Errorf("expected missing flag to be named. Got %v of %v", e.Missing, e.Flags)
+	}
+	if len(e.Addresses) != 0 || e.ACLEntry == nil || len(e.ACLEntry.BlockedUserIDs) != 0 {
+		t.Errorf("expected entry without addresses and user lists. Got %+v", e)
+	}
+	if _, e = explain(admin, "method=DELETE&path=/users/42"); len(e.Addresses) != 1 {
+		t.Errorf("expected addresses to be shown to service managers. Got %+v", e)
+	}
+
+	// the gateway agrees
+	req, _ := http.NewRequest(http.MethodDelete, gateway.URL+"/api/users/42", nil)
+	req.Header = developer
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &JSend{}
+	_ = json.NewDecoder(resp.Body).Decode(response)
+	resp.Body.Close()
+	if response.Message != "You do not have access to this service" {
+		t.Errorf("expected the gateway to deny the request. Got %+v", response)
+	}
+
+	if _, e = explain(nil, "path=/users/list"); e.Decision != DecisionNoJWT || e.JWTError == "" || len(e.Addresses) != 0 {
+		t.Errorf("expected missing JWT to be explained. Got %+v", e)
+	}
+	if _, e = explain(developer, "path=/users/list"); e.Decision != DecisionAllowed || e.Rule != "min_permission" {
+		t.Errorf("expected request to be allowed. Got %+v", e)
+	}
+
+	// admins explain the decision for someone else
+	if status, _ = explain(developer, "path=/users/list&user=mallory&permission=0"); status != http.StatusForbidden {
+		t.Errorf("expected developers not to explain for other users. Got %d", status)
+	}
+	_, e = explain(admin, "path=/users/list&user=mallory&permission="+PermissionLvlAdm.Str())
+	if e.Decision != DecisionDenied || !e.BlockedUser || e.Rule != "blocked_users" || !e.ACLEntry.BlockedUserIDs.Contains("mallory") {
+		t.Errorf("expected blocked user to be explained. Got %+v", e)
+	}
+
+	if status, _ = explain(developer, "path=/unknown/list"); status != http.StatusNotFound {
+		t.Errorf("expected unknown service not to be found. Got %d", status)
+	}
+}
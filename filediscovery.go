@@ -0,0 +1,112 @@
+package aclsrv
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// SnapshotSourceStatic is a snapshot read by FileDiscovery
+const SnapshotSourceStatic = "static"
+
+// NewFileDiscovery creates a watcher that fills the given state with the snapshot in the file at
+// path, and applies it again whenever the file changes.
+func NewFileDiscovery(path string, state *State) *FileDiscovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FileDiscovery{
+		path:     path,
+		state:    state,
+		interval: time.Second,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// FileDiscovery reads the services, user scripts and ACL configuration from a json or yaml file,
+// in the shape of POST /consul/services/change, and reloads it whenever it changes. It replaces
+// ConsulDiscovery for local development and tests.
+type FileDiscovery struct {
+	path     string
+	state    *State
+	interval time.Duration // how often the file is checked for changes
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// of the file last read, size is -1 while it is missing
+	modTime time.Time
+	size    int64
+}
+
+// Start loads the file, and watches it for changes in the background
+func (d *FileDiscovery) Start() {
+	d.reload()
+	d.wg.Add(1)
+	go d.watch()
+}
+
+// Stop ends watching the file
+func (d *FileDiscovery) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *FileDiscovery) watch() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.reload()
+		}
+	}
+}
+
+// reload applies the file when it changed since it was last read
+func (d *FileDiscovery) reload() {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		if d.size != -1 {
+			log.Print(d.path+": ", err)
+			d.modTime, d.size = time.Time{}, -1
+		}
+		return
+	}
+	if info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return
+	}
+	d.modTime, d.size = info.ModTime(), info.Size()
+
+	snap, err := readSnapshotFile(d.path)
+	if err != nil {
+		d.state.metrics.observeSnapshot(SnapshotSourceStatic, SnapshotRejected)
+	} else {
+		_, err = d.state.applySnapshot(SnapshotSourceStatic, snap)
+	}
+	if err != nil {
+		log.Print(d.path+": keeping the previous state, as the file is invalid: ", err)
+	}
+}
+
+// readSnapshotFile decodes a json or yaml snapshot. Unknown fields are refused, to catch typos.
+func readSnapshotFile(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{}
+	if err = yaml.UnmarshalStrict(data, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
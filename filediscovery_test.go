@@ -0,0 +1,77 @@
+package aclsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aclsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acl.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`
+services:
+  - name: users
+    addresses: ["localhost:8000"]
+    upstream:
+      timeout: 10s
+ACLEntries:
+  - service: users
+    min_permission: 4
+config:
+  - key: jwt
+    val: "true"
+`)
+	state := NewState()
+	d := NewFileDiscovery(path, state)
+	d.interval = 10 * time.Millisecond
+	d.Start()
+	defer d.Stop()
+
+	srv := state.Service("users")
+	if srv == nil || time.Duration(srv.Upstream.Timeout) != 10*time.Second || state.ServiceACL(srv) == nil || state.lookupConfig("jwt") != "true" {
+		t.Fatalf("expected yaml file to be applied. Got %+v", srv)
+	}
+
+	// json works as well
+	write(`{"services":[{"name":"users","addresses":["localhost:8000"]},{"name":"docs","addresses":["localhost:8001"]}]}`)
+	eventually(t, "reload", func() bool {
+		return state.Service("docs") != nil
+	})
+	if state.ServiceACL(srv) != nil {
+		t.Error("expected parts left out of the file to be removed")
+	}
+
+	write(`{"services":[{"name":"docs","adresses":["localhost:8001"]}]}`)
+	eventually(t, "rejected file", func() bool {
+		state.metrics.mu.Lock()
+		defer state.metrics.mu.Unlock()
+		return state.metrics.snapshots[snapshotLabels{source: SnapshotSourceStatic, result: SnapshotRejected}] > 0
+	})
+	if state.Service("users") == nil {
+		t.Error("expected invalid file to leave the state as it was")
+	}
+}
+
+func TestFileDiscoveryExample(t *testing.T) {
+	snap, err := readSnapshotFile("acl.local.yaml")
+	if err == nil {
+		err = snap.validate()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
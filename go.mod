@@ -1,9 +1,16 @@
 module aclsrv
 
+go 1.14
+
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/julienschmidt/httprouter v1.2.0
 	github.com/lestrrat-go/jwx v0.0.0-20180928232350-0d477e6a1f0e
+	sigs.k8s.io/yaml v1.3.0
+)
+
+require (
 	github.com/lestrrat-go/pdebug v0.0.0-20180220043849-39f9a71bcabe // indirect
 	github.com/pkg/errors v0.8.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,274 @@
+package aclsrv
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// DefaultHistorySize is the number of versions kept, see SetHistorySize
+	DefaultHistorySize = 20
+
+	// HeaderACLVersion holds the version of the snapshot in use, on every response
+	HeaderACLVersion = "X-ACL-Version"
+
+	// SnapshotSourceRollback is an earlier version applied again through /admin/history
+	SnapshotSourceRollback = "rollback"
+)
+
+// audit decisions of pinned versions
+const (
+	AuditVersionPinned   = "version-pinned"
+	AuditVersionUnpinned = "version-unpinned"
+)
+
+var (
+	errVersionNotFound = errors.New("version not found, it may have been dropped from the history")
+	errNotPinned       = errors.New("no version is pinned")
+	errPinned          = errors.New("a version is pinned, changes would be held back until DELETE /admin/history/pin")
+)
+
+// HistoryEntry is an applied version of the snapshot
+type HistoryEntry struct {
+	Version string        `json:"version"` // see Snapshot.contentVersion
+	Applied time.Time     `json:"applied"`
+	Source  string        `json:"source"` // see SnapshotSourceConsul
+	Diff    *SnapshotDiff `json:"diff"`   // compared to the version before
+
+	snap *Snapshot
+}
+
+// history holds the last applied versions, guarded by State.snapMu
+type history struct {
+	size    int
+	entries []*HistoryEntry // oldest first
+
+	// while a version is pinned, the last discovery update is held back instead of applied
+	pinned     string
+	held       *Snapshot
+	heldSource string
+}
+
+func (h *history) add(entry *HistoryEntry) {
+	h.entries = append(h.entries, entry)
+	h.trim()
+}
+
+func (h *history) trim() {
+	if len(h.entries) > h.size {
+		// copied, so dropped snapshots are released
+		h.entries = append([]*HistoryEntry(nil), h.entries[len(h.entries)-h.size:]...)
+	}
+}
+
+// find returns the last time a version was applied
+func (h *history) find(version string) *HistoryEntry {
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if h.entries[i].Version == version {
+			return h.entries[i]
+		}
+	}
+	return nil
+}
+
+// SetHistorySize changes the number of versions kept, DefaultHistorySize by default
+func (s *State) SetHistorySize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	s.history.size = size
+	s.history.trim()
+}
+
+// History lists the versions kept, the newest first
+func (s *State) History() []*HistoryEntry {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	entries := make([]*HistoryEntry, len(s.history.entries))
+	for i, entry := range s.history.entries {
+		entries[len(entries)-1-i] = entry
+	}
+	return entries
+}
+
+// historyEntry finds a version kept in the history
+func (s *State) historyEntry(version string) *HistoryEntry {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	return s.history.find(version)
+}
+
+// pinned returns the version kept in use, empty when discovery updates are applied
+func (s *State) pinned() string {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	return s.history.pinned
+}
+
+// pin keeps a version in use until unpin, and holds back discovery updates in the meantime. An
+// earlier version is applied again, keeping the current lockdowns.
+func (s *State) pin(version string, by UserID) (*SnapshotDiff, error) {
+	s.snapMu.Lock()
+	entry := s.history.find(version)
+	if entry == nil {
+		s.snapMu.Unlock()
+		return nil, errVersionNotFound
+	}
+	current := s.Snapshot()
+	if s.history.pinned == "" {
+		// restored by unpin, unless discovery updates it in the meantime
+		s.history.held, s.history.heldSource = current, s.history.entries[len(s.history.entries)-1].Source
+	}
+
+	snap, previous, diff := current, (*Snapshot)(nil), &SnapshotDiff{}
+	if entry.Version != current.version {
+		snap = entry.snap.copy()
+		snap.Lockdowns = current.Lockdowns
+		snap.index()
+		previous, diff = s.swapSnapshot(SnapshotSourceRollback, snap)
+	}
+	s.history.pinned = version
+	s.snapMu.Unlock()
+
+	if previous != nil {
+		s.metrics.observeSnapshot(SnapshotSourceRollback, SnapshotApplied)
+		s.snapshotApplied(SnapshotSourceRollback, previous, snap, diff)
+	} else {
+		s.saveStateFile()
+	}
+	s.recordChange(AuditVersionPinned, "", "history", strconv.Quote(version), by)
+	return diff, nil
+}
+
+// unpin applies discovery updates again, starting with the last one that was held back
+func (s *State) unpin(by UserID) (*SnapshotDiff, error) {
+	s.snapMu.Lock()
+	version := s.history.pinned
+	if version == "" {
+		s.snapMu.Unlock()
+		return nil, errNotPinned
+	}
+	held, source := s.history.held, s.history.heldSource
+	s.history.pinned, s.history.held, s.history.heldSource = "", nil, ""
+
+	var previous *Snapshot
+	diff := &SnapshotDiff{}
+	if held != nil {
+		// a copy, as the held snapshot may be a version in use before
+		snap := held.copy()
+		snap.index()
+		previous, diff = s.swapSnapshot(source, snap)
+	}
+	snap := s.Snapshot()
+	s.snapMu.Unlock()
+
+	if previous != nil {
+		s.metrics.observeSnapshot(source, SnapshotApplied)
+		s.snapshotApplied(source, previous, snap, diff)
+	} else {
+		s.saveStateFile()
+	}
+	s.recordChange(AuditVersionUnpinned, "", "history", strconv.Quote(version), by)
+	return diff, nil
+}
+
+// adminHistory is the response of GET /admin/history
+type adminHistory struct {
+	Current  string          `json:"current"`
+	Pinned   string          `json:"pinned,omitempty"`
+	Versions []*HistoryEntry `json:"versions"`
+}
+
+// adminVersion is a version with its snapshot
+type adminVersion struct {
+	*HistoryEntry
+	Snapshot *Snapshot `json:"snapshot"`
+}
+
+// setupHistoryRoutes lists the last applied versions, and pins or rolls back to one of them until
+// Consul is fixed
+func setupHistoryRoutes(router *httprouter.Router, ACLState *State) {
+	handle := func(method, path string, h func(r *http.Request, ps httprouter.Params, response *JSend)) {
+		router.Handle(method, path, ACLState.adminHandle(PFlagManageSrvAll, h))
+	}
+	entry := func(ps httprouter.Params, response *JSend) *HistoryEntry {
+		entry := ACLState.historyEntry(ps.ByName("version"))
+		if entry == nil {
+			adminNotFound(response, "version")
+		}
+		return entry
+	}
+
+	handle(http.MethodGet, "/admin/history", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		adminData(response, &adminHistory{
+			Current:  ACLState.Snapshot().version,
+			Pinned:   ACLState.pinned(),
+			Versions: ACLState.History(),
+		})
+	})
+	handle(http.MethodGet, "/admin/history/:version", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		e := entry(ps, response)
+		if e == nil {
+			return
+		}
+		snap := e.snap
+		if !ACLState.showUsers(r) {
+			snap = snap.copy()
+			snap.ACL = make([]*ACLEntry, len(e.snap.ACL))
+			for i, acl := range e.snap.ACL {
+				snap.ACL[i] = withoutUsers(acl)
+			}
+		}
+		adminData(response, &adminVersion{HistoryEntry: e, Snapshot: snap})
+	})
+
+	// what changed from a version to the one in ?to=, the current one by default
+	handle(http.MethodGet, "/admin/history/:version/diff", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		from := entry(ps, response)
+		if from == nil {
+			return
+		}
+		to := ACLState.Snapshot()
+		if v := r.URL.Query().Get("to"); v != "" {
+			e := ACLState.historyEntry(v)
+			if e == nil {
+				adminNotFound(response, "version")
+				return
+			}
+			to = e.snap
+		}
+		adminData(response, diffSnapshots(from.snap, to))
+	})
+
+	handle(http.MethodPost, "/admin/history/:version/pin", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		diff, err := ACLState.pin(ps.ByName("version"), ACLState.adminUser(r))
+		if err == errVersionNotFound {
+			adminNotFound(response, "version")
+			return
+		}
+		if err != nil {
+			adminError(response, err)
+			return
+		}
+		adminData(response, diff)
+	})
+	handle(http.MethodDelete, "/admin/history/pin", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		diff, err := ACLState.unpin(ACLState.adminUser(r))
+		if err == errNotPinned {
+			adminNotFound(response, "pinned version")
+			return
+		}
+		if err != nil {
+			adminError(response, err)
+			return
+		}
+		adminData(response, diff)
+	})
+}
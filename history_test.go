@@ -0,0 +1,119 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestHistory(t *testing.T) {
+	idp := newTestIssuer(t)
+	backend := backendAddress(newJSONBackend(t))
+	state := NewState()
+	discover := func(services []string, lockdowns []*Lockdown, acl ...*ACLEntry) *SnapshotDiff {
+		t.Helper()
+		snap := &Snapshot{Issuers: []*Issuer{idp.config()}, ACL: acl, Lockdowns: lockdowns}
+		for _, name := range services {
+			snap.Services = append(snap.Services, &Service{Name: name, Addresses: []string{backend}})
+		}
+		diff, err := state.applySnapshot(SnapshotSourceConsul, snap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diff
+	}
+	discover([]string{"users"}, nil, &ACLEntry{Service: "users", MinimumPermission: PFlagUsersAll})
+	first := state.Snapshot().version
+	// a bad KV edit wipes out the ACL entry
+	discover([]string{"users"}, nil)
+	second := state.Snapshot().version
+	if diff := discover([]string{"users"}, nil); !diff.Empty() || state.Snapshot().version != second || second == first {
+		t.Errorf("expected unchanged snapshot to keep its version. Got %s %s", state.Snapshot().version, diff)
+	}
+
+	// the version depends on the content only, so replicas agree on it
+	replica := NewState()
+	if _, err := replica.applySnapshot(SnapshotSourceConsul, state.Snapshot()); err != nil || replica.Snapshot().version != second {
+		t.Errorf("expected replicas to get the same version. Got %s %v", replica.Snapshot().version, err)
+	}
+	gateway := newTestGateway(t, state)
+
+	admin := authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}))
+	send := func(method, path string, header http.Header, v interface{}) (*http.Response, *JSend) {
+		t.Helper()
+		req, _ := http.NewRequest(method, gateway.URL+path, nil)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		response := &JSend{}
+		if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+		if v != nil {
+			if err = json.Unmarshal(response.Data, v); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+		return resp, response
+	}
+
+	if resp, _ := send(http.MethodGet, "/admin/history", authHeader(idp.sign(t, AlgRS256, nil)), nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected developers to be refused. Got %s", resp.Status)
+	}
+	list := &adminHistory{}
+	send(http.MethodGet, "/admin/history", admin, list)
+	if list.Current != second || len(list.Versions) != 2 || list.Versions[0].Version != second || list.Versions[0].Source != SnapshotSourceConsul {
+		t.Errorf("incorrect history. Got %+v", list)
+	}
+	diff := &SnapshotDiff{}
+	send(http.MethodGet, "/admin/history/"+first+"/diff", admin, diff)
+	if len(diff.ACLChanged) != 1 || len(diff.ServicesChanged) != 0 {
+		t.Errorf("expected ACL entry to be removed since the first version. Got %s", diff)
+	}
+	if resp, _ := send(http.MethodGet, "/admin/history/7", admin, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected unknown version not to be found. Got %s", resp.Status)
+	}
+
+	// roll back until consul is fixed
+	send(http.MethodPost, "/admin/history/"+first+"/pin", admin, diff)
+	info := &ACLInfo{}
+	resp, _ := send(http.MethodGet, "/configuration", nil, info)
+	if state.ServiceACL(&Service{Name: "users"}) == nil || info.Version != first || !info.Pinned || resp.Header.Get(HeaderACLVersion) != first {
+		t.Errorf("expected the first version to be applied again. Got %+v %s", info, resp.Header.Get(HeaderACLVersion))
+	}
+	if resp, _ = send(http.MethodPut, "/admin/acl/users", admin, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected config changes to be refused while pinned. Got %s", resp.Status)
+	}
+
+	// lockdowns are needed during the incident, they are applied anyway
+	discover([]string{"users", "docs"}, []*Lockdown{{Service: "users"}})
+	if state.Service("docs") != nil || state.ServiceACL(&Service{Name: "users"}) == nil {
+		t.Error("expected discovery updates to be held back while pinned")
+	}
+	if resp, _ = send(http.MethodGet, "/api/users/list", nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected lockdown to be applied while pinned. Got %s", resp.Status)
+	}
+
+	send(http.MethodDelete, "/admin/history/pin", admin, diff)
+	if state.Service("docs") == nil || state.ServiceACL(&Service{Name: "users"}) != nil || len(state.Snapshot().Lockdowns) != 1 {
+		t.Errorf("expected held back update to be applied. Got %s", diff)
+	}
+	if resp, _ = send(http.MethodDelete, "/admin/history/pin", admin, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected nothing to be pinned. Got %s", resp.Status)
+	}
+
+	state.SetHistorySize(2)
+	if versions := state.History(); len(versions) != 2 || versions[1].Version == first {
+		t.Errorf("expected oldest versions to be dropped. Got %+v", versions)
+	}
+	if resp, _ = send(http.MethodPost, "/admin/history/"+first+"/pin", admin, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected dropped version not to be found. Got %s", resp.Status)
+	}
+}
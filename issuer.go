@@ -0,0 +1,203 @@
+package aclsrv
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// supported signing algorithms. Symmetric algorithms are never accepted.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// DefaultIssuer is the cognito user pool of the platform. It is trusted
+// when no issuers have been configured.
+var DefaultIssuer = &Issuer{
+	Issuer:     "https://cognito-idp.us-east-1.amazonaws.com/us-east-1_AMfopmP6e",
+	JWKSURL:    "https://cognito-idp.us-east-1.amazonaws.com/us-east-1_AMfopmP6e/.well-known/jwks.json",
+	Algorithms: []string{AlgRS256},
+}
+
+// Issuer is a trusted identity provider, such as a cognito user pool. Tokens are matched to
+// their issuer through the "iss" claim. Issuers are configured in the Consul KV storage as json:
+// srv-acl_ACLEntry-issuer_<name>
+type Issuer struct {
+	Issuer     string   `json:"issuer"`               // expected "iss" claim
+	JWKSURL    string   `json:"jwks_url"`             // where to fetch the public keys
+	Algorithms []string `json:"algorithms,omitempty"` // allowed "alg" headers. Defaults to RS256
+	Audiences  []string `json:"audiences,omitempty"`  // accepted "aud" or "client_id" claims. Empty accepts all
+	TokenUse   string   `json:"token_use,omitempty"`  // required "token_use" claim, eg. "id" or "access"
+}
+
+func (i *Issuer) allowsAlgorithm(alg string) bool {
+	if len(i.Algorithms) == 0 {
+		return alg == AlgRS256
+	}
+	for _, allowed := range i.Algorithms {
+		if allowed == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyClaims checks the issuer specific claims. Expiration and such is verified by the jwt parser.
+func (i *Issuer) verifyClaims(claims jwt.MapClaims) error {
+	if i.TokenUse != "" {
+		if use, _ := claims["token_use"].(string); use != i.TokenUse {
+			return fmt.Errorf("token_use must be %s, got %s", i.TokenUse, use)
+		}
+	}
+
+	if len(i.Audiences) == 0 {
+		return nil
+	}
+
+	// cognito id tokens use "aud" while access tokens use "client_id"
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for i := range aud {
+			if str, ok := aud[i].(string); ok {
+				audiences = append(audiences, str)
+			}
+		}
+	}
+	if clientID, ok := claims["client_id"].(string); ok {
+		audiences = append(audiences, clientID)
+	}
+
+	for _, aud := range audiences {
+		for _, accepted := range i.Audiences {
+			if aud == accepted {
+				return nil
+			}
+		}
+	}
+	return errors.New("token audience is not accepted")
+}
+
+func (i *Issuer) validate() error {
+	if i.Issuer == "" {
+		return errors.New("missing issuer")
+	}
+	if i.JWKSURL == "" {
+		return errors.New("missing jwks_url for issuer " + i.Issuer)
+	}
+	for _, alg := range i.Algorithms {
+		if alg != AlgRS256 && alg != AlgES256 && alg != AlgEdDSA {
+			return errors.New("unsupported algorithm " + alg + " for issuer " + i.Issuer)
+		}
+	}
+	return nil
+}
+
+// parseJWKS materializes every supported public key in a JWKS document, by key ID.
+// Keys of unsupported types are skipped.
+func parseJWKS(data []byte) (keys map[string]interface{}, err error) {
+	var doc struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	keys = map[string]interface{}{}
+	for _, raw := range doc.Keys {
+		var header struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+		}
+		if err = json.Unmarshal(raw, &header); err != nil {
+			return nil, err
+		}
+
+		var key interface{}
+		if header.Kty == "OKP" {
+			// not supported by jwx
+			key, err = parseEd25519JWK(header.Crv, header.X)
+		} else {
+			var set *jwk.Set
+			if set, err = jwk.Parse([]byte(`{"keys":[` + string(raw) + `]}`)); err == nil {
+				key, err = set.Keys[0].Materialize()
+			}
+		}
+		if err != nil {
+			log.Print("skipping jwk "+header.Kid+": ", err)
+			continue
+		}
+
+		keys[header.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func parseEd25519JWK(crv, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, errors.New("unsupported curve " + crv)
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key size")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// SigningMethodEdDSA implements EdDSA (Ed25519) for jwt-go, which does not support it out of the box.
+// Expects ed25519.PrivateKey for signing and ed25519.PublicKey for verification.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return AlgEdDSA
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("EdDSA verification failed")
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func init() {
+	jwt.RegisterSigningMethod(AlgEdDSA, func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
@@ -0,0 +1,245 @@
+package aclsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// testIssuer is a local identity provider with generated keys and a JWKS endpoint
+type testIssuer struct {
+	*httptest.Server
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	jwks    []map[string]string
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	issuer := &testIssuer{}
+
+	var err error
+	if issuer.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if issuer.ecdsa, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	var edPublic ed25519.PublicKey
+	if edPublic, issuer.ed25519, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	coordinate := func(n *big.Int) string {
+		buf := make([]byte, 32)
+		data := n.Bytes()
+		copy(buf[len(buf)-len(data):], data)
+		return b64(buf)
+	}
+	issuer.jwks = []map[string]string{
+		{
+			"kty": "RSA", "kid": "rsa", "alg": AlgRS256, "use": "sig",
+			"n": b64(issuer.rsa.N.Bytes()),
+			"e": b64(big.NewInt(int64(issuer.rsa.E)).Bytes()),
+		},
+		{
+			"kty": "EC", "kid": "ec", "alg": AlgES256, "use": "sig", "crv": "P-256",
+			"x": coordinate(issuer.ecdsa.X),
+			"y": coordinate(issuer.ecdsa.Y),
+		},
+		{
+			"kty": "OKP", "kid": "ed", "alg": AlgEdDSA, "use": "sig", "crv": "Ed25519",
+			"x": b64(edPublic),
+		},
+	}
+
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": issuer.jwks})
+	}))
+	t.Cleanup(issuer.Close)
+
+	return issuer
+}
+
+func (i *testIssuer) config(algorithms ...string) *Issuer {
+	return &Issuer{
+		Issuer:     i.URL,
+		JWKSURL:    i.URL + "/.well-known/jwks.json",
+		Algorithms: algorithms,
+	}
+}
+
+// sign creates a token for the given algorithm, with default claims for a user
+func (i *testIssuer) sign(t *testing.T, alg string, claims jwt.MapClaims) string {
+	defaults := jwt.MapClaims{
+		"iss":              i.URL,
+		"exp":              time.Now().Add(time.Hour).Unix(),
+		"cognito:username": "andersfylling",
+		"cognito:groups":   []string{"user", "p:" + PermissionLvlDev.Str()},
+	}
+	for k, v := range claims {
+		defaults[k] = v
+	}
+
+	var token *jwt.Token
+	var key interface{}
+	switch alg {
+	case AlgRS256:
+		token, key = jwt.NewWithClaims(jwt.SigningMethodRS256, defaults), i.rsa
+		token.Header["kid"] = "rsa"
+	case AlgES256:
+		token, key = jwt.NewWithClaims(jwt.SigningMethodES256, defaults), i.ecdsa
+		token.Header["kid"] = "ec"
+	case AlgEdDSA:
+		token, key = jwt.NewWithClaims(SigningMethodEdDSA, defaults), i.ed25519
+		token.Header["kid"] = "ed"
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func authHeader(token string) http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	return header
+}
+
+func TestAuthenticateAlgorithms(t *testing.T) {
+	idp := newTestIssuer(t)
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config(AlgRS256, AlgES256, AlgEdDSA)}
+	})
+
+	for _, alg := range []string{AlgRS256, AlgES256, AlgEdDSA} {
+		user, err := state.authenticate(authHeader(idp.sign(t, alg, nil)))
+		if err != nil {
+			t.Errorf("%s: %s", alg, err)
+			continue
+		}
+		if user.ID != "andersfylling" || user.Permission != PermissionLvlDev {
+			t.Errorf("%s: incorrect user. Got %+v", alg, user)
+		}
+	}
+
+	// only allow RS256
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+	})
+	if _, err := state.authenticate(authHeader(idp.sign(t, AlgES256, nil))); err == nil {
+		t.Error("ES256 should not be accepted when only RS256 is allowed")
+	}
+	if _, err := state.authenticate(authHeader(idp.sign(t, AlgRS256, nil))); err != nil {
+		t.Error(err)
+	}
+
+	// expired
+	expired := idp.sign(t, AlgRS256, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})
+	if _, err := state.authenticate(authHeader(expired)); err == nil {
+		t.Error("expired token should not be accepted")
+	}
+
+	if _, err := state.authenticate(http.Header{}); err != errMissingJWT {
+		t.Errorf("expected missing JWT error. Got %v", err)
+	}
+}
+
+func TestAuthenticateIssuers(t *testing.T) {
+	staging := newTestIssuer(t)
+	production := newTestIssuer(t)
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{staging.config(), production.config()}
+	})
+
+	if _, err := state.authenticate(authHeader(staging.sign(t, AlgRS256, nil))); err != nil {
+		t.Error(err)
+	}
+	if _, err := state.authenticate(authHeader(production.sign(t, AlgRS256, nil))); err != nil {
+		t.Error(err)
+	}
+
+	// a token claiming to be from production, but signed by the staging keys
+	forged := staging.sign(t, AlgRS256, jwt.MapClaims{"iss": production.URL, "cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}})
+	user, err := state.authenticate(authHeader(forged))
+	if err == nil {
+		t.Error("token signed by another issuer should not be accepted")
+	}
+	if user.ID != "" || user.Permission != 0 {
+		t.Errorf("claims of a rejected token should not be used. Got %+v", user)
+	}
+
+	// untrusted issuer
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{production.config()}
+	})
+	if _, err := state.authenticate(authHeader(staging.sign(t, AlgRS256, nil))); err == nil {
+		t.Error("untrusted issuer should not be accepted")
+	}
+}
+
+func TestAuthenticateIssuerClaims(t *testing.T) {
+	idp := newTestIssuer(t)
+
+	issuer := idp.config()
+	issuer.Audiences = []string{"client-a"}
+	issuer.TokenUse = "id"
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{issuer}
+	})
+
+	testcases := []struct {
+		claims jwt.MapClaims
+		valid  bool
+	}{
+		{jwt.MapClaims{"aud": "client-a", "token_use": "id"}, true},
+		{jwt.MapClaims{"client_id": "client-a", "token_use": "id"}, true},
+		{jwt.MapClaims{"aud": []string{"x", "client-a"}, "token_use": "id"}, true},
+		{jwt.MapClaims{"aud": "client-b", "token_use": "id"}, false},
+		{jwt.MapClaims{"aud": "client-a", "token_use": "access"}, false},
+		{jwt.MapClaims{"aud": "client-a"}, false},
+	}
+
+	for i, tc := range testcases {
+		_, err := state.authenticate(authHeader(idp.sign(t, AlgRS256, tc.claims)))
+		if tc.valid && err != nil {
+			t.Errorf("%d: expected token to be valid. Got %s", i, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%d: expected token to be invalid", i)
+		}
+	}
+}
+
+func TestParseJWKSSkipsUnsupportedKeys(t *testing.T) {
+	keys, err := parseJWKS([]byte(`{"keys":[{"kty":"OKP","kid":"x","crv":"X25519","x":"AAAA"},{"kty":"unknown","kid":"y"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expected unsupported keys to be skipped. Got %d keys", len(keys))
+	}
+}
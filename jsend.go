@@ -11,6 +11,13 @@ const (
 	JSendError   = "error"
 )
 
+// error codes, see the error_code field
+const (
+	ErrCodeUpstreamTimeout     = 1001 // the service did not respond in time
+	ErrCodeUpstreamUnavailable = 1002 // the service could not be reached
+	ErrCodeCircuitOpen         = 1003 // the service keeps failing and is not called for a while
+)
+
 type JSend struct {
 	Status           string          `json:"status"`
 	Data             json.RawMessage `json:"data,omitempty"`
@@ -31,5 +38,8 @@ func (j *JSend) write(w http.ResponseWriter) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if j.HTTPCode != 0 {
+		w.WriteHeader(j.HTTPCode)
+	}
 	_, _ = w.Write(body)
 }
@@ -0,0 +1,285 @@
+package aclsrv
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksDefaultRefresh = time.Hour        // used when the IdP does not send a max-age
+	jwksMinRefresh     = time.Minute      // lower bound of a max-age
+	jwksMaxRefresh     = 24 * time.Hour   // upper bound of a max-age
+	jwksRetry          = 30 * time.Second // pause before retrying a failed refresh
+	jwksUnknownKid     = 30 * time.Second // min time between refreshes caused by unknown key IDs
+	jwksTimeout        = 10 * time.Second // max duration of fetching the JWKS
+)
+
+var errUnknownKid = errors.New("unable to find key")
+
+// JWKSStatus is the refresh status of a JWKS url, as shown at /health
+type JWKSStatus struct {
+	URL         string     `json:"url"`
+	Keys        int        `json:"keys"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"` // last successful refresh
+	NextRefresh *time.Time `json:"next_refresh,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Fetches     uint64     `json:"fetches"`
+	Failures    uint64     `json:"failures"`
+	Restored    bool       `json:"restored,omitempty"` // keys are from the state file, not refreshed yet
+}
+
+func newJWKSManager(client *http.Client, url string) *jwksManager {
+	return &jwksManager{
+		url:            url,
+		client:         client,
+		unknownKidWait: jwksUnknownKid,
+		retry:          jwksRetry,
+		timeout:        jwksTimeout,
+		stop:           make(chan struct{}),
+		refreshed:      make(chan struct{}, 1),
+	}
+}
+
+// jwksManager keeps the public keys of a JWKS url up to date. The keys are refreshed in
+// the background, as dictated by the Cache-Control header of the IdP. Keys that are
+// removed from the JWKS are dropped on refresh.
+//
+// Unknown key IDs can trigger a refresh to pick up rotated keys, but at most once every
+// unknownKidWait. Concurrent refreshes are coalesced into a single request.
+type jwksManager struct {
+	url            string
+	client         *http.Client
+	unknownKidWait time.Duration
+	retry          time.Duration
+	timeout        time.Duration // of a single fetch, so a hanging IdP can't block refreshes
+	onRefresh      func()        // called after a successful refresh
+
+	mu             sync.RWMutex
+	keys           map[string]interface{} // kid => public key
+	raw            []byte                 // the JWKS document of keys
+	lastRefresh    time.Time              // last successful refresh
+	nextRefresh    time.Time
+	lastErr        error
+	lastUnknownKid time.Time
+	inflight       *jwksFetch
+	fetches        uint64
+	failures       uint64
+
+	stop      chan struct{}
+	stopOnce  sync.Once
+	refreshed chan struct{} // wakes up the background loop after a refresh
+}
+
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// key returns the public key of the given key ID
+func (m *jwksManager) key(kid string) (interface{}, error) {
+	m.mu.RLock()
+	key, ok := m.keys[kid]
+	m.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	// negative caching: random key IDs must not hammer the IdP
+	m.mu.Lock()
+	if time.Since(m.lastUnknownKid) < m.unknownKidWait && m.inflight == nil {
+		m.mu.Unlock()
+		return nil, errUnknownKid
+	}
+	m.lastUnknownKid = time.Now()
+	m.mu.Unlock()
+
+	if err := m.refresh(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if key, ok = m.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errUnknownKid
+}
+
+// refresh fetches the JWKS. Callers arriving while a fetch is in flight wait for
+// that fetch instead of starting a new one.
+func (m *jwksManager) refresh() error {
+	m.mu.Lock()
+	if f := m.inflight; f != nil {
+		m.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	m.inflight = f
+	m.mu.Unlock()
+
+	keys, raw, maxAge, err := m.fetch()
+
+	m.mu.Lock()
+	m.inflight = nil
+	m.lastErr = err
+	m.fetches++
+	if err == nil {
+		m.keys = keys
+		m.raw = raw
+		m.lastRefresh = time.Now()
+		m.nextRefresh = m.lastRefresh.Add(maxAge)
+	} else {
+		m.failures++
+		m.nextRefresh = time.Now().Add(m.retry)
+	}
+	m.mu.Unlock()
+
+	f.err = err
+	close(f.done)
+	if err == nil && m.onRefresh != nil {
+		m.onRefresh()
+	}
+
+	select {
+	case m.refreshed <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+func (m *jwksManager) fetch() (keys map[string]interface{}, data []byte, maxAge time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, m.url, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, 0, errors.New("unexpected jwks response: " + resp.Status)
+	}
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if keys, err = parseJWKS(data); err != nil {
+		return nil, nil, 0, err
+	}
+
+	return keys, data, cacheMaxAge(resp.Header), nil
+}
+
+// restore uses the keys of a JWKS document saved earlier, until the first refresh
+func (m *jwksManager) restore(data []byte) error {
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.keys == nil {
+		m.keys = keys
+		m.raw = data
+	}
+	return nil
+}
+
+// document returns the JWKS document of the keys, nil when there are none
+func (m *jwksManager) document() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.raw
+}
+
+// cacheMaxAge extracts max-age from the Cache-Control header, bounded to a sane refresh interval
+func cacheMaxAge(header http.Header) time.Duration {
+	maxAge := jwksDefaultRefresh
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		if seconds, err := strconv.ParseInt(directive[len("max-age="):], 10, 64); err == nil {
+			maxAge = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if maxAge < jwksMinRefresh {
+		maxAge = jwksMinRefresh
+	} else if maxAge > jwksMaxRefresh {
+		maxAge = jwksMaxRefresh
+	}
+	return maxAge
+}
+
+// run refreshes the keys on schedule until the manager is stopped
+func (m *jwksManager) run() {
+	if err := m.refresh(); err != nil {
+		log.Print("jwks "+m.url+": ", err)
+	}
+
+	for {
+		m.mu.RLock()
+		wait := time.Until(m.nextRefresh)
+		m.mu.RUnlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-m.stop:
+			timer.Stop()
+			return
+		case <-m.refreshed:
+			// refreshed on demand, reschedule
+			timer.Stop()
+		case <-timer.C:
+			if err := m.refresh(); err != nil {
+				log.Print("jwks "+m.url+": ", err)
+			}
+		}
+	}
+}
+
+func (m *jwksManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *jwksManager) status() *JWKSStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := &JWKSStatus{
+		URL:      m.url,
+		Keys:     len(m.keys),
+		Fetches:  m.fetches,
+		Failures: m.failures,
+	}
+	if !m.lastRefresh.IsZero() {
+		lastRefresh := m.lastRefresh
+		status.LastRefresh = &lastRefresh
+	}
+	if !m.nextRefresh.IsZero() {
+		nextRefresh := m.nextRefresh
+		status.NextRefresh = &nextRefresh
+	}
+	if m.lastErr != nil {
+		status.LastError = m.lastErr.Error()
+	}
+	status.Restored = m.keys != nil && m.lastRefresh.IsZero()
+	return status
+}
@@ -0,0 +1,158 @@
+package aclsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWKSManagerCoalescesFetches(t *testing.T) {
+	idp := newTestIssuer(t)
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		idp.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	m := newJWKSManager(server.Client(), server.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.key("rsa"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("expected concurrent lookups to share one fetch. Got %d fetches", got)
+	}
+}
+
+func TestJWKSManagerUnknownKid(t *testing.T) {
+	idp := newTestIssuer(t)
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		idp.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	m := newJWKSManager(server.Client(), server.URL)
+	m.unknownKidWait = 100 * time.Millisecond
+
+	for i := 0; i < 20; i++ {
+		if _, err := m.key("random-kid"); err != errUnknownKid {
+			t.Errorf("expected unknown kid error. Got %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("expected unknown key IDs to be rate limited. Got %d fetches", got)
+	}
+
+	// known keys are still served from cache
+	if _, err := m.key("ec"); err != nil {
+		t.Error(err)
+	}
+
+	time.Sleep(m.unknownKidWait)
+	if _, err := m.key("random-kid"); err != errUnknownKid {
+		t.Errorf("expected unknown kid error. Got %v", err)
+	}
+	if got := atomic.LoadInt32(&fetches); got != 2 {
+		t.Errorf("expected a new fetch after the wait. Got %d fetches", got)
+	}
+}
+
+func TestJWKSManagerRotation(t *testing.T) {
+	idp := newTestIssuer(t)
+	m := newJWKSManager(idp.Client(), idp.URL)
+
+	if _, err := m.key("rsa"); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate: drop the rsa key
+	idp.jwks = idp.jwks[1:]
+	if err := m.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.unknownKidWait = time.Hour
+	if _, err := m.key("rsa"); err == nil {
+		t.Error("expected removed key to be dropped")
+	}
+	if _, err := m.key("ed"); err != nil {
+		t.Error(err)
+	}
+
+	status := m.status()
+	if status.Keys != 2 || status.LastRefresh == nil || status.LastError != "" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// keys are kept when a refresh fails
+	idp.Close()
+	if err := m.refresh(); err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+	if _, err := m.key("ed"); err != nil {
+		t.Error(err)
+	}
+	if status = m.status(); status.LastError == "" {
+		t.Error("expected last error in status")
+	}
+}
+
+func TestJWKSManagerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	m := newJWKSManager(server.Client(), server.URL)
+	m.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if err := m.refresh(); err == nil {
+		t.Fatal("expected hanging IdP to fail the refresh")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected refresh to give up after the timeout. Took %s", elapsed)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	testcases := []struct {
+		header string
+		wants  time.Duration
+	}{
+		{"", jwksDefaultRefresh},
+		{"public, max-age=3600", time.Hour},
+		{"max-age=7200, must-revalidate", 2 * time.Hour},
+		{"max-age=1", jwksMinRefresh},
+		{"max-age=99999999", jwksMaxRefresh},
+		{"no-cache", jwksDefaultRefresh},
+	}
+
+	for _, tc := range testcases {
+		header := http.Header{}
+		header.Set("Cache-Control", tc.header)
+		if got := cacheMaxAge(header); got != tc.wants {
+			t.Errorf("%q: got %s, wants %s", tc.header, got, tc.wants)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package aclsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// consul txn verbs
+const (
+	kvVerbCAS       = "cas"        // set the key if its ModifyIndex is Index. 0 means the key must not exist
+	kvVerbDeleteCAS = "delete-cas" // delete the key if its ModifyIndex is Index
+)
+
+var (
+	errKVConflict     = errors.New("the configuration was changed by someone else, reload it and try again")
+	errNoConfigStore  = errors.New("the configuration cannot be changed without consul")
+	errInvalidKVName  = errors.New("names must not be empty or contain '/'")
+	errMissingCASFlag = errors.New("missing cas query parameter: the index of the configuration that was read, 0 to create")
+)
+
+// kvOp is a single operation of a transaction
+type kvOp struct {
+	Verb  string
+	Key   string
+	Value []byte
+	Index uint64
+}
+
+// configStore holds the srv-acl_ KV pairs the state is built from
+type configStore interface {
+	// pairs returns the current KV pairs
+	pairs() []*consulKVPair
+
+	// txn applies every operation, or none. errKVConflict is returned when an index does not match.
+	// The state is updated before it returns.
+	txn(ops []*kvOp) error
+}
+
+func (s *State) setConfigStore(store configStore) {
+	s.Lock()
+	defer s.Unlock()
+	s.store = store
+}
+
+func (s *State) configStore() configStore {
+	s.RLock()
+	defer s.RUnlock()
+	return s.store
+}
+
+// kvIndex is the ModifyIndex of every given key that exists
+func kvIndex(pairs []*consulKVPair, keys ...string) map[string]uint64 {
+	wanted := map[string]bool{}
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	index := map[string]uint64{}
+	for _, pair := range pairs {
+		if wanted[pair.Key] {
+			index[pair.Key] = pair.ModifyIndex
+		}
+	}
+	return index
+}
+
+// maxIndex is the version of a resource stored in several keys
+func maxIndex(index map[string]uint64) (max uint64) {
+	for _, i := range index {
+		if i > max {
+			max = i
+		}
+	}
+	return max
+}
+
+// kvWrite replaces the given keys, where a nil value deletes the key, and writes the keys to keep
+// back as they are. The write only succeeds when cas is the current version of every key, see
+// maxIndex, and none of them changes in the meantime.
+func kvWrite(store configStore, values map[string][]byte, cas uint64, keep ...string) error {
+	pairs := store.pairs()
+	for _, key := range keep {
+		values[key] = nil
+		for _, pair := range pairs {
+			if pair.Key == key {
+				values[key] = append([]byte{}, pair.Value...)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	index := kvIndex(pairs, keys...)
+	if maxIndex(index) != cas {
+		return errKVConflict
+	}
+
+	var ops []*kvOp
+	for _, key := range keys {
+		current, exists := index[key]
+		switch {
+		case values[key] != nil:
+			ops = append(ops, &kvOp{Verb: kvVerbCAS, Key: key, Value: values[key], Index: current})
+		case exists:
+			ops = append(ops, &kvOp{Verb: kvVerbDeleteCAS, Key: key, Index: current})
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return store.txn(ops)
+}
+
+// aclEntryKeys are the keys an ACL entry is stored in
+func aclEntryKeys(service string) []string {
+	return []string{
+		KVACLEntry + service,
+		KVACLRules + service,
+		KVACLAllow + service,
+		KVACLBlock + service,
+		KVQuota + service,
+		KVACLMode + service,
+	}
+}
+
+// aclEntryValues encodes an ACL entry into its keys. Empty fields delete their key.
+func aclEntryValues(e *ACLEntry) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	for _, key := range aclEntryKeys(e.Service) {
+		values[key] = nil
+	}
+	values[KVACLEntry+e.Service] = []byte(e.MinimumPermission.Str())
+
+	fields := map[string]interface{}{}
+	if len(e.Rules) > 0 {
+		fields[KVACLRules] = e.Rules
+	}
+	if len(e.AllowedUserIDs) > 0 {
+		fields[KVACLAllow] = e.AllowedUserIDs
+	}
+	if len(e.BlockedUserIDs) > 0 {
+		fields[KVACLBlock] = e.BlockedUserIDs
+	}
+	if len(e.Quotas) > 0 {
+		fields[KVQuota] = e.Quotas
+	}
+	if e.Mode != "" {
+		values[KVACLMode+e.Service] = []byte(e.Mode)
+	}
+	for prefix, field := range fields {
+		data, err := json.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		values[prefix+e.Service] = data
+	}
+	return values, nil
+}
+
+// validName checks a service, role or config key used in a KV key
+func validName(name string) bool {
+	return name != "" && !strings.Contains(name, "/")
+}
+
+func (e *ACLEntry) validate() error {
+	if !validName(e.Service) {
+		return errInvalidKVName
+	}
+	if !validACLMode(e.Mode) {
+		return errors.New("mode must be " + ACLModeEnforce + ", " + ACLModeReportOnly + " or " + ACLModeDisabled)
+	}
+	for _, rule := range e.Rules {
+		if rule == nil || !strings.HasPrefix(rule.Path, "/") {
+			return errors.New("rule paths must start with /")
+		}
+	}
+	for _, quota := range e.Quotas {
+		if quota == nil || (quota.Path != "" && !strings.HasPrefix(quota.Path, "/")) {
+			return errors.New("quota paths must start with /")
+		}
+	}
+	return nil
+}
+
+// pairs returns the KV pairs the state was last built from
+func (d *ConsulDiscovery) pairs() []*consulKVPair {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.kv
+}
+
+type consulTxnOp struct {
+	KV *consulTxnKV `json:"KV"`
+}
+
+type consulTxnKV struct {
+	Verb  string `json:"Verb"`
+	Key   string `json:"Key"`
+	Value []byte `json:"Value,omitempty"` // base64 encoded by encoding/json, as consul expects
+	Index uint64 `json:"Index"`
+}
+
+type consulTxnResponse struct {
+	Results []struct {
+		KV *consulKVPair `json:"KV"`
+	} `json:"Results"`
+	Errors []struct {
+		What string `json:"What"`
+	} `json:"Errors"`
+}
+
+// txn runs the operations in a consul transaction, and applies them to the state right away
+// instead of waiting for the KV watch.
+func (d *ConsulDiscovery) txn(ops []*kvOp) error {
+	body := make([]*consulTxnOp, len(ops))
+	for i, op := range ops {
+		body[i] = &consulTxnOp{KV: &consulTxnKV{Verb: op.Verb, Key: op.Key, Value: op.Value, Index: op.Index}}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, d.address+"/v1/txn", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req.WithContext(d.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	result := &consulTxnResponse{}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err = json.Unmarshal(data, result); err != nil {
+			return err
+		}
+	case http.StatusConflict:
+		// rolled back, as one of the indexes did not match
+		return errKVConflict
+	default:
+		return errors.New("unexpected consul response for /v1/txn: " + resp.Status + " " + strings.TrimSpace(string(data)))
+	}
+
+	// the results hold the new ModifyIndex of every key that was set
+	modified := map[string]uint64{}
+	for _, r := range result.Results {
+		if r.KV != nil {
+			modified[r.KV.Key] = r.KV.ModifyIndex
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pairs := map[string]*consulKVPair{}
+	for _, pair := range d.kv {
+		pairs[pair.Key] = pair
+	}
+	for _, op := range ops {
+		if op.Verb == kvVerbDeleteCAS {
+			delete(pairs, op.Key)
+			continue
+		}
+		pairs[op.Key] = &consulKVPair{Key: op.Key, Value: op.Value, ModifyIndex: modified[op.Key]}
+	}
+	d.kv = make([]*consulKVPair, 0, len(pairs))
+	for _, pair := range pairs {
+		d.kv = append(d.kv, pair)
+	}
+	sort.Slice(d.kv, func(i, j int) bool {
+		return d.kv[i].Key < d.kv[j].Key
+	})
+	d.apply()
+	return nil
+}
+
+// parseCAS reads the cas query parameter of a write
+func parseCAS(r *http.Request) (uint64, error) {
+	value := r.URL.Query().Get("cas")
+	if value == "" {
+		return 0, errMissingCASFlag
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
@@ -0,0 +1,228 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// LockdownGlobal is the service of a lockdown of the whole platform
+	LockdownGlobal = "*"
+
+	defaultLockdownMessage    = "The service is down for maintenance, please try again later"
+	defaultLockdownRetryAfter = time.Minute
+)
+
+// audit decisions of lockdown changes
+const (
+	AuditLockdownActivated   = "lockdown-activated"
+	AuditLockdownDeactivated = "lockdown-deactivated"
+)
+
+// Lockdown shuts off a service, a user script (script:<name>) or with LockdownGlobal every
+// service and user script, while they stay registered in consul
+type Lockdown struct {
+	Service    string     `json:"service"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter Duration   `json:"retry_after,omitempty"`
+	Bypass     Permission `json:"bypass,omitempty"` // users holding every flag get through, nobody when 0
+	By         UserID     `json:"by,omitempty"`     // who activated it through the admin API
+}
+
+func (l *Lockdown) validate() error {
+	if !validName(l.Service) {
+		return errInvalidKVName
+	}
+	if l.RetryAfter < 0 {
+		return errors.New("retry_after must not be negative")
+	}
+	return nil
+}
+
+// bypasses checks if the user is let through
+func (l *Lockdown) bypasses(user *User, authenticated bool) bool {
+	return authenticated && l.Bypass != 0 && user.Permission&l.Bypass == l.Bypass
+}
+
+// respond fills in the maintenance response of a locked down request
+func (l *Lockdown) respond(w http.ResponseWriter, response *JSend) {
+	retryAfter := time.Duration(l.RetryAfter)
+	if retryAfter == 0 {
+		retryAfter = defaultLockdownRetryAfter
+	}
+	seconds := strconv.Itoa(ceilSeconds(retryAfter))
+	w.Header().Set("Retry-After", seconds)
+
+	response.Status = JSendError
+	response.Message = l.Message
+	if response.Message == "" {
+		response.Message = defaultLockdownMessage
+	}
+	response.Data = []byte(`{"retry_after":` + seconds + `}`)
+	response.HTTPCode = http.StatusServiceUnavailable
+}
+
+// lockdown finds the lockdown that applies to the user, the global one first. Nil is returned
+// when the request may continue.
+func (s *State) lockdown(service string, user *User, authenticated bool) *Lockdown {
+	lockdowns := s.Snapshot().lockdowns
+	if l, ok := lockdowns[LockdownGlobal]; ok && !l.bypasses(user, authenticated) {
+		return l
+	}
+	if l, ok := lockdowns[service]; ok && !l.bypasses(user, authenticated) {
+		return l
+	}
+	return nil
+}
+
+// auditLockdowns records the activations and deactivations between two lists of lockdowns
+func (s *State) auditLockdowns(previous, lockdowns []*Lockdown) {
+	before := map[string]*Lockdown{}
+	for _, l := range previous {
+		before[l.Service] = l
+	}
+	after := map[string]*Lockdown{}
+	for _, l := range lockdowns {
+		after[l.Service] = l
+	}
+
+	for _, l := range previous {
+		if _, ok := after[l.Service]; !ok {
+			s.recordLockdown(AuditLockdownDeactivated, l, s.liftedBy(l.Service))
+		}
+	}
+	for _, l := range lockdowns {
+		if old, ok := before[l.Service]; !ok || *old != *l {
+			s.recordLockdown(AuditLockdownActivated, l, l.By)
+		}
+	}
+}
+
+// liftLockdown remembers who lifts the lockdown of a service, so its deactivation can be recorded
+// as theirs once it is applied
+func (s *State) liftLockdown(service string, by UserID) {
+	s.liftedMu.Lock()
+	defer s.liftedMu.Unlock()
+	if s.lifted == nil {
+		s.lifted = map[string]UserID{}
+	}
+	s.lifted[service] = by
+}
+
+// liftedBy returns and forgets who lifted the lockdown of a service, empty when unknown
+func (s *State) liftedBy(service string) UserID {
+	s.liftedMu.Lock()
+	defer s.liftedMu.Unlock()
+	by := s.lifted[service]
+	delete(s.lifted, service)
+	return by
+}
+
+// recordLockdown records a change, by the given user if known
+func (s *State) recordLockdown(decision string, l *Lockdown, by UserID) {
+	data, _ := json.Marshal(l)
+	s.recordChange(decision, l.Service, "lockdown", string(data), by)
+}
+
+// recordChange logs a change of the configuration and records it in the audit log. The reason
+// must be json.
+func (s *State) recordChange(decision, service, rule, reason string, by UserID) {
+	s.log(LogLvlWarn, logString(`{"`+decision+`":`+reason+`}`))
+
+	a := s.auditLog()
+	if a == nil {
+		return
+	}
+	err := a.Record(&AuditRecord{
+		UserID:   by,
+		Service:  service,
+		Decision: decision,
+		Rule:     rule,
+		Reason:   reason,
+	})
+	if err != nil {
+		log.Print("audit: ", err)
+	}
+}
+
+// logString is a request log entry that is already formatted
+type logString string
+
+func (s logString) String() string {
+	return string(s)
+}
+
+func setupLockdownRoutes(router *httprouter.Router, ACLState *State) {
+	handle := func(method, path string, h func(r *http.Request, ps httprouter.Params, response *JSend)) {
+		router.Handle(method, path, ACLState.adminHandle(PFlagManageSrvAll, h))
+	}
+
+	handle(http.MethodGet, "/admin/lockdown", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		current := ACLState.Snapshot().Lockdowns
+		lockdowns := make([]*adminLockdown, len(current))
+		for i, l := range current {
+			lockdowns[i] = &adminLockdown{Lockdown: l}
+		}
+
+		for _, l := range lockdowns {
+			l.Index = ACLState.kvVersion(KVLockdown + l.Service)
+		}
+		adminData(response, lockdowns)
+	})
+
+	// activates or changes a lockdown, eg. PUT /admin/lockdown/*?cas=0 for the whole platform
+	handle(http.MethodPut, "/admin/lockdown/:service", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		lockdown := &Lockdown{}
+		store, cas := ACLState.adminWrite(r, lockdown, response)
+		if store == nil {
+			return
+		}
+		lockdown.Service = ps.ByName("service")
+		if err := lockdown.validate(); err != nil {
+			adminBadRequest(response, err)
+			return
+		}
+		lockdown.By = ACLState.adminUser(r)
+
+		data, err := json.Marshal(lockdown)
+		if err == nil {
+			err = kvWrite(store, map[string][]byte{KVLockdown + lockdown.Service: data}, cas)
+		}
+		if err != nil {
+			adminError(response, err)
+			return
+		}
+		adminData(response, &adminLockdown{Lockdown: lockdown, Index: ACLState.kvVersion(KVLockdown + lockdown.Service)})
+	})
+
+	handle(http.MethodDelete, "/admin/lockdown/:service", func(r *http.Request, ps httprouter.Params, response *JSend) {
+		store, cas := ACLState.adminWrite(r, nil, response)
+		if store == nil {
+			return
+		}
+		service := ps.ByName("service")
+		key := KVLockdown + service
+		if ACLState.kvVersion(key) == 0 {
+			adminNotFound(response, "lockdown")
+			return
+		}
+		ACLState.liftLockdown(service, ACLState.adminUser(r))
+		if err := kvWrite(store, map[string][]byte{key: nil}, cas); err != nil {
+			ACLState.liftedBy(service)
+			adminError(response, err)
+			return
+		}
+		response.Status = JSendSuccess
+	})
+}
+
+type adminLockdown struct {
+	*Lockdown
+	Index uint64 `json:"index"`
+}
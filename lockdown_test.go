@@ -0,0 +1,170 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestLockdown(t *testing.T) {
+	idp := newTestIssuer(t)
+	audit, path := newTestAuditLog(t)
+	backend := backendAddress(newJSONBackend(t))
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backend}},
+			{Name: "docs", Addresses: []string{backend}},
+		}
+		snap.UserScripts = []*Service{{Name: "abc", Addresses: []string{backend}}}
+	})
+	state.SetAuditLog(audit)
+	gateway := newTestGateway(t, state)
+
+	developer := authHeader(idp.sign(t, AlgRS256, nil))
+	admin := authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}))
+	send := func(path string, header http.Header) (*http.Response, *JSend) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, gateway.URL+path, nil)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		response := &JSend{}
+		if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+		return resp, response
+	}
+
+	lockdown := func(lockdowns ...*Lockdown) {
+		setSnapshot(t, state, func(snap *Snapshot) {
+			snap.Lockdowns = lockdowns
+		})
+	}
+
+	lockdown(&Lockdown{Service: "users", Message: "Migrating users", RetryAfter: Duration(2 * time.Minute), By: "anders"})
+	resp, response := send("/api/users/list", developer)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "120" || response.Message != "Migrating users" {
+		t.Errorf("expected maintenance response. Got %s %s %+v", resp.Status, resp.Header.Get("Retry-After"), response)
+	}
+	if resp, _ = send("/api/docs/list", developer); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other services to be reachable. Got %s", resp.Status)
+	}
+	if resp, _ = send("/script/abc/run", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected user scripts to be reachable. Got %s", resp.Status)
+	}
+
+	// the whole platform, except for admins
+	lockdown(&Lockdown{Service: LockdownGlobal, Bypass: PFlagManageSrvAll})
+	for _, path := range []string{"/api/docs/list", "/script/abc/run"} {
+		if resp, response = send(path, developer); resp.StatusCode != http.StatusServiceUnavailable || response.Message != defaultLockdownMessage {
+			t.Errorf("expected %s to be locked down. Got %s %+v", path, resp.Status, response)
+		}
+	}
+	if resp, _ = send("/api/docs/list", admin); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected admins to get through. Got %s", resp.Status)
+	}
+	lockdown()
+	if resp, _ = send("/api/docs/list", developer); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected lockdown to be lifted. Got %s", resp.Status)
+	}
+
+	audit.Close()
+	var changes []string
+	for _, line := range readAuditLines(t, path) {
+		if strings.Contains(line, `"rule":"lockdown"`) {
+			changes = append(changes, line)
+		}
+	}
+	expected := []string{
+		`"uid":"anders","permission":0,"service":"users","method":"","path":"","decision":"lockdown-activated"`,
+		`"ip":"","permission":0,"service":"users","method":"","path":"","decision":"lockdown-deactivated"`,
+		`"service":"*","method":"","path":"","decision":"lockdown-activated"`,
+		`"service":"*","method":"","path":"","decision":"lockdown-deactivated"`,
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d lockdown records. Got %d", len(expected), len(changes))
+	}
+	for i, wants := range expected {
+		if !strings.Contains(changes[i], wants) {
+			t.Errorf("incorrect record %d. Got %s", i+1, changes[i])
+		}
+	}
+
+	// lockdowns found on startup are not recorded as activated again
+	restartedAudit, restartedPath := newTestAuditLog(t)
+	restarted := NewState()
+	restarted.SetAuditLog(restartedAudit)
+	setSnapshot(t, restarted, func(snap *Snapshot) {
+		snap.Lockdowns = []*Lockdown{{Service: "users"}}
+	})
+	restartedAudit.Close()
+	if lines := readAuditLines(t, restartedPath); len(lines) != 0 {
+		t.Errorf("expected no records on startup. Got %v", lines)
+	}
+}
+
+func TestLockdownAdminAPI(t *testing.T) {
+	idp := newTestIssuer(t)
+	issuer, _ := json.Marshal(idp.config(AlgRS256))
+	consul := newFakeConsul()
+	consul.putKV(KVIssuers+"test", string(issuer))
+	state, _ := startFakeConsulDiscovery(t, consul)
+	eventually(t, "issuer", func() bool {
+		return len(state.Snapshot().Issuers) == 1
+	})
+	audit, path := newTestAuditLog(t)
+	state.SetAuditLog(audit)
+	gateway := newTestGateway(t, state)
+
+	admin := authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}))
+	call := func(method, path, body string) *adminLockdown {
+		t.Helper()
+		req, _ := http.NewRequest(method, gateway.URL+path, strings.NewReader(body))
+		req.Header = admin
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		response := &JSend{}
+		_ = json.NewDecoder(resp.Body).Decode(response)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: expected success. Got %s %+v", method, path, resp.Status, response)
+		}
+		l := &adminLockdown{}
+		_ = json.Unmarshal(response.Data, l)
+		return l
+	}
+
+	activated := call(http.MethodPut, "/admin/lockdown/*?cas=0", `{"message":"Incident","bypass":16384}`)
+	lockdowns := state.Snapshot().Lockdowns
+	if len(lockdowns) != 1 || lockdowns[0].Service != LockdownGlobal || lockdowns[0].By != "andersfylling" || lockdowns[0].Bypass != PFlagManageSrvAll {
+		t.Errorf("expected global lockdown to be applied. Got %+v", lockdowns)
+	}
+
+	call(http.MethodDelete, "/admin/lockdown/*?cas="+strconv.FormatUint(activated.Index, 10), "")
+	eventually(t, "lockdown to be lifted", func() bool {
+		return len(state.Snapshot().Lockdowns) == 0
+	})
+	audit.Close()
+	var changes []string
+	for _, line := range readAuditLines(t, path) {
+		if strings.Contains(line, `"rule":"lockdown"`) {
+			changes = append(changes, line)
+		}
+	}
+	if len(changes) != 2 || !strings.Contains(changes[0], `"uid":"andersfylling"`) || !strings.Contains(changes[1], `"uid":"andersfylling","permission":0,"service":"*","method":"","path":"","decision":"lockdown-deactivated"`) {
+		t.Errorf("expected both changes to be recorded as the admin's. Got %v", changes)
+	}
+}
@@ -2,17 +2,23 @@ package aclsrv
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	log2 "log"
+	"math"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Java log levels as an integer
 const (
+	LogLvlOff    = math.MaxInt32
 	LogLvlWarn   = 900
 	LogLvlINFO   = 800
 	LogLvlFINEST = 300
@@ -30,6 +36,7 @@ type LEapi struct {
 	IP          string      `json:"ip"`
 	Err string `json:"err,omitempty"`
 	User *User `json:"usr,omitempty"`
+	Decision string `json:"decision,omitempty"` // see DecisionAllowed
 	ReqHeader   http.Header `json:"req_header,omitempty"`
 	ResHeader   http.Header `json:"res_header,omitempty"`
 }
@@ -45,50 +52,223 @@ func (e *LEapi) String() string {
 
 var _ fmt.Stringer = (*LEapi)(nil)
 
-var logClient = http.DefaultClient
+const (
+	DefaultLoggerURL = "http://logger:8888/set"
+
+	logQueueSize     = 4096 // entries waiting to be shipped, new entries are dropped when full
+	logBatchSize     = 100
+	logFlushInterval = time.Second
+	logTimeout       = 2 * time.Second
+	logMaxAttempts   = 5
+	logRetryBackoff  = 100 * time.Millisecond // doubled after every failed attempt
+)
+
+// client of the logging service, replaced during tests
+var logClient = &http.Client{Timeout: logTimeout}
+
+var errLogQueueFull = errors.New("log queue is full")
+
+// LogShipper sends log entries to the logging service in the background. Entries are queued and
+// flushed in batches, posting one entry per request; failed requests are retried with backoff. The
+// ACL keeps running when the logging service is down: entries are dropped, and counted, when the
+// queue is full or the logging service keeps failing.
+type LogShipper struct {
+	url       string
+	client    *http.Client
+	batchSize int
+	interval  time.Duration
+	backoff   time.Duration
 
-// contacts the logging service
-func logger(level int, info fmt.Stringer) (dbIndex int) {
-	logClient.Timeout = time.Duration(2 * time.Second)
+	mu      sync.RWMutex // held for writing when closing, such that no entry is queued after the final drain
+	closed  bool
+	queue   chan *ACLLogEntry
+	closing chan struct{}
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc // aborts shipping when Close runs out of time
 
-	entry := &ACLLogEntry{
-		Name:  "acl",
-		Level: level,
-		Info:  info.String(),
+	startOnce sync.Once
+	closeOnce sync.Once
+
+	shipped uint64 // atomic
+	dropped uint64 // atomic
+}
+
+func NewLogShipper(url string) *LogShipper {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LogShipper{
+		url:       url,
+		client:    logClient,
+		batchSize: logBatchSize,
+		interval:  logFlushInterval,
+		backoff:   logRetryBackoff,
+		queue:     make(chan *ACLLogEntry, logQueueSize),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
 	}
-	if entry.Info == "" {
-		log2.Print("empty entry")
-		return -1
+}
+
+var _ LogSink = (*LogShipper)(nil)
+
+// Write queues an entry without blocking. The background shipping starts with the first entry.
+func (l *LogShipper) Write(entry *ACLLogEntry) error {
+	l.startOnce.Do(func() {
+		go l.run()
+	})
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		atomic.AddUint64(&l.dropped, 1)
+		return errLogSinkClosed
+	}
+	select {
+	case l.queue <- entry:
+		return nil
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+		return errLogQueueFull
+	}
+}
+
+func (l *LogShipper) String() string {
+	return l.url
+}
+
+// Close ships every queued entry and stops. Entries that are not shipped before ctx is done are dropped.
+func (l *LogShipper) Close(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		l.closed = true
+		close(l.closing)
+		l.mu.Unlock()
+	})
+	l.startOnce.Do(func() {
+		go l.run()
+	})
+
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		<-l.done
+		return ctx.Err()
 	}
+}
+
+func (l *LogShipper) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	var batch []*ACLLogEntry
+	add := func(entry *ACLLogEntry) {
+		batch = append(batch, entry)
+		if len(batch) >= l.batchSize {
+			l.ship(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case entry := <-l.queue:
+			add(entry)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				l.ship(batch)
+				batch = nil
+			}
+		case <-l.closing:
+			for {
+				select {
+				case entry := <-l.queue:
+					add(entry)
+				default:
+					if len(batch) > 0 {
+						l.ship(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// ship posts the entries of a batch one at a time, as the logging service takes a single entry
+// per request. The rest of the batch is dropped when the logging service stays unavailable.
+func (l *LogShipper) ship(batch []*ACLLogEntry) {
+	for i, entry := range batch {
+		unavailable, err := l.send(entry)
+		if err == nil {
+			atomic.AddUint64(&l.shipped, 1)
+			continue
+		}
+
+		dropped := 1
+		if unavailable {
+			dropped = len(batch) - i
+		}
+		log2.Printf("logger: dropped %d entries: %v", dropped, err)
+		atomic.AddUint64(&l.dropped, uint64(dropped))
+		if unavailable {
+			return
+		}
+	}
+}
+
+// send posts an entry, and retries with backoff until it succeeds or the attempts run out.
+// unavailable is false when the logging service rejected the entry itself.
+func (l *LogShipper) send(entry *ACLLogEntry) (unavailable bool, err error) {
 	data, err := json.Marshal(entry)
 	if err != nil {
-		log2.Fatal(err)
-		return -1
+		return false, err
 	}
 
-	var body io.ReadCloser
-	body = ioutil.NopCloser(bytes.NewBuffer(data))
-	req, err := http.NewRequest(http.MethodPost, "http://logger:8888/set", body)
+	backoff := l.backoff
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = l.post(data); err == nil || !retry {
+			return false, err
+		}
+		if attempt == logMaxAttempts || l.ctx.Err() != nil {
+			return true, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-l.ctx.Done():
+			timer.Stop()
+		}
+		backoff *= 2
+	}
+}
+
+// post sends an entry once. retry is false when the logging service rejected the entry itself.
+func (l *LogShipper) post(data []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(data))
 	if err != nil {
-		log2.Fatal(err)
-		return -1
+		return false, err
 	}
+	req = req.WithContext(l.ctx)
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
 	req.Header.Set("Accept", "application/json")
-	resp, err := logClient.Do(req)
-	if err != nil {
-		log2.Fatal(err)
-		return -1
-	}
 
-	defer resp.Body.Close()
-	data, err = ioutil.ReadAll(resp.Body)
+	resp, err := l.client.Do(req)
 	if err != nil {
-		log2.Fatal(err)
-		return -1
+		return true, err
 	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
 
-	fmt.Println("logger response: " + string(data))
-
-	return -1 // TODO: use the response
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, errors.New("unexpected logger response: " + resp.Status)
+	}
+	return false, errors.New("entry rejected by the logger: " + resp.Status)
 }
@@ -0,0 +1,150 @@
+package aclsrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newLogService records every entry it receives. fail is called first, and the entry is
+// rejected with its status if it is not 0.
+func newLogService(t *testing.T, fail func() int) (*httptest.Server, func() []*ACLLogEntry) {
+	var mu sync.Mutex
+	var entries []*ACLLogEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := fail(); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		entry := &ACLLogEntry{}
+		if err := json.NewDecoder(r.Body).Decode(entry); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		entries = append(entries, entry)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []*ACLLogEntry {
+		mu.Lock()
+		defer mu.Unlock()
+		return entries
+	}
+}
+
+func newTestLogShipper(url string) *LogShipper {
+	l := NewLogShipper(url)
+	l.client = http.DefaultClient
+	l.backoff = time.Millisecond
+	return l
+}
+
+func TestLogShipperFlushesOnClose(t *testing.T) {
+	server, entries := newLogService(t, func() int { return 0 })
+	l := newTestLogShipper(server.URL)
+	l.interval = time.Hour
+
+	for i := 0; i < 250; i++ {
+		l.Write(&ACLLogEntry{Name: "acl", Level: LogLvlINFO, Info: "request"})
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(entries()); got != 250 || l.shipped != 250 {
+		t.Errorf("expected every entry to be shipped. Got %d", got)
+	}
+
+	// entries after close are dropped
+	l.Write(&ACLLogEntry{Name: "acl", Level: LogLvlINFO, Info: "late"})
+	if l.dropped != 1 {
+		t.Errorf("expected late entry to be dropped. Got %d dropped", l.dropped)
+	}
+}
+
+func TestLogShipperRetries(t *testing.T) {
+	var attempts int32
+	server, entries := newLogService(t, func() int {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	})
+	l := newTestLogShipper(server.URL)
+
+	l.Write(&ACLLogEntry{Name: "acl", Level: LogLvlWarn, Info: "request"})
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(); len(got) != 1 || got[0].Level != LogLvlWarn || got[0].Name != "acl" {
+		t.Errorf("expected entry to be shipped after retrying. Got %+v", got)
+	}
+}
+
+func TestLogShipperRejectedEntries(t *testing.T) {
+	var attempts int32
+	server, _ := newLogService(t, func() int {
+		atomic.AddInt32(&attempts, 1)
+		return http.StatusBadRequest
+	})
+	l := newTestLogShipper(server.URL)
+
+	for i := 0; i < 3; i++ {
+		l.Write(&ACLLogEntry{Name: "acl", Level: LogLvlINFO, Info: "request"})
+	}
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || l.dropped != 3 {
+		t.Errorf("expected every rejected entry to be dropped without retrying. Got %d attempts and %d dropped", attempts, l.dropped)
+	}
+}
+
+func TestLogShipperDropsWhenDown(t *testing.T) {
+	server, _ := newLogService(t, func() int { return http.StatusBadGateway })
+	l := newTestLogShipper(server.URL)
+	l.queue = make(chan *ACLLogEntry, 2)
+	l.interval = time.Hour
+
+	// the background loop may have taken a few entries from the queue
+	for i := 0; i < 10; i++ {
+		l.Write(&ACLLogEntry{Name: "acl", Level: LogLvlINFO, Info: "request"})
+	}
+	if atomic.LoadUint64(&l.dropped) == 0 {
+		t.Error("expected entries to be dropped when the queue is full")
+	}
+
+	if err := l.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if l.shipped != 0 || l.dropped != 10 {
+		t.Errorf("expected every entry to be dropped. Got %d shipped and %d dropped", l.shipped, l.dropped)
+	}
+}
+
+func TestLogShipperCloseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := newLogService(t, func() int {
+		<-release
+		return 0
+	})
+	defer close(release)
+	l := newTestLogShipper(server.URL)
+	l.Write(&ACLLogEntry{Name: "acl", Level: LogLvlINFO, Info: "request"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected close to give up. Got %v", err)
+	}
+	if l.dropped != 1 {
+		t.Errorf("expected the pending entry to be dropped. Got %d", l.dropped)
+	}
+}
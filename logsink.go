@@ -0,0 +1,380 @@
+package aclsrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errLogSinkClosed = errors.New("log sink is closed")
+
+// LogSink is a destination of log entries, such as stdout, a file or the logging service
+type LogSink interface {
+	Write(entry *ACLLogEntry) error
+
+	// Close flushes pending entries. Entries written afterwards are dropped.
+	Close(ctx context.Context) error
+
+	// String describes the sink in metrics, eg. its path or url
+	String() string
+}
+
+// LogOutput sends entries of at least MinLevel to Sink
+type LogOutput struct {
+	Sink     LogSink
+	MinLevel int
+}
+
+// logOutput queues the entries of a sink, such that a slow sink, such as a syslog server that went
+// away, doesn't hold up the requests. Entries are dropped, and counted as errors, when the queue is full.
+type logOutput struct {
+	LogOutput
+	errors uint64 // atomic
+
+	mu     sync.RWMutex // held for writing when stopping, such that no entry is queued afterwards
+	closed bool
+	queue  chan *ACLLogEntry // nil for sinks that queue entries themselves
+	done   chan struct{}
+}
+
+func newLogOutput(output LogOutput) *logOutput {
+	o := &logOutput{LogOutput: output, done: make(chan struct{})}
+	if _, queued := output.Sink.(*LogShipper); queued {
+		close(o.done)
+		return o
+	}
+	o.queue = make(chan *ACLLogEntry, logQueueSize)
+	go o.run()
+	return o
+}
+
+// write queues an entry without blocking
+func (o *logOutput) write(entry *ACLLogEntry) {
+	if o.queue == nil {
+		o.failed(o.Sink.Write(entry))
+		return
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.closed {
+		o.failed(errLogSinkClosed)
+		return
+	}
+	select {
+	case o.queue <- entry:
+	default:
+		o.failed(errLogQueueFull)
+	}
+}
+
+func (o *logOutput) run() {
+	defer close(o.done)
+	for entry := range o.queue {
+		o.failed(o.Sink.Write(entry))
+	}
+}
+
+// failed counts an error of the sink
+func (o *logOutput) failed(err error) {
+	if err == nil {
+		return
+	}
+	// a broken sink would otherwise log every request
+	if n := atomic.AddUint64(&o.errors, 1); n == 1 || n%1000 == 0 {
+		log.Printf("log sink %s: %v (%d errors)", o.Sink, err, n)
+	}
+}
+
+// stop writes the queued entries, until ctx is done. The sink is left open.
+func (o *logOutput) stop(ctx context.Context) error {
+	if o.queue != nil {
+		o.mu.Lock()
+		if !o.closed {
+			o.closed = true
+			close(o.queue)
+		}
+		o.mu.Unlock()
+	}
+
+	select {
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetLogOutputs replaces the destinations of the request logs. Entries are written to every sink
+// that accepts their level, in the background. The replaced sinks are left open.
+func (s *State) SetLogOutputs(outputs ...LogOutput) {
+	logs := make([]*logOutput, len(outputs))
+	for i := range outputs {
+		logs[i] = newLogOutput(outputs[i])
+	}
+
+	s.Lock()
+	previous := s.logs
+	s.logs = logs
+	s.Unlock()
+
+	for _, output := range previous {
+		go output.stop(context.Background())
+	}
+}
+
+func (s *State) logOutputs() []*logOutput {
+	s.RLock()
+	defer s.RUnlock()
+	return s.logs
+}
+
+// CloseLogs writes the queued entries, and flushes and closes every log sink
+func (s *State) CloseLogs(ctx context.Context) (err error) {
+	for _, output := range s.logOutputs() {
+		if stopErr := output.stop(ctx); stopErr != nil && err == nil {
+			err = stopErr
+		}
+		if closeErr := output.Sink.Close(ctx); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// log queues an entry for every sink that accepts the level
+func (s *State) log(level int, info fmt.Stringer) {
+	entry := &ACLLogEntry{
+		Name:  "acl",
+		Level: level,
+		Info:  info.String(),
+	}
+	if entry.Info == "" {
+		log.Print("empty entry")
+		return
+	}
+
+	for _, output := range s.logOutputs() {
+		if level >= output.MinLevel {
+			output.write(entry)
+		}
+	}
+}
+
+// LogLevelName is the Java name of a level
+func LogLevelName(level int) string {
+	switch {
+	case level == LogLvlOff:
+		return "OFF"
+	case level >= LogLvlWarn:
+		return "WARNING"
+	case level >= LogLvlINFO:
+		return "INFO"
+	}
+	return "FINEST"
+}
+
+// ParseLogLevel parses the Java name of a level, such as INFO, or its number
+func ParseLogLevel(value string) (int, error) {
+	switch strings.ToUpper(strings.TrimSpace(value)) {
+	case "OFF":
+		return LogLvlOff, nil
+	case "WARN", "WARNING":
+		return LogLvlWarn, nil
+	case "INFO":
+		return LogLvlINFO, nil
+	case "FINEST":
+		return LogLvlFINEST, nil
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("unknown log level: " + value)
+	}
+	return level, nil
+}
+
+// jsonLogLine is a structured log entry
+type jsonLogLine struct {
+	Time    time.Time       `json:"time"`
+	Service string          `json:"service"`
+	Level   string          `json:"level"`
+	Info    json.RawMessage `json:"info"`
+}
+
+// marshalLogLine encodes an entry as a single line of json. Info is kept as json when it is.
+func marshalLogLine(entry *ACLLogEntry, now time.Time) ([]byte, error) {
+	line := &jsonLogLine{
+		Time:    now.UTC(),
+		Service: entry.Name,
+		Level:   LogLevelName(entry.Level),
+		Info:    json.RawMessage(entry.Info),
+	}
+	if !json.Valid(line.Info) {
+		info, err := json.Marshal(entry.Info)
+		if err != nil {
+			return nil, err
+		}
+		line.Info = info
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// JSONSink writes every entry as a line of json, eg. to stdout for a cluster log collector
+type JSONSink struct {
+	mu   sync.Mutex
+	w    io.Writer
+	name string
+}
+
+var _ LogSink = (*JSONSink)(nil)
+
+func NewJSONSink(w io.Writer, name string) *JSONSink {
+	return &JSONSink{w: w, name: name}
+}
+
+func NewStdoutSink() *JSONSink {
+	return NewJSONSink(os.Stdout, "stdout")
+}
+
+func (j *JSONSink) Write(entry *ACLLogEntry) error {
+	line, err := marshalLogLine(entry, time.Now())
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(line)
+	return err
+}
+
+func (j *JSONSink) Close(ctx context.Context) error {
+	return nil
+}
+
+func (j *JSONSink) String() string {
+	return j.name
+}
+
+// FileSink writes every entry as a line of json to a file. The file is rotated once it would grow
+// beyond MaxSize: <path> is renamed to <path>.1, <path>.1 to <path>.2 and so on, keeping MaxBackups files.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+var _ LogSink = (*FileSink)(nil)
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	f := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// rotate moves the current file to the first backup. Must be called while holding f.mu
+func (f *FileSink) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	if f.maxBackups <= 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *FileSink) Write(entry *ACLLogEntry) error {
+	line, err := marshalLogLine(entry, time.Now())
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return errLogSinkClosed
+	}
+	if f.file == nil {
+		// a previous rotation failed
+		if err = f.open(); err != nil {
+			return err
+		}
+	}
+	if f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err = f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+func (f *FileSink) Close(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed || f.file == nil {
+		f.closed = true
+		return nil
+	}
+	f.closed = true
+	return f.file.Close()
+}
+
+func (f *FileSink) String() string {
+	return f.path
+}
@@ -0,0 +1,238 @@
+package aclsrv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStateLogLevels(t *testing.T) {
+	var warnings, everything bytes.Buffer
+	state := NewState()
+	state.SetLogOutputs(
+		LogOutput{Sink: NewJSONSink(&warnings, "warnings"), MinLevel: LogLvlWarn},
+		LogOutput{Sink: NewJSONSink(&everything, "everything"), MinLevel: LogLvlFINEST},
+	)
+
+	state.log(LogLvlINFO, &LEapi{OriginalURL: "/api/users/list"})
+	state.log(LogLvlWarn, &LEapi{OriginalURL: "/api/users/42", Err: "timeout"})
+	if err := state.CloseLogs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Count(warnings.String(), "\n"); got != 1 {
+		t.Errorf("expected a single warning. Got %d lines", got)
+	}
+	if got := strings.Count(everything.String(), "\n"); got != 2 {
+		t.Errorf("expected every entry. Got %d lines", got)
+	}
+
+	line := struct {
+		Time    time.Time `json:"time"`
+		Service string    `json:"service"`
+		Level   string    `json:"level"`
+		Info    *LEapi    `json:"info"`
+	}{}
+	if err := json.Unmarshal(warnings.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Service != "acl" || line.Level != "WARNING" || line.Info.Err != "timeout" || line.Time.IsZero() {
+		t.Errorf("incorrect json line. Got %s", warnings.String())
+	}
+}
+
+// blockedSink waits for release on every write
+type blockedSink struct {
+	release chan struct{}
+	written uint64 // atomic
+}
+
+func (b *blockedSink) Write(entry *ACLLogEntry) error {
+	<-b.release
+	atomic.AddUint64(&b.written, 1)
+	return nil
+}
+
+func (b *blockedSink) Close(ctx context.Context) error {
+	return nil
+}
+
+func (b *blockedSink) String() string {
+	return "blocked"
+}
+
+func TestStateLogSlowSink(t *testing.T) {
+	sink := &blockedSink{release: make(chan struct{})}
+	state := NewState()
+	state.SetLogOutputs(LogOutput{Sink: sink, MinLevel: LogLvlINFO})
+
+	// requests are not held up by the sink, entries beyond the queue are dropped
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < logQueueSize+10; i++ {
+			state.log(LogLvlINFO, &LEapi{OriginalURL: "/api/users/list"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected logging not to wait for the sink")
+	}
+	if errors := atomic.LoadUint64(&state.logOutputs()[0].errors); errors < 9 {
+		t.Errorf("expected dropped entries to be counted. Got %d", errors)
+	}
+
+	close(sink.release)
+	if err := state.CloseLogs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if written := atomic.LoadUint64(&sink.written); written < logQueueSize {
+		t.Errorf("expected queued entries to be written on close. Got %d", written)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for value, wants := range map[string]int{"warn": LogLvlWarn, "WARNING": LogLvlWarn, "INFO": LogLvlINFO, "finest": LogLvlFINEST, "off": LogLvlOff, "500": 500} {
+		if got, err := ParseLogLevel(value); err != nil || got != wants {
+			t.Errorf("incorrect level of %s. Got %d, wants %d", value, got, wants)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("expected unknown level to fail")
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acl.log")
+	entry := &ACLLogEntry{Name: "acl", Level: LogLvlINFO, Info: "request"}
+	line, _ := marshalLogLine(entry, time.Now())
+
+	// room for two lines per file. Lines differ a few bytes in length, as trailing zeros of the
+	// time are left out
+	sink, err := NewFileSink(path, int64(5*len(line)/2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err = sink.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, lines := range map[string]int{"acl.log": 1, "acl.log.1": 2, "acl.log.2": 2} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(string(data), "\n"); got != lines {
+			t.Errorf("incorrect lines in %s. Got %d, wants %d", name, got, lines)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected only two backups")
+	}
+	if err = sink.Write(entry); err != errLogSinkClosed {
+		t.Errorf("expected closed sink. Got %v", err)
+	}
+}
+
+var syslogMessage = regexp.MustCompile(`^<(\d+)>1 \S+Z \S+ acl \d+ - - (\{.*\})$`)
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewSyslogSink("udp", conn.LocalAddr().String(), "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close(context.Background())
+	if err = sink.Write(&ACLLogEntry{Name: "acl", Level: LogLvlWarn, Info: `{"ip":"10.0.0.1"}`}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := syslogMessage.FindStringSubmatch(string(buf[:n]))
+	if match == nil {
+		t.Fatalf("incorrect syslog message. Got %s", buf[:n])
+	}
+	if match[1] != "132" { // local0.warning
+		t.Errorf("incorrect priority. Got %s", match[1])
+	}
+	if !strings.Contains(match[2], `"info":{"ip":"10.0.0.1"}`) {
+		t.Errorf("incorrect message. Got %s", match[2])
+	}
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sink, err := NewSyslogSink("tcp", listener.Addr().String(), "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close(context.Background())
+	for _, level := range []int{LogLvlINFO, LogLvlFINEST} {
+		if err = sink.Write(&ACLLogEntry{Name: "acl", Level: level, Info: "not json"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+
+	// octet counting: <length> <message>
+	for _, priority := range []string{"134", "135"} {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(length))
+		msg := make([]byte, size)
+		if _, err = io.ReadFull(reader, msg); err != nil {
+			t.Fatal(err)
+		}
+		match := syslogMessage.FindStringSubmatch(string(msg))
+		if match == nil || match[1] != priority || !strings.Contains(match[2], `"info":"not json"`) {
+			t.Errorf("incorrect syslog message. Got %s", msg)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package aclsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// there is no logging service during tests
+	logClient = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{}`))),
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,321 @@
+package aclsrv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ACL decisions, see the decision label of acl_requests_total
+const (
+	DecisionAllowed    = "allowed"
+	DecisionDenied     = "denied"
+	DecisionWouldDeny  = "would-deny" // denied by an ACL entry in report-only mode, but proxied
+	DecisionNoJWT      = "no-jwt"
+	DecisionInvalidJWT = "invalid-jwt"
+	DecisionLimited    = "limited"   // rate limit or daily quota
+	DecisionNotFound   = "not-found" // unknown service or user script
+	DecisionLockdown   = "lockdown"  // the service, user script or platform is shut off
+)
+
+// upper bounds of the request duration buckets, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// requestLabels of a request to /api or /script
+type requestLabels struct {
+	route    string // streamRouteAPI or streamRouteScript
+	service  string // empty when not found, as the name comes from the client
+	method   string // see methodLabel
+	decision string
+	upstream string // http status of the service, see upstreamStatusLabel
+}
+
+// newRequestLabels are the labels of a request that has not been decided on yet
+func newRequestLabels(route string, r *http.Request) *requestLabels {
+	return &requestLabels{
+		route:    route,
+		method:   methodLabel(r.Method),
+		decision: DecisionAllowed,
+		upstream: upstreamStatusLabel(0, nil),
+	}
+}
+
+// methodLabel is the http method, or "other" for methods that are not standard, as clients can
+// send any method
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// upstreamStatusLabel is the http status of the service, the reason it could not be reached, or
+// "none" when the request was not sent to the service
+func upstreamStatusLabel(status int, err error) string {
+	if err != nil {
+		response := &JSend{}
+		response.upstreamError(err)
+		switch response.ErrorCode {
+		case ErrCodeCircuitOpen:
+			return "circuit-open"
+		case ErrCodeUpstreamTimeout:
+			return "timeout"
+		}
+		return "unavailable"
+	}
+	if status == 0 {
+		return "none"
+	}
+	return strconv.Itoa(status)
+}
+
+type histogram struct {
+	buckets []uint64 // not cumulative, the last one is +Inf
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(durationBuckets, v)
+	h.buckets[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics collects the traffic of the gateway. Everything else is read from the state when scraped.
+type metrics struct {
+	mu        sync.Mutex
+	requests  map[requestLabels]*histogram
+	snapshots map[snapshotLabels]uint64
+}
+
+type snapshotLabels struct {
+	source string // see SnapshotSourceConsul
+	result string // see SnapshotApplied
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  map[requestLabels]*histogram{},
+		snapshots: map[snapshotLabels]uint64{},
+	}
+}
+
+func (m *metrics) observeSnapshot(source, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshots[snapshotLabels{source: source, result: result}]++
+}
+
+func (m *metrics) observeRequest(labels *requestLabels, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.requests[*labels]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets)+1)}
+		m.requests[*labels] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+// MetricsHandler serves the metrics to callers holding the internal token (?token=<ACL_INTERNAL_TOKEN>)
+// or PFlagSeeClusterInfo, as the labels hold user script tokens and the addresses of the services
+func (s *State) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token == "" || token != os.Getenv("ACL_INTERNAL_TOKEN") {
+		response := &JSend{}
+		if s.authorize(r, PFlagSeeClusterInfo, response) == nil {
+			response.write(w)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	s.writeMetrics(buf)
+	_ = buf.Flush()
+}
+
+func (s *State) writeMetrics(w io.Writer) {
+	s.writeRequestMetrics(w)
+
+	// jwks
+	health := s.Health()
+	writeHeader(w, "acl_jwks_fetches_total", "counter", "JWKS fetches by url and result.")
+	for _, jwks := range health.JWKS {
+		writeSample(w, "acl_jwks_fetches_total", float64(jwks.Fetches-jwks.Failures), "url", jwks.URL, "result", "success")
+		writeSample(w, "acl_jwks_fetches_total", float64(jwks.Failures), "url", jwks.URL, "result", "failure")
+	}
+	writeHeader(w, "acl_jwks_keys", "gauge", "Keys loaded from a JWKS url.")
+	for _, jwks := range health.JWKS {
+		writeSample(w, "acl_jwks_keys", float64(jwks.Keys), "url", jwks.URL)
+	}
+
+	// load balancers
+	upstreams := s.upstreamStatus()
+	endpointMetrics := []struct {
+		name, kind, help string
+		value            func(e *EndpointStatus) float64
+	}{
+		{"acl_upstream_outstanding_requests", "gauge", "Requests in flight per address.", func(e *EndpointStatus) float64 {
+			return float64(e.Outstanding)
+		}},
+		{"acl_upstream_requests_total", "counter", "Requests sent per address.", func(e *EndpointStatus) float64 {
+			return float64(e.Requests)
+		}},
+		{"acl_upstream_failures_total", "counter", "Failed requests per address.", func(e *EndpointStatus) float64 {
+			return float64(e.Failures)
+		}},
+		{"acl_upstream_latency_seconds", "gauge", "Moving average of the response latency per address.", func(e *EndpointStatus) float64 {
+			return e.LatencyMS / 1000
+		}},
+		{"acl_upstream_ejected", "gauge", "1 if the address is ejected from the load balancer.", func(e *EndpointStatus) float64 {
+			if e.Ejected {
+				return 1
+			}
+			return 0
+		}},
+	}
+	for _, metric := range endpointMetrics {
+		writeHeader(w, metric.name, metric.kind, metric.help)
+		for _, u := range upstreams {
+			for _, e := range u.Endpoints {
+				writeSample(w, metric.name, metric.value(e), "route", u.Route, "service", u.Service, "address", e.Address)
+			}
+		}
+	}
+
+	// request logs
+	outputs := s.logOutputs()
+	writeHeader(w, "acl_log_write_errors_total", "counter", "Log entries a sink failed to write.")
+	for _, output := range outputs {
+		writeSample(w, "acl_log_write_errors_total", float64(atomic.LoadUint64(&output.errors)), "sink", output.Sink.String())
+	}
+	var shippers []*LogShipper
+	for _, output := range outputs {
+		if shipper, ok := output.Sink.(*LogShipper); ok {
+			shippers = append(shippers, shipper)
+		}
+	}
+	writeHeader(w, "acl_log_entries_shipped_total", "counter", "Log entries sent to the logging service.")
+	for _, l := range shippers {
+		writeSample(w, "acl_log_entries_shipped_total", float64(atomic.LoadUint64(&l.shipped)), "sink", l.String())
+	}
+	writeHeader(w, "acl_log_entries_dropped_total", "counter", "Log entries dropped as the queue was full or the logging service failed.")
+	for _, l := range shippers {
+		writeSample(w, "acl_log_entries_dropped_total", float64(atomic.LoadUint64(&l.dropped)), "sink", l.String())
+	}
+	writeHeader(w, "acl_log_queue_length", "gauge", "Log entries waiting to be shipped.")
+	for _, l := range shippers {
+		writeSample(w, "acl_log_queue_length", float64(len(l.queue)), "sink", l.String())
+	}
+
+	// audit log
+	if audit := s.auditLog(); audit != nil {
+		writeHeader(w, "acl_audit_records_total", "counter", "Access decisions recorded in the audit log.")
+		writeSample(w, "acl_audit_records_total", float64(atomic.LoadUint64(&audit.records)))
+		writeHeader(w, "acl_audit_errors_total", "counter", "Access decisions that could not be recorded, their requests were rejected.")
+		writeSample(w, "acl_audit_errors_total", float64(atomic.LoadUint64(&audit.errors)))
+	}
+
+	// discovery
+	snap := s.Snapshot()
+	updated := snap.updated
+	services, scripts := len(snap.Services), len(snap.UserScripts)
+
+	if !updated.IsZero() {
+		writeHeader(w, "acl_discovery_snapshot_age_seconds", "gauge", "Time since services and ACL entries were last updated.")
+		writeSample(w, "acl_discovery_snapshot_age_seconds", time.Since(updated).Seconds())
+	}
+	s.metrics.mu.Lock()
+	snapshots := make([]snapshotLabels, 0, len(s.metrics.snapshots))
+	for l := range s.metrics.snapshots {
+		snapshots = append(snapshots, l)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].source+snapshots[i].result < snapshots[j].source+snapshots[j].result
+	})
+	writeHeader(w, "acl_discovery_updates_total", "counter", "Discovery updates by source, applied or rejected as invalid.")
+	for _, l := range snapshots {
+		writeSample(w, "acl_discovery_updates_total", float64(s.metrics.snapshots[l]), "source", l.source, "result", l.result)
+	}
+	s.metrics.mu.Unlock()
+
+	writeHeader(w, "acl_services", "gauge", "Services exposed at /api.")
+	writeSample(w, "acl_services", float64(services))
+	writeHeader(w, "acl_user_scripts", "gauge", "User scripts exposed at /script.")
+	writeSample(w, "acl_user_scripts", float64(scripts))
+}
+
+// pairs of label names and values
+func (l requestLabels) pairs() []string {
+	return []string{"route", l.route, "service", l.service, "method", l.method, "decision", l.decision, "upstream_status", l.upstream}
+}
+
+func (s *State) writeRequestMetrics(w io.Writer) {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+
+	labels := make([]requestLabels, 0, len(s.metrics.requests))
+	for l := range s.metrics.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return strings.Join(labels[i].pairs(), "\x00") < strings.Join(labels[j].pairs(), "\x00")
+	})
+
+	writeHeader(w, "acl_requests_total", "counter", "Requests to /api and /script.")
+	for _, l := range labels {
+		writeSample(w, "acl_requests_total", float64(s.metrics.requests[l].count), l.pairs()...)
+	}
+
+	writeHeader(w, "acl_request_duration_seconds", "histogram", "Duration of requests to /api and /script, including whole WebSocket and Server-Sent Events sessions.")
+	for _, l := range labels {
+		h := s.metrics.requests[l]
+		var cumulative uint64
+		for i, count := range h.buckets {
+			cumulative += count
+			le := "+Inf"
+			if i < len(durationBuckets) {
+				le = strconv.FormatFloat(durationBuckets[i], 'g', -1, 64)
+			}
+			writeSample(w, "acl_request_duration_seconds_bucket", float64(cumulative), append(l.pairs(), "le", le)...)
+		}
+		writeSample(w, "acl_request_duration_seconds_sum", h.sum, l.pairs()...)
+		writeSample(w, "acl_request_duration_seconds_count", float64(h.count), l.pairs()...)
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes a sample with the given label name and value pairs
+func writeSample(w io.Writer, name string, value float64, labels ...string) {
+	var sample strings.Builder
+	sample.WriteString(name)
+	if len(labels) > 0 {
+		sample.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				sample.WriteByte(',')
+			}
+			sample.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		sample.WriteByte('}')
+	}
+	fmt.Fprintf(w, "%s %s\n", sample.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,143 @@
+package aclsrv
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	previous, set := os.LookupEnv("ACL_INTERNAL_TOKEN")
+	os.Setenv("ACL_INTERNAL_TOKEN", "secret")
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("ACL_INTERNAL_TOKEN", previous)
+		} else {
+			os.Unsetenv("ACL_INTERNAL_TOKEN")
+		}
+	})
+
+	idp := newTestIssuer(t)
+	backend := newJSONBackend(t)
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Config = []ACLConfigEntry{{Key: "jwt", Val: "true"}}
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backendAddress(backend)}},
+		}
+		snap.UserScripts = []*Service{
+			{Name: "abc123", Addresses: []string{backendAddress(backend)}},
+		}
+		snap.ACL = []*ACLEntry{
+			{Service: "users", Rules: []*ACLRule{{Method: http.MethodDelete, Path: "/**", MinimumPermission: PFlagUsersAll}}},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	send := func(method, path string, header http.Header) {
+		req, _ := http.NewRequest(method, gateway.URL+path, nil)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	token := authHeader(idp.sign(t, AlgRS256, nil))
+	send(http.MethodGet, "/api/users/list", token)
+	send(http.MethodGet, "/api/users/list", token)
+	send(http.MethodDelete, "/api/users/42", token)
+	send(http.MethodGet, "/api/users/list", nil)
+	send(http.MethodGet, "/api/users/list", authHeader("not.a.jwt"))
+	send(http.MethodGet, "/api/unknown/list", token)
+	send(http.MethodPost, "/script/abc123/run", nil)
+
+	// the labels hold user script tokens and internal addresses
+	for _, header := range []http.Header{nil, token} {
+		req, _ := http.NewRequest(http.MethodGet, gateway.URL+"/metrics?token=wrong", nil)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected metrics to be refused. Got %s", resp.Status)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, gateway.URL+"/metrics", nil)
+	req.Header = authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected admins to see the metrics. Got %s", resp.Status)
+	}
+
+	resp, err = http.Get(gateway.URL + "/metrics?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	metrics := string(data)
+
+	expected := []string{
+		`acl_requests_total{route="api",service="users",method="GET",decision="allowed",upstream_status="200"} 2`,
+		`acl_requests_total{route="api",service="users",method="DELETE",decision="denied",upstream_status="none"} 1`,
+		`acl_requests_total{route="api",service="users",method="GET",decision="no-jwt",upstream_status="none"} 1`,
+		`acl_requests_total{route="api",service="users",method="GET",decision="invalid-jwt",upstream_status="none"} 1`,
+		`acl_requests_total{route="api",service="",method="GET",decision="not-found",upstream_status="none"} 1`,
+		`acl_requests_total{route="script",service="abc123",method="POST",decision="allowed",upstream_status="200"} 1`,
+		`acl_request_duration_seconds_bucket{route="api",service="users",method="GET",decision="allowed",upstream_status="200",le="+Inf"} 2`,
+		`acl_request_duration_seconds_count{route="api",service="users",method="GET",decision="allowed",upstream_status="200"} 2`,
+		`acl_jwks_fetches_total{url="` + idp.URL + `/.well-known/jwks.json",result="success"} 1`,
+		`acl_upstream_requests_total{route="api",service="users",address="` + backendAddress(backend) + `"} 2`,
+		`acl_upstream_ejected{route="api",service="users",address="` + backendAddress(backend) + `"} 0`,
+		`acl_services 1`,
+		`acl_user_scripts 1`,
+		`# TYPE acl_request_duration_seconds histogram`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, metrics)
+		}
+	}
+	if !strings.Contains(metrics, "acl_discovery_snapshot_age_seconds ") {
+		t.Error("expected snapshot age to be reported once a snapshot was applied")
+	}
+
+	var empty strings.Builder
+	NewState().writeMetrics(&empty)
+	if strings.Contains(empty.String(), "acl_discovery_snapshot_age_seconds") {
+		t.Error("snapshot age should not be reported before the first update")
+	}
+}
+
+func TestMethodLabel(t *testing.T) {
+	for method, label := range map[string]string{http.MethodGet: "GET", http.MethodPatch: "PATCH", "get": "other", "BREW": "other"} {
+		if got := methodLabel(method); got != label {
+			t.Errorf("incorrect label of %s. Got %s, wants %s", method, got, label)
+		}
+	}
+}
+
+func TestWriteSampleEscapesLabels(t *testing.T) {
+	var b strings.Builder
+	writeSample(&b, "acl_test", 1.5, "path", "a\"b\\c\nd")
+	if got, wants := b.String(), `acl_test{path="a\"b\\c\nd"} 1.5`+"\n"; got != wants {
+		t.Errorf("incorrect sample. Got %s, wants %s", got, wants)
+	}
+}
@@ -8,8 +8,6 @@ import (
 	"strings"
 )
 
-const jwksURL = "https://cognito-idp.us-east-1.amazonaws.com/us-east-1_AMfopmP6e/.well-known/jwks.json"
-
 // Permission is user level. It represents a group of different permissions/activities/actions
 // a user can execute on the platform
 type Permission uint32
@@ -44,6 +42,47 @@ const (
 	// To add move permission flags, create a PR or a GitHub issue.
 )
 
+// names of the permission flags, by bit
+var permissionFlagNames = []string{
+	"PFlagSeeUsers",
+	"PFlagUserSelf",
+	"PFlagUsersAll",
+	"PFlagSrvLogsSelf",
+	"PFlagSrvLogsAll",
+	"PFlagPlatformLogs",
+	"PFlagSeeJolieAll",
+	"PFlagSeeUserSafeSrv",
+	"PFlagDeployJolie",
+	"PFlagManageJolieSelf",
+	"PFlagManageJolieAll",
+	"PFlagSeeSrvAll",
+	"PFlagCreateSrv",
+	"PFlagManageSrvSelf",
+	"PFlagManageSrvAll",
+	"PFlagManageGCloud",
+	"PFlagSeeClusterInfo",
+	"PFlagSeePlatformDocs",
+	"PFlagManagePlatformDocs",
+	"PFlagMoveSrv",
+}
+
+// Flags lists the names of every flag set, eg. [PFlagSeeUsers PFlagUsersAll]. Flags without a
+// name are listed by their bit, eg. flag21.
+func (p Permission) Flags() []string {
+	flags := []string{}
+	for bit := 0; bit < 32; bit++ {
+		if p&(1<<uint(bit)) == 0 {
+			continue
+		}
+		if bit < len(permissionFlagNames) {
+			flags = append(flags, permissionFlagNames[bit])
+		} else {
+			flags = append(flags, "flag"+strconv.Itoa(bit+1))
+		}
+	}
+	return flags
+}
+
 // basic roles
 //
 
@@ -132,7 +171,8 @@ func getJWT(header http.Header) string {
 	jwt := header.Get("jwt")
 	jwt2 := header.Get("Authorization")
 
-	if jwt == "" && jwt2 != "" {
+	// other schemes, or a header too short to hold one, are no JWT
+	if jwt == "" && strings.HasPrefix(jwt2, "Bearer ") {
 		jwt = jwt2[len("Bearer "):]
 	}
 
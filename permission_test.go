@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/lestrrat-go/jwx/jwk"
+	"net/http"
 	"testing"
 )
 
@@ -21,6 +22,21 @@ func TestJWTParser(t *testing.T) {
 	fmt.Printf("%+v\n", b)
 }
 
+func TestGetJWT(t *testing.T) {
+	for value, wants := range map[string]string{
+		"Bearer abc": "abc",
+		"Token":      "",
+		"Basic YWJj": "",
+		"":           "",
+	} {
+		header := http.Header{}
+		header.Set("Authorization", value)
+		if got := getJWT(header); got != wants {
+			t.Errorf("%q: got %q, wants %q", value, got, wants)
+		}
+	}
+}
+
 func TestPermission(t *testing.T) {
 	fmt.Println(PermissionLvlUsr)
 	fmt.Println(PermissionLvlDev)
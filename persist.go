@@ -0,0 +1,160 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// SnapshotSourceFile is a snapshot restored by LoadStateFile
+	SnapshotSourceFile = "file"
+
+	// DefaultStateFileMaxAge is the age after which a saved state is refused
+	DefaultStateFileMaxAge = 24 * time.Hour
+)
+
+var errStateFileExpired = errors.New("state file is too old")
+
+// stateFile is the last known state, saved so a restart can serve requests while service
+// discovery is unavailable
+type stateFile struct {
+	Updated  time.Time                  `json:"updated"` // when the snapshot was applied
+	Snapshot *Snapshot                  `json:"snapshot"`
+	Pinned   string                     `json:"pinned,omitempty"` // see /admin/history
+	JWKS     map[string]json.RawMessage `json:"jwks,omitempty"`   // JWKS documents by jwks url
+}
+
+// LoadStateFile restores the services, ACL configuration, JWKS and pinned version saved in path, and
+// saves them there from now on. A state older than maxAge is refused, or dropped once it gets older
+// while discovery delivers nothing, and a missing file is not an error. Until service discovery
+// delivers data, /health reports the state as degraded.
+func (s *State) LoadStateFile(path string, maxAge time.Duration) error {
+	s.stateFileMu.Lock()
+	s.stateFile = path
+	s.stateFileMu.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	file := &stateFile{}
+	if err = json.Unmarshal(data, file); err != nil {
+		return errors.New("invalid state file: " + err.Error())
+	}
+	if file.Snapshot == nil {
+		return errors.New("invalid state file: missing snapshot")
+	}
+	if time.Since(file.Updated) > maxAge {
+		return errStateFileExpired
+	}
+	if s.Snapshot().version != "" {
+		// discovery was faster
+		return nil
+	}
+
+	s.jwksMu.Lock()
+	for url, document := range file.JWKS {
+		s.jwksSaved[url] = document
+	}
+	s.jwksMu.Unlock()
+
+	file.Snapshot.updated = file.Updated
+	if _, err = s.applySnapshot(SnapshotSourceFile, file.Snapshot); err != nil {
+		return err
+	}
+
+	if file.Pinned != "" {
+		s.snapMu.Lock()
+		s.history.pinned = file.Pinned
+		s.snapMu.Unlock()
+		s.saveStateFile()
+		log.Print("state file: version " + file.Pinned + " is pinned, discovery updates are held back")
+	}
+	time.AfterFunc(maxAge-time.Since(file.Updated), s.expireStateFile)
+	return nil
+}
+
+// expireStateFile drops the restored state once it is older than the max age, unless service
+// discovery delivered data in the meantime. The ACL is then empty, as it would be without the file.
+func (s *State) expireStateFile() {
+	s.snapMu.Lock()
+	previous := s.Snapshot()
+	if !previous.restored {
+		s.snapMu.Unlock()
+		return
+	}
+	snap := &Snapshot{expired: true}
+	snap.index()
+	s.snap.Store(snap)
+	s.history.pinned, s.history.held = "", nil
+	s.snapMu.Unlock()
+
+	log.Print("state file: the state of " + previous.updated.UTC().Format(time.RFC3339) + " is too old, and was dropped")
+	s.pruneJWKS()
+	s.pruneUpstreams()
+	s.revalidateStreams()
+}
+
+// saveStateFile replaces the state file by the current snapshot and JWKS, when set
+func (s *State) saveStateFile() {
+	s.stateFileMu.Lock()
+	defer s.stateFileMu.Unlock()
+
+	snap := s.Snapshot()
+	if s.stateFile == "" || snap.version == "" {
+		return
+	}
+	file := &stateFile{
+		Updated:  snap.updated,
+		Snapshot: snap,
+		Pinned:   s.pinned(),
+		JWKS:     map[string]json.RawMessage{},
+	}
+	s.jwksMu.RLock()
+	for url, document := range s.jwksSaved {
+		file.JWKS[url] = document
+	}
+	for url, m := range s.jwks {
+		if document := m.document(); document != nil {
+			file.JWKS[url] = document
+		}
+	}
+	s.jwksMu.RUnlock()
+
+	data, err := json.Marshal(file)
+	if err == nil {
+		err = writeFileAtomic(s.stateFile, data)
+	}
+	if err != nil {
+		log.Print("state file: ", err)
+	}
+}
+
+// writeFileAtomic replaces a file, so a crash never leaves it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package aclsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aclsrv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	idp := newTestIssuer(t)
+	token := authHeader(idp.sign(t, AlgRS256, nil))
+	state := NewState()
+	if err = state.LoadStateFile(path, time.Hour); err != nil {
+		t.Fatalf("expected missing state file to be ignored. Got %v", err)
+	}
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Services = []*Service{{Name: "users", Addresses: []string{"10.0.0.1:80"}}}
+		snap.ACL = []*ACLEntry{{Service: "users", MinimumPermission: PFlagUsersAll}}
+	})
+	if _, err = state.authenticate(token); err != nil {
+		t.Fatal(err)
+	}
+	version := state.Snapshot().version
+	if _, err = state.pin(version, "anders"); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted while consul and the IdP are unavailable
+	idp.Close()
+	restarted := NewState()
+	if err = restarted.LoadStateFile(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Service("users") == nil || restarted.ServiceACL(&Service{Name: "users"}) == nil {
+		t.Error("expected services and ACL entries to be restored")
+	}
+	if _, err = restarted.authenticate(token); err != nil {
+		t.Errorf("expected saved JWKS to be used. Got %v", err)
+	}
+	if health := restarted.Health(); health.Status != HealthDegraded || len(health.JWKS) != 1 || !health.JWKS[0].Restored {
+		t.Errorf("expected restored state to be degraded. Got %+v", health)
+	}
+	if restarted.pinned() != version || restarted.Snapshot().version != version {
+		t.Errorf("expected version %s to stay pinned. Got %s", version, restarted.pinned())
+	}
+
+	// discovery delivers while the version is pinned
+	setSnapshot(t, restarted, func(snap *Snapshot) {
+		snap.Services = append(snap.Services, &Service{Name: "orders", Addresses: []string{"10.0.0.2:80"}})
+	})
+	if health := restarted.Health(); health.Status != HealthOK || restarted.Service("orders") != nil {
+		t.Errorf("expected fresh data to end the degraded state, and to be held back. Got %+v", health)
+	}
+	if _, err = restarted.unpin("anders"); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Service("orders") == nil {
+		t.Error("expected held update to be applied on unpin")
+	}
+
+	// consul stays away until the state gets too old
+	expiring := NewState()
+	if err = expiring.LoadStateFile(path, 500*time.Millisecond); err != nil || expiring.Service("users") == nil {
+		t.Fatalf("expected recent state to be restored. Got %v", err)
+	}
+	eventually(t, "state file to expire", func() bool {
+		return expiring.Service("users") == nil
+	})
+	if health := expiring.Health(); health.Status != HealthDegraded {
+		t.Errorf("expected dropped state to be degraded. Got %+v", health)
+	}
+	setSnapshot(t, expiring, func(snap *Snapshot) {})
+	if health := expiring.Health(); health.Status != HealthOK {
+		t.Errorf("expected fresh data to end the degraded state. Got %+v", health)
+	}
+
+	stale := NewState()
+	if err = stale.LoadStateFile(path, time.Nanosecond); err != errStateFileExpired || stale.Service("users") != nil {
+		t.Errorf("expected old state to be refused. Got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package aclsrv
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// streamProxy streams the request to the target and the response back to the client, without
+// buffering and without a JSend envelope. Responses are flushed as soon as data arrives from
+// the service, and trailers and protocol upgrades are kept. onError is called if the service
+// could not be reached.
+func (s *State) streamProxy(w http.ResponseWriter, r *http.Request, target *url.URL, transport http.RoundTripper, onError func(err error)) {
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = target.Path
+			req.URL.RawPath = target.RawPath
+			req.URL.RawQuery = target.RawQuery
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			onError(err)
+
+			response := &JSend{}
+			response.upstreamError(err)
+			response.write(w)
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+// statusCode returns the status code of a response, or 0 if there is none
+func statusCode(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,196 @@
+package aclsrv
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// newTestGateway serves the ACL routes of the given state
+func newTestGateway(t *testing.T, state *State) *httptest.Server {
+	router := httprouter.New()
+	SetupRoutes(router, state)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newJSONBackend is a service that answers every request with an empty json object
+func newJSONBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// backendAddress returns the <ip:port> of a test server
+func backendAddress(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestAPIHandlerStream(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/report.csv" || r.URL.Query().Get("v") != "2" {
+			t.Errorf("unexpected request to backend: %s", r.URL.String())
+		}
+
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("id,name\n"))
+		w.(http.Flusher).Flush()
+
+		<-release
+		_, _ = w.Write([]byte("1,anders\n"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{
+			{Name: "docs", Addresses: []string{backendAddress(backend)}, Proxy: ProxyModeStream},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	resp, err := http.Get(gateway.URL + "/api/docs/files/report.csv?v=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "text/csv" {
+		t.Errorf("incorrect content type. Got %s, wants %s", got, "text/csv")
+	}
+
+	// the first chunk must arrive before the backend has finished
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "id,name\n" {
+		t.Errorf("incorrect first chunk. Got %q", line)
+	}
+	close(release)
+
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "1,anders\n" {
+		t.Errorf("incorrect second chunk. Got %q", string(rest))
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+		t.Errorf("missing trailer. Got %q", got)
+	}
+}
+
+func TestAPIHandlerStreamChecksAccess(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not reach the backend")
+	}))
+	defer backend.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Config = []ACLConfigEntry{{Key: "jwt", Val: true}}
+		snap.Services = []*Service{
+			{Name: "docs", Addresses: []string{backendAddress(backend)}, Proxy: ProxyModeStream},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	resp, err := http.Get(gateway.URL + "/api/docs/files/report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	response := &JSend{}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status == JSendSuccess || response.Message != errMissingJWT.Error() {
+		t.Errorf("expected missing JWT response. Got %+v", response)
+	}
+}
+
+func TestAPIHandlerStreamEnforcesBody(t *testing.T) {
+	bodies := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer backend.Close()
+
+	idp := newTestIssuer(t)
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Config = []ACLConfigEntry{{Key: "enforce", Val: "true"}}
+		snap.Services = []*Service{
+			{Name: "docs", Addresses: []string{backendAddress(backend)}, Proxy: ProxyModeStream},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	// the declared content type is up to the caller, and does not turn enforcement off
+	for contentType, body := range map[string]string{
+		"application/json": `{"acle_user_id":"admin"}`,
+		"text/plain":       `{"acle_user_id":"admin"}`,
+		"text/csv":         "acle_user_id\nadmin\n",
+	} {
+		req, _ := http.NewRequest(http.MethodPost, gateway.URL+"/api/docs/upload", strings.NewReader(body))
+		req.Header = authHeader(idp.sign(t, AlgRS256, nil))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		wants := body
+		if strings.HasPrefix(body, "{") {
+			wants = `{"acle_user_id":"andersfylling"}`
+		}
+		if got := <-bodies; got != wants {
+			t.Errorf("%s: incorrect body. Got %s, wants %s", contentType, got, wants)
+		}
+	}
+
+	// a lenient json parser would read the first value, so it must not slip through
+	req, _ := http.NewRequest(http.MethodPost, gateway.URL+"/api/docs/upload", strings.NewReader(`{"acle_user_id":"admin"} x`))
+	req.Header = authHeader(idp.sign(t, AlgRS256, nil))
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	response := &JSend{}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil || response.Status == JSendSuccess {
+		t.Errorf("expected body with trailing data to be refused. Got %+v %v", response, err)
+	}
+}
+
+// setSnapshot applies a copy of the current snapshot, changed by edit
+func setSnapshot(t testing.TB, state *State, edit func(snap *Snapshot)) {
+	t.Helper()
+	snap := state.Snapshot().copy()
+	edit(snap)
+	if _, err := state.applySnapshot("test", snap); err != nil {
+		t.Fatal(err)
+	}
+}
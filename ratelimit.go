@@ -0,0 +1,260 @@
+package aclsrv
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rate limit keys, see RateLimit.Key
+const (
+	RateLimitAnonymous     = "anonymous" // per client IP, for callers without a valid JWT
+	RateLimitRolePrefix    = "role:"     // per user with the role, eg. role:usr
+	RateLimitServicePrefix = "service:"  // every request to the service
+	RateLimitScriptPrefix  = "script:"   // every request to the user script
+)
+
+var errRateLimitStore = errors.New("rate limits are unavailable, try again later")
+
+// RateLimit is a token bucket: Requests are allowed every Per, with bursts of up to Burst requests.
+// Configured as json in the Consul KV storage: srv-acl_ACLEntry-ratelimit_<key>
+type RateLimit struct {
+	Key      string   `json:"key"`
+	Requests float64  `json:"requests"`
+	Per      Duration `json:"per,omitempty"`   // defaults to a second
+	Burst    int      `json:"burst,omitempty"` // defaults to Requests
+}
+
+func (l *RateLimit) validate() error {
+	if l.Requests <= 0 {
+		return errors.New("requests must be positive")
+	}
+	if l.Per < 0 || l.Burst < 0 {
+		return errors.New("per and burst must not be negative")
+	}
+	if float64(l.per())/l.Requests < 1 {
+		// the interval between requests would be 0, see RateBucket
+		return errors.New("requests must not exceed one per nanosecond")
+	}
+	return nil
+}
+
+func (l *RateLimit) per() time.Duration {
+	if l.Per > 0 {
+		return time.Duration(l.Per)
+	}
+	return time.Second
+}
+
+func (l *RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Ceil(l.Requests))
+}
+
+// bucket of the limit for a subject, such as a user ID or IP
+func (l *RateLimit) bucket(subject string) *RateBucket {
+	return &RateBucket{
+		Key:      l.Key + "|" + subject,
+		Interval: time.Duration(float64(l.per()) / l.Requests),
+		Burst:    l.burst(),
+	}
+}
+
+// Quota limits the number of requests a user sends to (part of) a service per day, in UTC.
+// Configured as a json list in the Consul KV storage: srv-acl_ACLEntry-quota_<service>
+type Quota struct {
+	Method string `json:"method,omitempty"` // any method when empty
+	Path   string `json:"path,omitempty"`   // pattern as in ACL rules, the whole service when empty
+	Daily  int    `json:"daily"`
+
+	// Roles overrides the daily quota per role, eg. {"adm": -1}. A negative quota is unlimited.
+	Roles map[string]int `json:"roles,omitempty"`
+}
+
+func (q *Quota) rule() *ACLRule {
+	rule := &ACLRule{Method: q.Method, Path: q.Path}
+	if rule.Path == "" {
+		rule.Path = "/**"
+	}
+	return rule
+}
+
+// daily quota of a role
+func (q *Quota) daily(role string) int {
+	if daily, ok := q.Roles[role]; ok {
+		return daily
+	}
+	return q.Daily
+}
+
+// Quota returns the most specific quota for the given method and path, if any
+func (e *ACLEntry) Quota(method, path string) (quota *Quota) {
+	best := -1
+	for _, q := range e.Quotas {
+		if q == nil {
+			continue
+		}
+		if score, ok := q.rule().match(method, path); ok && score > best {
+			best = score
+			quota = q
+		}
+	}
+
+	return quota
+}
+
+// SetRateLimitStore replaces the in-memory rate limit state, eg. by a RedisStore shared by every replica
+func (s *State) SetRateLimitStore(store RateLimitStore) {
+	s.Lock()
+	defer s.Unlock()
+	s.limiter = store
+}
+
+func (s *State) rateLimitStore() RateLimitStore {
+	s.RLock()
+	defer s.RUnlock()
+	return s.limiter
+}
+
+// rateLimitFailOpen decides what happens to requests when the rate limit store is unavailable:
+// they are allowed unless config ratelimit_fail is "closed"
+func (s *State) rateLimitFailOpen(err error) bool {
+	log.Print("rate limit store: ", err)
+	return s.lookupConfig("ratelimit_fail") != "closed"
+}
+
+// rateLimitBuckets lists the buckets that apply to a request on the given route. An unauthenticated
+// user is limited by its IP.
+func (s *State) rateLimitBuckets(r *http.Request, user *User, authenticated bool, route, name string) (buckets []*RateBucket) {
+	limits := s.Snapshot().rateLimits
+	if len(limits) == 0 {
+		return nil
+	}
+
+	if authenticated && user.ID != "" {
+		if limit, ok := limits[RateLimitRolePrefix+getRoleName(user.Permission)]; ok {
+			buckets = append(buckets, limit.bucket(user.ID.Str()))
+		}
+	} else if limit, ok := limits[RateLimitAnonymous]; ok {
+		buckets = append(buckets, limit.bucket(clientIP(r)))
+	}
+
+	prefix := RateLimitServicePrefix
+	if route == streamRouteScript {
+		prefix = RateLimitScriptPrefix
+	}
+	if limit, ok := limits[prefix+name]; ok {
+		buckets = append(buckets, limit.bucket(""))
+	}
+	return buckets
+}
+
+// rateLimit takes a token from every limit that applies to the request, and sets the X-RateLimit-*
+// headers. The response is filled in and false is returned when the request is rejected.
+func (s *State) rateLimit(w http.ResponseWriter, r *http.Request, user *User, authenticated bool, route, name string, response *JSend) bool {
+	buckets := s.rateLimitBuckets(r, user, authenticated, route, name)
+	if len(buckets) == 0 {
+		return true
+	}
+
+	decision, err := s.rateLimitStore().Take(buckets)
+	if err != nil {
+		if s.rateLimitFailOpen(err) {
+			return true
+		}
+		response.Status = JSendError
+		response.Message = errRateLimitStore.Error()
+		response.HTTPCode = http.StatusServiceUnavailable
+		return false
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	if decision.Allowed {
+		return true
+	}
+
+	tooManyRequests(w, response, "Too many requests", decision.RetryAfter)
+	return false
+}
+
+// quota counts the request against the daily quota of the user, if the service has one, and sets
+// the X-Quota-* headers. The response is filled in and false is returned when the quota is used up.
+func (s *State) quota(w http.ResponseWriter, r *http.Request, user *User, authenticated bool, entry *ACLEntry, path string, response *JSend) bool {
+	if entry == nil {
+		return true
+	}
+	q := entry.Quota(r.Method, path)
+	if q == nil {
+		return true
+	}
+
+	subject := clientIP(r)
+	daily := q.Daily
+	if authenticated && user.ID != "" {
+		subject = user.ID.Str()
+		daily = q.daily(getRoleName(user.Permission))
+	}
+	if daily < 0 {
+		return true
+	}
+
+	// the store picks the day, so replicas sharing it agree on when it starts over
+	rule := q.rule()
+	key := "quota|" + entry.Service + "|" + rule.Method + " " + rule.Path + "|" + subject
+
+	count, reset, err := s.rateLimitStore().IncrDaily(key)
+	if err != nil {
+		if s.rateLimitFailOpen(err) {
+			return true
+		}
+		response.Status = JSendError
+		response.Message = errRateLimitStore.Error()
+		response.HTTPCode = http.StatusServiceUnavailable
+		return false
+	}
+
+	remaining := int64(daily) - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(daily))
+	w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+	if count <= int64(daily) {
+		return true
+	}
+
+	tooManyRequests(w, response, "Daily quota exceeded", reset)
+	return false
+}
+
+// tooManyRequests fills the response of a rejected request
+func tooManyRequests(w http.ResponseWriter, response *JSend, msg string, retryAfter time.Duration) {
+	seconds := strconv.Itoa(ceilSeconds(retryAfter))
+	w.Header().Set("Retry-After", seconds)
+	response.Status = JSendFail
+	response.Message = msg + ", retry in " + seconds + " seconds"
+	response.Data = []byte(`{"retry_after":` + seconds + `}`)
+	response.HTTPCode = http.StatusTooManyRequests
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP is the IP of the caller, without port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.TrimSpace(r.RemoteAddr)
+	}
+	return host
+}
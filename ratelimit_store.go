@@ -0,0 +1,153 @@
+package aclsrv
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimitStore holds the state of rate limits and quotas. ACL replicas that share a store
+// also share their limits.
+type RateLimitStore interface {
+	// Take takes a token from every bucket, but only if every bucket has a token left
+	Take(buckets []*RateBucket) (*RateDecision, error)
+
+	// IncrDaily increments the counter of key for the current day in UTC, by the clock of the store,
+	// and returns its new value and the time left until the next day starts over.
+	IncrDaily(key string) (count int64, reset time.Duration, err error)
+}
+
+// quotaDay is the day in UTC of a daily counter, and when it ends
+func quotaDay(now time.Time) (day string, end time.Time) {
+	now = now.UTC()
+	return now.Format("2006-01-02"), time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// RateBucket is a token bucket of a single user, IP, service or script
+type RateBucket struct {
+	Key      string
+	Interval time.Duration // between two tokens
+	Burst    int
+}
+
+// RateDecision is the outcome of taking a token from every bucket that applies to a request
+type RateDecision struct {
+	Allowed    bool
+	Limit      int           // burst of the most restrictive bucket
+	Remaining  int           // tokens left in the most restrictive bucket
+	Reset      time.Duration // until the most restrictive bucket is full again
+	RetryAfter time.Duration // until a rejected request may be retried
+}
+
+// takeGCRA takes a token from every bucket using the generic cell rate algorithm. The state of a
+// bucket is its theoretical arrival time (TAT), which is zero for a new bucket. The TATs to store
+// are returned; they are only changed when every bucket allows the request.
+func takeGCRA(now time.Time, buckets []*RateBucket, tats []time.Time) ([]time.Time, *RateDecision) {
+	decision := &RateDecision{Allowed: true, Remaining: -1}
+	next := make([]time.Time, len(buckets))
+	for i, b := range buckets {
+		tat := tats[i]
+		if tat.Before(now) {
+			tat = now
+		}
+		next[i] = tat.Add(b.Interval)
+		allowAt := next[i].Add(-b.Interval * time.Duration(b.Burst))
+
+		remaining, reset := 0, tat.Sub(now)
+		if now.Before(allowAt) {
+			decision.Allowed = false
+			if retryAfter := allowAt.Sub(now); retryAfter > decision.RetryAfter {
+				decision.RetryAfter = retryAfter
+			}
+		} else {
+			remaining, reset = int(now.Sub(allowAt)/b.Interval), next[i].Sub(now)
+		}
+
+		if decision.Remaining < 0 || remaining < decision.Remaining {
+			decision.Limit = b.Burst
+			decision.Remaining = remaining
+			decision.Reset = reset
+		}
+	}
+
+	if !decision.Allowed {
+		copy(next, tats)
+	}
+	return next, decision
+}
+
+// memoryStore keeps the rate limit state in memory, which is only shared within a single replica
+type memoryStore struct {
+	sync.Mutex
+	tats      map[string]time.Time
+	counters  map[string]*memoryCounter
+	lastSweep time.Time
+}
+
+type memoryCounter struct {
+	value   int64
+	expires time.Time
+}
+
+const memoryStoreSweep = time.Minute // min time between removing expired state
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tats:     map[string]time.Time{},
+		counters: map[string]*memoryCounter{},
+	}
+}
+
+func (m *memoryStore) Take(buckets []*RateBucket) (*RateDecision, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	tats := make([]time.Time, len(buckets))
+	for i, b := range buckets {
+		tats[i] = m.tats[b.Key]
+	}
+	tats, decision := takeGCRA(now, buckets, tats)
+	for i, b := range buckets {
+		m.tats[b.Key] = tats[i]
+	}
+	return decision, nil
+}
+
+func (m *memoryStore) IncrDaily(key string) (int64, time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	day, end := quotaDay(now)
+	key += "|" + day
+	c, ok := m.counters[key]
+	if !ok || now.After(c.expires) {
+		c = &memoryCounter{expires: end}
+		m.counters[key] = c
+	}
+	c.value++
+	return c.value, end.Sub(now), nil
+}
+
+// sweep removes full buckets, as they are no different from new buckets, and expired counters
+func (m *memoryStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < memoryStoreSweep {
+		return
+	}
+	m.lastSweep = now
+
+	for key, tat := range m.tats {
+		if now.After(tat) {
+			delete(m.tats, key)
+		}
+	}
+	for key, c := range m.counters {
+		if now.After(c.expires) {
+			delete(m.counters, key)
+		}
+	}
+}
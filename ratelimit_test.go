@@ -0,0 +1,82 @@
+package aclsrv
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	user := &RateLimit{Key: RateLimitRolePrefix + "usr", Requests: 2, Per: Duration(time.Second)}
+	service := &RateLimit{Key: RateLimitServicePrefix + "users", Requests: 3, Per: Duration(time.Second)}
+	store := newMemoryStore()
+
+	alice := []*RateBucket{user.bucket("alice"), service.bucket("")}
+	bob := []*RateBucket{user.bucket("bob"), service.bucket("")}
+
+	for i := 0; i < 2; i++ {
+		if decision, _ := store.Take(alice); !decision.Allowed {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	decision, _ := store.Take(alice)
+	if decision.Allowed || decision.RetryAfter <= 0 || decision.RetryAfter > 500*time.Millisecond {
+		t.Fatalf("expected rejection with a retry after. Got %+v", decision)
+	}
+
+	// the rejected request did not use a service token
+	if decision, _ = store.Take(bob); !decision.Allowed || decision.Remaining != 0 {
+		t.Errorf("expected the last service token to be taken. Got %+v", decision)
+	}
+	if decision, _ = store.Take(bob); decision.Allowed {
+		t.Error("expected the service limit to reject the request")
+	}
+}
+
+func TestAPIHandlerRateLimit(t *testing.T) {
+	idp := newTestIssuer(t)
+	backend := newJSONBackend(t)
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backendAddress(backend)}},
+		}
+		snap.RateLimits = []*RateLimit{
+			{Key: RateLimitAnonymous, Requests: 2, Per: Duration(time.Minute)},
+			{Key: RateLimitRolePrefix + "dev", Requests: 5, Per: Duration(time.Minute)},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	for i := 0; i < 2; i++ {
+		if _, response := getJSend(t, http.MethodGet, gateway.URL+"/api/users/list", ""); response.Status != JSendSuccess {
+			t.Fatalf("request %d should be allowed. Got %+v", i, response)
+		}
+	}
+	resp, response := getJSend(t, http.MethodGet, gateway.URL+"/api/users/list", "")
+	if resp.StatusCode != http.StatusTooManyRequests || response.Status != JSendFail {
+		t.Errorf("expected anonymous caller to be rate limited. Got %s %+v", resp.Status, response)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Errorf("incorrect Retry-After. Got %q", got)
+	}
+	if resp.Header.Get("X-RateLimit-Limit") != "2" || resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("incorrect rate limit headers: %v", resp.Header)
+	}
+
+	// authenticated users have a bucket of their own
+	req, _ := http.NewRequest(http.MethodGet, gateway.URL+"/api/users/list", nil)
+	req.Header = authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{}))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-RateLimit-Remaining") != "4" {
+		t.Errorf("expected developer limit. Got %s %v", resp.Status, resp.Header)
+	}
+}
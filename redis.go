@@ -0,0 +1,308 @@
+package aclsrv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisKeyPrefix   = "srv-acl:"
+	redisPoolSize    = 16
+	redisTimeout     = 2 * time.Second
+	redisMaxAttempts = 10 // optimistic transactions before giving up on contention
+)
+
+var errRedisContention = errors.New("redis: too many concurrent updates")
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisStore keeps the rate limit state in Redis, or any server speaking the Redis protocol,
+// such that it is shared by every ACL replica. Buckets are updated in optimistic transactions
+// (WATCH/MULTI/EXEC) by the clock of the server, and expire once they are full again.
+type RedisStore struct {
+	address  string
+	password string
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+func NewRedisStore(address, password string) *RedisStore {
+	return &RedisStore{
+		address:  address,
+		password: password,
+		timeout:  redisTimeout,
+		pool:     make(chan *redisConn, redisPoolSize),
+	}
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// conn takes an idle connection from the pool, or dials a new one
+func (s *RedisStore) conn() (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, reader: bufio.NewReader(conn)}
+	if s.password != "" {
+		if _, err = s.do(c, "AUTH", s.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// release puts the connection back in the pool. Connections are closed after any error, as they
+// could be left with watched keys or in the middle of a transaction.
+func (s *RedisStore) release(c *redisConn, err error) {
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	select {
+	case s.pool <- c:
+	default:
+		c.Close()
+	}
+}
+
+// do sends a command and reads its reply. Error replies are returned as redisError.
+func (s *RedisStore) do(c *redisConn, args ...string) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return nil, err
+	}
+
+	var cmd strings.Builder
+	cmd.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		cmd.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := io.WriteString(c, cmd.String()); err != nil {
+		return nil, err
+	}
+
+	return readRESP(c.reader)
+}
+
+// readRESP reads a single reply: a string, an int64, a []byte, an []interface{} of replies, or nil
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, size)
+		for i := range replies {
+			// error replies within an array, such as from EXEC, are kept as values
+			replies[i], err = readRESP(r)
+			if redisErr, ok := err.(redisError); ok {
+				replies[i] = redisErr
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+func (s *RedisStore) Take(buckets []*RateBucket) (decision *RateDecision, err error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		s.release(c, err)
+	}()
+
+	keys := make([]string, len(buckets))
+	for i, b := range buckets {
+		keys[i] = redisKeyPrefix + "rl:" + b.Key
+	}
+
+	var reply interface{}
+	for attempt := 0; attempt < redisMaxAttempts; attempt++ {
+		if _, err = s.do(c, append([]string{"WATCH"}, keys...)...); err != nil {
+			return nil, err
+		}
+		reply, err = s.do(c, append([]string{"MGET"}, keys...)...)
+		if err != nil {
+			return nil, err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != len(keys) {
+			return nil, errors.New("redis: unexpected MGET reply")
+		}
+
+		tats := make([]time.Time, len(keys))
+		for i, value := range values {
+			if data, ok := value.([]byte); ok {
+				var nanos int64
+				if nanos, err = strconv.ParseInt(string(data), 10, 64); err != nil {
+					return nil, err
+				}
+				tats[i] = time.Unix(0, nanos)
+			}
+		}
+
+		// the clock of the server is shared by every replica, unlike their own
+		var now time.Time
+		if now, err = s.time(c); err != nil {
+			return nil, err
+		}
+		var next []time.Time
+		next, decision = takeGCRA(now, buckets, tats)
+		if !decision.Allowed {
+			_, err = s.do(c, "UNWATCH")
+			return decision, err
+		}
+
+		if _, err = s.do(c, "MULTI"); err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			ttl := next[i].Sub(now)/time.Millisecond + 1
+			_, err = s.do(c, "SET", key, strconv.FormatInt(next[i].UnixNano(), 10), "PX", strconv.FormatInt(int64(ttl), 10))
+			if err != nil {
+				_, _ = s.do(c, "DISCARD")
+				return nil, err
+			}
+		}
+		reply, err = s.do(c, "EXEC")
+		if err != nil {
+			return nil, err
+		}
+		if reply != nil {
+			return decision, nil
+		}
+		// a watched key was changed by another replica, try again after a short random backoff
+		time.Sleep(time.Duration(rand.Int63n(int64(attempt+1) * int64(time.Millisecond))))
+	}
+
+	return nil, errRedisContention
+}
+
+// time returns the current time of the server
+func (s *RedisStore) time(c *redisConn) (time.Time, error) {
+	reply, err := s.do(c, "TIME")
+	if err != nil {
+		return time.Time{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return time.Time{}, errors.New("redis: unexpected TIME reply")
+	}
+	var parts [2]int64
+	for i, value := range values {
+		data, _ := value.([]byte)
+		if parts[i], err = strconv.ParseInt(string(data), 10, 64); err != nil {
+			return time.Time{}, errors.New("redis: unexpected TIME reply")
+		}
+	}
+	return time.Unix(parts[0], parts[1]*int64(time.Microsecond)), nil
+}
+
+func (s *RedisStore) IncrDaily(key string) (count int64, reset time.Duration, err error) {
+	c, err := s.conn()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		s.release(c, err)
+	}()
+
+	// every replica starts the next day at the same moment, see Take
+	var now time.Time
+	if now, err = s.time(c); err != nil {
+		return 0, 0, err
+	}
+	day, end := quotaDay(now)
+
+	key = redisKeyPrefix + key + "|" + day
+	if _, err = s.do(c, "MULTI"); err != nil {
+		return 0, 0, err
+	}
+	if _, err = s.do(c, "INCR", key); err != nil {
+		_, _ = s.do(c, "DISCARD")
+		return 0, 0, err
+	}
+	expiresAt := strconv.FormatInt(end.UnixNano()/int64(time.Millisecond), 10)
+	if _, err = s.do(c, "PEXPIREAT", key, expiresAt); err != nil {
+		_, _ = s.do(c, "DISCARD")
+		return 0, 0, err
+	}
+
+	var reply interface{}
+	if reply, err = s.do(c, "EXEC"); err != nil {
+		return 0, 0, err
+	}
+	replies, ok := reply.([]interface{})
+	if !ok || len(replies) != 2 {
+		return 0, 0, errors.New("redis: unexpected EXEC reply")
+	}
+	if count, ok = replies[0].(int64); !ok {
+		return 0, 0, errors.New("redis: unexpected INCR reply")
+	}
+	return count, end.Sub(now), nil
+}
+
+// Close closes every idle connection
+func (s *RedisStore) Close() {
+	for {
+		select {
+		case c := <-s.pool:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package aclsrv
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// fakeRedis speaks enough of the Redis protocol for RedisStore
+type fakeRedis struct {
+	net.Listener
+
+	mu       sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	versions map[string]int // bumped on every write, for WATCH
+	skew     time.Duration  // of the server clock
+}
+
+type fakeRedisConn struct {
+	watched map[string]int
+	queue   [][]string // commands queued by MULTI
+	multi   bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis := &fakeRedis{
+		Listener: listener,
+		values:   map[string]string{},
+		expires:  map[string]time.Time{},
+		versions: map[string]int{},
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go redis.serve(conn)
+		}
+	}()
+	return redis
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	state := &fakeRedisConn{}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = reader.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			data := make([]byte, size+2)
+			if _, err = io.ReadFull(reader, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+
+		if _, err = io.WriteString(conn, f.handle(state, args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) handle(conn *fakeRedisConn, args []string) string {
+	cmd := strings.ToUpper(args[0])
+	if conn.multi && cmd != "EXEC" && cmd != "DISCARD" {
+		conn.queue = append(conn.queue, args)
+		return "+QUEUED\r\n"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd {
+	case "WATCH":
+		if conn.watched == nil {
+			conn.watched = map[string]int{}
+		}
+		for _, key := range args[1:] {
+			conn.watched[key] = f.versions[key]
+		}
+		return "+OK\r\n"
+	case "UNWATCH":
+		conn.watched = nil
+		return "+OK\r\n"
+	case "MULTI":
+		conn.multi = true
+		return "+OK\r\n"
+	case "DISCARD":
+		conn.multi, conn.queue, conn.watched = false, nil, nil
+		return "+OK\r\n"
+	case "EXEC":
+		queue, watched := conn.queue, conn.watched
+		conn.multi, conn.queue, conn.watched = false, nil, nil
+		for key, version := range watched {
+			if f.versions[key] != version {
+				return "*-1\r\n"
+			}
+		}
+		reply := "*" + strconv.Itoa(len(queue)) + "\r\n"
+		for _, args := range queue {
+			reply += f.exec(args)
+		}
+		return reply
+	}
+	return f.exec(args)
+}
+
+// exec runs a data command. Must be called while holding f.mu
+func (f *fakeRedis) exec(args []string) string {
+	now := time.Now().Add(f.skew)
+	get := func(key string) (string, bool) {
+		if expires, ok := f.expires[key]; ok && now.After(expires) {
+			delete(f.values, key)
+			delete(f.expires, key)
+		}
+		value, ok := f.values[key]
+		return value, ok
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "TIME":
+		seconds := strconv.FormatInt(now.Unix(), 10)
+		micros := strconv.Itoa(now.Nanosecond() / int(time.Microsecond))
+		return "*2\r\n$" + strconv.Itoa(len(seconds)) + "\r\n" + seconds + "\r\n$" + strconv.Itoa(len(micros)) + "\r\n" + micros + "\r\n"
+	case "AUTH":
+		if args[1] != "secret" {
+			return "-ERR invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)-1) + "\r\n"
+		for _, key := range args[1:] {
+			if value, ok := get(key); ok {
+				reply += "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "SET":
+		f.values[args[1]] = args[2]
+		f.versions[args[1]]++
+		delete(f.expires, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.ParseInt(args[4], 10, 64)
+			f.expires[args[1]] = now.Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "INCR":
+		value, _ := get(args[1])
+		n, _ := strconv.ParseInt(value, 10, 64)
+		n++
+		f.values[args[1]] = strconv.FormatInt(n, 10)
+		f.versions[args[1]]++
+		return ":" + strconv.FormatInt(n, 10) + "\r\n"
+	case "PEXPIREAT":
+		ms, _ := strconv.ParseInt(args[2], 10, 64)
+		f.expires[args[1]] = time.Unix(0, ms*int64(time.Millisecond))
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisStoreTake(t *testing.T) {
+	redis := newFakeRedis(t)
+
+	// two replicas sharing the same limits
+	replicas := []*RedisStore{
+		NewRedisStore(redis.Addr().String(), "secret"),
+		NewRedisStore(redis.Addr().String(), "secret"),
+	}
+	bucket := &RateBucket{Key: "role:usr|alice", Interval: time.Hour, Burst: 10}
+
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(store *RedisStore) {
+			defer wg.Done()
+			decision, err := store.Take([]*RateBucket{bucket})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if decision.Allowed {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}(replicas[i%2])
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Errorf("expected the burst to hold across replicas. Got %d allowed requests", allowed)
+	}
+
+	if _, err := NewRedisStore(redis.Addr().String(), "wrong").Take([]*RateBucket{bucket}); err == nil {
+		t.Error("expected authentication to fail")
+	}
+}
+
+func TestRedisStoreTakeServerClock(t *testing.T) {
+	redis := newFakeRedis(t)
+	store := NewRedisStore(redis.Addr().String(), "")
+	bucket := &RateBucket{Key: "ip|10.0.0.1", Interval: time.Hour, Burst: 1}
+
+	for i, allowed := range []bool{true, false} {
+		if decision, err := store.Take([]*RateBucket{bucket}); err != nil || decision.Allowed != allowed {
+			t.Fatalf("request %d: expected allowed=%v. Got %+v, %v", i, allowed, decision, err)
+		}
+	}
+
+	// only the clock of the server moved on
+	redis.mu.Lock()
+	redis.skew = time.Hour
+	redis.mu.Unlock()
+	if decision, err := store.Take([]*RateBucket{bucket}); err != nil || !decision.Allowed {
+		t.Errorf("expected the bucket to be refilled by the server clock. Got %+v, %v", decision, err)
+	}
+}
+
+func TestRedisStoreIncrDaily(t *testing.T) {
+	redis := newFakeRedis(t)
+	store := NewRedisStore(redis.Addr().String(), "")
+
+	for i := int64(1); i <= 3; i++ {
+		count, reset, err := store.IncrDaily("quota|x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != i || reset <= 0 || reset > 24*time.Hour {
+			t.Errorf("incorrect count. Got %d %s, wants %d", count, reset, i)
+		}
+	}
+
+	// the next day starts by the clock of the server, not the one of the replica
+	redis.mu.Lock()
+	redis.skew = 24 * time.Hour
+	redis.mu.Unlock()
+	if count, _, _ := store.IncrDaily("quota|x"); count != 1 {
+		t.Errorf("expected the counter to start over the next day of the server. Got %d", count)
+	}
+}
+
+func TestRateLimitStoreUnavailable(t *testing.T) {
+	unavailable := newFakeRedis(t)
+	unavailable.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backendAddress(newJSONBackend(t))}},
+		}
+		snap.RateLimits = []*RateLimit{{Key: RateLimitAnonymous, Requests: 1}}
+	})
+	state.SetRateLimitStore(NewRedisStore(unavailable.Addr().String(), ""))
+	gateway := newTestGateway(t, state)
+
+	if _, response := getJSend(t, http.MethodGet, gateway.URL+"/api/users/list", ""); response.Status != JSendSuccess {
+		t.Errorf("expected to fail open. Got %+v", response)
+	}
+
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Config = []ACLConfigEntry{{Key: "ratelimit_fail", Val: "closed"}}
+	})
+	resp, response := getJSend(t, http.MethodGet, gateway.URL+"/api/users/list", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || response.Status == JSendSuccess {
+		t.Errorf("expected to fail closed. Got %s %+v", resp.Status, response)
+	}
+}
+
+func TestAPIHandlerQuota(t *testing.T) {
+	idp := newTestIssuer(t)
+	redis := newFakeRedis(t)
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Services = []*Service{
+			{Name: "jolie-deployer", Addresses: []string{backendAddress(newJSONBackend(t))}},
+		}
+		snap.ACL = []*ACLEntry{
+			{
+				Service: "jolie-deployer",
+				Quotas: []*Quota{
+					{Method: http.MethodPost, Path: "/deploy", Daily: 2, Roles: map[string]int{"adm": -1}},
+				},
+			},
+		}
+	})
+	state.SetRateLimitStore(NewRedisStore(redis.Addr().String(), ""))
+	gateway := newTestGateway(t, state)
+
+	send := func(method, path string, claims jwt.MapClaims) *http.Response {
+		req, _ := http.NewRequest(method, gateway.URL+"/api/jolie-deployer"+path, strings.NewReader(`{}`))
+		req.Header = authHeader(idp.sign(t, AlgRS256, claims))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := send(http.MethodPost, "/deploy", nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("deploy %d should be allowed. Got %s", i, resp.Status)
+		}
+	}
+	resp := send(http.MethodPost, "/deploy", nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("X-Quota-Remaining") != "0" {
+		t.Errorf("expected quota to be used up. Got %s %v", resp.Status, resp.Header)
+	}
+	if seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After")); seconds <= 0 || seconds > 24*60*60 {
+		t.Errorf("expected retry at midnight. Got %q", resp.Header.Get("Retry-After"))
+	}
+
+	// other endpoints and users are not affected
+	if resp = send(http.MethodGet, "/list", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected list to be allowed. Got %s", resp.Status)
+	}
+	if resp = send(http.MethodPost, "/deploy", jwt.MapClaims{"cognito:username": "other"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected other user to have their own quota. Got %s", resp.Status)
+	}
+	admin := jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}
+	for i := 0; i < 3; i++ {
+		if resp = send(http.MethodPost, "/deploy", admin); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected admins to be unlimited. Got %s", resp.Status)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package aclsrv
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// users tracked per service, further users are only counted in the service total
+const wouldDenyMaxUsers = 1000
+
+// WouldDenyUser sums up the requests of a user that an ACL entry in report-only mode would deny
+type WouldDenyUser struct {
+	UserID     UserID     `json:"uid"` // empty for requests without a valid JWT
+	Permission Permission `json:"permission"`
+	Count      uint64     `json:"count"`
+	First      time.Time  `json:"first"`
+	Last       time.Time  `json:"last"`
+
+	// the last request that would have been denied
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// WouldDenyService sums up the would-deny events of a service, busiest users first
+type WouldDenyService struct {
+	Service string           `json:"service"`
+	Count   uint64           `json:"count"`
+	Users   []*WouldDenyUser `json:"users"`
+}
+
+type wouldDenyService struct {
+	count uint64
+	users map[UserID]*WouldDenyUser
+}
+
+// wouldDenyReport counts the requests that were proxied while an ACL entry in report-only mode
+// would deny them, such that it is known who gets locked out before switching to enforce
+type wouldDenyReport struct {
+	mu       sync.Mutex
+	services map[string]*wouldDenyService
+}
+
+func newWouldDenyReport() *wouldDenyReport {
+	return &wouldDenyReport{services: map[string]*wouldDenyService{}}
+}
+
+func (w *wouldDenyReport) add(service string, user *User, method, path string, access *AccessDecision) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	srv, ok := w.services[service]
+	if !ok {
+		srv = &wouldDenyService{users: map[UserID]*WouldDenyUser{}}
+		w.services[service] = srv
+	}
+	srv.count++
+
+	now := time.Now()
+	u, ok := srv.users[user.ID]
+	if !ok {
+		if len(srv.users) >= wouldDenyMaxUsers {
+			return
+		}
+		u = &WouldDenyUser{UserID: user.ID, First: now}
+		srv.users[user.ID] = u
+	}
+	u.Count++
+	u.Last = now
+	u.Permission = user.Permission
+	u.Method = method
+	u.Path = path
+	u.Rule = access.Rule
+	u.Reason = access.Reason
+}
+
+// summary of every service, or only the given one
+func (w *wouldDenyReport) summary(service string) []*WouldDenyService {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	summary := []*WouldDenyService{}
+	for name, srv := range w.services {
+		if service != "" && name != service {
+			continue
+		}
+		s := &WouldDenyService{Service: name, Count: srv.count}
+		for _, u := range srv.users {
+			c := *u
+			s.Users = append(s.Users, &c)
+		}
+		sort.Slice(s.Users, func(i, j int) bool {
+			if s.Users[i].Count != s.Users[j].Count {
+				return s.Users[i].Count > s.Users[j].Count
+			}
+			return s.Users[i].UserID < s.Users[j].UserID
+		})
+		summary = append(summary, s)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		return summary[i].Service < summary[j].Service
+	})
+	return summary
+}
+
+// reset forgets the events of every service, or only the given one
+func (w *wouldDenyReport) reset(service string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if service == "" {
+		w.services = map[string]*wouldDenyService{}
+		return
+	}
+	delete(w.services, service)
+}
+
+func setupWouldDenyRoutes(router *httprouter.Router, ACLState *State) {
+	// would-deny events since start, optionally of a single service: ?service=<service>
+	router.GET("/admin/would-deny", ACLState.adminHandle(PFlagManageSrvAll, func(r *http.Request, ps httprouter.Params, response *JSend) {
+		adminData(response, ACLState.wouldDeny.summary(r.URL.Query().Get("service")))
+	}))
+
+	// start over, eg. after changing the rules
+	router.DELETE("/admin/would-deny", ACLState.adminHandle(PFlagManageSrvAll, func(r *http.Request, ps httprouter.Params, response *JSend) {
+		ACLState.wouldDeny.reset(r.URL.Query().Get("service"))
+		response.Status = JSendSuccess
+	}))
+}
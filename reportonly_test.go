@@ -0,0 +1,81 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestACLModes(t *testing.T) {
+	idp := newTestIssuer(t)
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Services = []*Service{
+			{Name: "users", Addresses: []string{backendAddress(newJSONBackend(t))}},
+		}
+	})
+	mode := func(mode string) {
+		setSnapshot(t, state, func(snap *Snapshot) {
+			snap.ACL = []*ACLEntry{{Service: "users", Mode: mode, MinimumPermission: PFlagUsersAll}}
+		})
+	}
+	mode(ACLModeReportOnly)
+	gateway := newTestGateway(t, state)
+
+	developer := authHeader(idp.sign(t, AlgRS256, nil))
+	admin := authHeader(idp.sign(t, AlgRS256, jwt.MapClaims{"cognito:groups": []string{"p:" + PermissionLvlAdm.Str()}}))
+	send := func(method, path string, header http.Header) *JSend {
+		t.Helper()
+		req, _ := http.NewRequest(method, gateway.URL+path, nil)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		response := &JSend{}
+		if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// report-only: still proxied, but counted
+	for i := 0; i < 2; i++ {
+		if response := send(http.MethodGet, "/api/users/list", developer); response.Status != JSendSuccess {
+			t.Fatalf("expected request to be proxied. Got %+v", response)
+		}
+	}
+	var summary []*WouldDenyService
+	if err := json.Unmarshal(send(http.MethodGet, "/admin/would-deny", admin).Data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary) != 1 || summary[0].Service != "users" || summary[0].Count != 2 || len(summary[0].Users) != 1 {
+		t.Fatalf("expected would-deny events of a single user. Got %+v", summary)
+	}
+	if u := summary[0].Users[0]; u.UserID != "andersfylling" || u.Count != 2 || u.Path != "/list" || u.Rule != "min_permission" {
+		t.Errorf("incorrect would-deny summary. Got %+v", u)
+	}
+	if response := send(http.MethodGet, "/admin/would-deny", developer); response.Status == JSendSuccess {
+		t.Error("expected developers not to see the summary")
+	}
+
+	send(http.MethodDelete, "/admin/would-deny?service=users", admin)
+	summary = nil
+	if err := json.Unmarshal(send(http.MethodGet, "/admin/would-deny", admin).Data, &summary); err != nil || len(summary) != 0 {
+		t.Errorf("expected summary to be reset. Got %+v %v", summary, err)
+	}
+
+	mode(ACLModeEnforce)
+	if response := send(http.MethodGet, "/api/users/list", developer); response.Message != "You do not have access to this service" {
+		t.Errorf("expected request to be denied. Got %+v", response)
+	}
+
+	mode(ACLModeDisabled)
+	if response := send(http.MethodGet, "/api/users/list", developer); response.Status != JSendSuccess {
+		t.Errorf("expected ACL entry to be ignored. Got %+v", response)
+	}
+}
@@ -17,52 +17,61 @@ type UserLevel struct {
 }
 
 type ACLInfo struct {
+	Version    string       `json:"version,omitempty"` // of the snapshot in use, see /admin/history
+	Pinned     bool         `json:"pinned,omitempty"`
 	UserLevels []*UserLevel `json:"user_levels,omitempty"`
 	ACLConfig  []*ACLEntry  `json:"acl_endpoints,omitempty"`
 }
 
-func setupResponse(w *http.ResponseWriter, req *http.Request) {
+func (s *State) setupResponse(w *http.ResponseWriter, req *http.Request) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, PATCH, OPTIONS, PUT, DELETE")
 	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, jwt, JWT, X-Jolie-MessageID, X-Jolie-ServicePath")
+	(*w).Header().Set("Access-Control-Expose-Headers", HeaderACLVersion)
+	if version := s.Snapshot().version; version != "" {
+		(*w).Header().Set(HeaderACLVersion, version)
+	}
 }
 
 func SetupRoutes(router *httprouter.Router, ACLState *State) {
 	router.GET("/configuration", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		setupResponse(&w, r)
+		ACLState.setupResponse(&w, r)
 
 		response := &JSend{
 			HTTPCode: http.StatusOK,
 		}
 		defer func(response *JSend) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(response.HTTPCode)
 			response.write(w)
 		}(response)
 
+		// only user managers may see who is explicitly allowed or blocked
+		user, err := ACLState.authenticate(r.Header)
+		showUsers := err == nil && user.Permission&PFlagUsersAll == PFlagUsersAll
+
+		snap := ACLState.Snapshot()
 		list := &ACLInfo{
-			UserLevels: ACLState.PermissionDefaults,
-			ACLConfig:  ACLState.ACL,
+			Version:    snap.version,
+			Pinned:     ACLState.pinned() != "",
+			UserLevels: snap.PermissionDefaults,
 		}
-
-		// add services without ACL entry
-		ACLState.RLock()
-		for i := range ACLState.Services {
-			exists := false
-			for j := range list.ACLConfig {
-				exists = ACLState.Services[i].Name == list.ACLConfig[j].Service
-				if exists {
-					break
-				}
+		for _, entry := range snap.ACL {
+			if !showUsers {
+				e := *entry
+				e.AllowedUserIDs = nil
+				e.BlockedUserIDs = nil
+				entry = &e
 			}
+			list.ACLConfig = append(list.ACLConfig, entry)
+		}
 
-			if !exists {
+		// add services without ACL entry
+		for _, srv := range snap.Services {
+			if _, exists := snap.acl[srv.Name]; !exists {
 				list.ACLConfig = append(list.ACLConfig, &ACLEntry{
-					Service: ACLState.Services[i].Name,
+					Service: srv.Name,
 				})
 			}
 		}
-		ACLState.RUnlock()
 
 		data, err := json.Marshal(list)
 		if err != nil {
@@ -78,6 +87,12 @@ func SetupRoutes(router *httprouter.Router, ACLState *State) {
 
 	router.POST("/consul/services/change", ACLState.WatchAliveServicesHandler)
 
+	setupAdminRoutes(router, ACLState)
+
+	router.GET("/explain", ACLState.ExplainHandler)
+
+	router.HandlerFunc(http.MethodGet, "/metrics", ACLState.MetricsHandler)
+
 	// setup
 	accepts := []string{
 		http.MethodGet,
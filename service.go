@@ -1,33 +1,159 @@
 package aclsrv
 
 import (
+	"encoding/json"
 	"errors"
 	"strings"
-	"sync"
+	"time"
 )
 
-// Service holds detail needed + round robin to load balance requests
+// proxy modes of a service
+const (
+	// ProxyModeJSend buffers the response and wraps it in the data field of a JSend response
+	ProxyModeJSend = "jsend"
+
+	// ProxyModeStream streams the request and response through as is, without a JSend envelope.
+	// Used for non-json or large responses, such as file downloads.
+	ProxyModeStream = "stream"
+)
+
+// Service holds detail needed to load balance requests, see State.pick
 // assumption: a Service object never exists if there are no addresses for it
 type Service struct {
-	sync.RWMutex
 	Name      string   `json:"name"`
 	Addresses []string `json:"addresses"`
-	rri       int      // round robin index
+	Proxy     string   `json:"proxy,omitempty"` // ProxyModeJSend when empty
+	Upstream  Upstream `json:"upstream"`
 }
 
-func (s *Service) Empty() bool {
-	return len(s.Addresses) == 0 || s.Name == ""
+// Upstream holds the connection settings of a service or user script. Configured as json
+// in the Consul KV storage: srv-acl_ACLEntry-upstream_<service>
+type Upstream struct {
+	// IdleTimeout closes WebSocket and Server-Sent Events connections without any traffic
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+
+	// MaxLifetime closes WebSocket and Server-Sent Events connections after the duration
+	MaxLifetime Duration `json:"max_lifetime,omitempty"`
+
+	// ConnectTimeout limits the time to establish a connection to an address
+	ConnectTimeout Duration `json:"connect_timeout,omitempty"`
+
+	// ResponseTimeout limits the time from sending the request until the response headers arrive
+	ResponseTimeout Duration `json:"response_timeout,omitempty"`
+
+	// Timeout limits the total time of a buffered request, retries included. Streamed responses
+	// are only limited by the connect and response timeouts.
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// Retries is the number of times an idempotent request is retried on another address
+	Retries int `json:"retries,omitempty"`
+
+	// Breaker fails requests fast while the service keeps failing
+	Breaker Breaker `json:"breaker"`
+
+	// Balancer is the load balancing strategy: BalancerRoundRobin (default), BalancerLeastOutstanding
+	// or BalancerPowerOfTwo
+	Balancer string `json:"balancer,omitempty"`
 }
 
-// GetAddress returns a <ip:port> string which is accessible within the cluster
-func (s *Service) GetAddress() (adr string) {
-	s.Lock()
-	defer s.Unlock()
+// defaults when not configured
+const (
+	defaultIdleTimeout     = 10 * time.Minute
+	defaultMaxLifetime     = 24 * time.Hour
+	defaultConnectTimeout  = 5 * time.Second
+	defaultResponseTimeout = time.Minute
+	defaultTimeout         = 2 * time.Minute
+)
 
-	adr = s.Addresses[s.rri]
-	s.rri = (s.rri + 1) % len(s.Addresses)
+func (u *Upstream) idleTimeout() time.Duration {
+	if u.IdleTimeout > 0 {
+		return time.Duration(u.IdleTimeout)
+	}
+	return defaultIdleTimeout
+}
 
-	return
+func (u *Upstream) maxLifetime() time.Duration {
+	if u.MaxLifetime > 0 {
+		return time.Duration(u.MaxLifetime)
+	}
+	return defaultMaxLifetime
+}
+
+func (u *Upstream) connectTimeout() time.Duration {
+	if u.ConnectTimeout > 0 {
+		return time.Duration(u.ConnectTimeout)
+	}
+	return defaultConnectTimeout
+}
+
+func (u *Upstream) responseTimeout() time.Duration {
+	if u.ResponseTimeout > 0 {
+		return time.Duration(u.ResponseTimeout)
+	}
+	return defaultResponseTimeout
+}
+
+func (u *Upstream) timeout() time.Duration {
+	if u.Timeout > 0 {
+		return time.Duration(u.Timeout)
+	}
+	return defaultTimeout
+}
+
+func (u *Upstream) balancer() string {
+	switch u.Balancer {
+	case BalancerLeastOutstanding, BalancerPowerOfTwo:
+		return u.Balancer
+	}
+	return BalancerRoundRobin
+}
+
+func (u *Upstream) validate() error {
+	if u.Retries < 0 {
+		// no attempt would be made at all
+		return errors.New("retries must not be negative")
+	}
+	return nil
+}
+
+// Duration is a time.Duration that is encoded as a string in json, eg. "1m30s".
+// Numbers are decoded as seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (s *Service) Empty() bool {
+	return len(s.Addresses) == 0 || s.Name == ""
+}
+
+func (s *Service) hasAddress(adr string) bool {
+	for i := range s.Addresses {
+		if s.Addresses[i] == adr {
+			return true
+		}
+	}
+	return false
 }
 
 // getServiceName extract the service name from the uri path, after the /api prefix
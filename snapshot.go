@@ -0,0 +1,464 @@
+package aclsrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sources of a snapshot, see the source label of acl_discovery_updates_total
+const (
+	SnapshotSourceConsul = "consul"
+	SnapshotSourcePush   = "push" // POST /consul/services/change
+)
+
+// results of a snapshot, see the result label of acl_discovery_updates_total
+const (
+	SnapshotApplied  = "applied"
+	SnapshotRejected = "rejected"
+	SnapshotHeld     = "held" // valid, but kept back while a version is pinned
+)
+
+// Snapshot is everything discovery provides: services, user scripts and the ACL configuration.
+// A snapshot is built and validated as a whole before it replaces the current one, and is never
+// modified afterwards.
+type Snapshot struct {
+	// a service might exist here, while not in the ACL.
+	// That simply means the service has no ACL configuration and that everyone has access
+	Services           []*Service       `json:"services"`
+	ACL                []*ACLEntry      `json:"ACLEntries"`
+	UserScripts        []*Service       `json:"user_scripts"`
+	PermissionDefaults []*UserLevel     `json:"ACLRolesPermission"`
+	Config             []ACLConfigEntry `json:"config"`
+	Issuers            []*Issuer        `json:"issuers"` // DefaultIssuer is used when empty
+	RateLimits         []*RateLimit     `json:"rate_limits"`
+	Lockdowns          []*Lockdown      `json:"lockdowns"`
+
+	// lookups by name, built by index when the snapshot is applied
+	services   map[string]*Service
+	scripts    map[string]*Service
+	acl        map[string]*ACLEntry
+	config     map[string]string // formatted values
+	issuers    map[string]*Issuer
+	rateLimits map[string]*RateLimit
+	lockdowns  map[string]*Lockdown
+
+	version  string    // hash of the lists, the same on every replica, see contentVersion
+	updated  time.Time // when it was applied
+	restored bool      // from the state file, and not refreshed by discovery yet
+	expired  bool      // empty, as the restored snapshot got too old, see expireStateFile
+}
+
+// copy returns the lists of the snapshot, without its indexes
+func (snap *Snapshot) copy() *Snapshot {
+	return &Snapshot{
+		Services:           snap.Services,
+		ACL:                snap.ACL,
+		UserScripts:        snap.UserScripts,
+		PermissionDefaults: snap.PermissionDefaults,
+		Config:             snap.Config,
+		Issuers:            snap.Issuers,
+		RateLimits:         snap.RateLimits,
+		Lockdowns:          snap.Lockdowns,
+	}
+}
+
+// contentVersion hashes the lists of the snapshot, such that replicas applying the same data agree
+// on its version, and a rollback gets the version it had before
+func (snap *Snapshot) contentVersion() string {
+	// empty lists are left out, as nil and empty lists are equal, see equalLists
+	lists := reflect.ValueOf(snap.copy()).Elem()
+	for i := 0; i < lists.NumField(); i++ {
+		if field := lists.Field(i); field.CanSet() && field.Kind() == reflect.Slice && field.Len() == 0 {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	data, err := json.Marshal(lists.Interface())
+	if err != nil {
+		panic(err) // the lists were decoded from json
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// index builds the lookups of a valid snapshot
+func (snap *Snapshot) index() {
+	snap.services = make(map[string]*Service, len(snap.Services))
+	for _, srv := range snap.Services {
+		snap.services[srv.Name] = srv
+	}
+	snap.scripts = make(map[string]*Service, len(snap.UserScripts))
+	for _, srv := range snap.UserScripts {
+		snap.scripts[srv.Name] = srv
+	}
+	snap.acl = make(map[string]*ACLEntry, len(snap.ACL))
+	for _, entry := range snap.ACL {
+		snap.acl[entry.Service] = entry
+	}
+	snap.config = make(map[string]string, len(snap.Config))
+	for _, entry := range snap.Config {
+		snap.config[entry.Key] = fmt.Sprint(entry.Val)
+	}
+
+	issuers := snap.Issuers
+	if len(issuers) == 0 {
+		issuers = []*Issuer{DefaultIssuer}
+	}
+	snap.issuers = make(map[string]*Issuer, len(issuers))
+	for _, issuer := range issuers {
+		snap.issuers[issuer.Issuer] = issuer
+	}
+
+	snap.rateLimits = make(map[string]*RateLimit, len(snap.RateLimits))
+	for _, limit := range snap.RateLimits {
+		snap.rateLimits[limit.Key] = limit
+	}
+	snap.lockdowns = make(map[string]*Lockdown, len(snap.Lockdowns))
+	for _, l := range snap.Lockdowns {
+		snap.lockdowns[l.Service] = l
+	}
+}
+
+// validate rejects snapshots that cannot be served correctly
+func (snap *Snapshot) validate() error {
+	services := func(kind string, list []*Service) error {
+		names := map[string]bool{}
+		for _, srv := range list {
+			if srv == nil || srv.Name == "" {
+				return errors.New(kind + " without name")
+			}
+			if names[srv.Name] {
+				return errors.New("duplicate " + kind + " " + srv.Name)
+			}
+			names[srv.Name] = true
+			if len(srv.Addresses) == 0 {
+				return errors.New(kind + " " + srv.Name + " has no addresses")
+			}
+			for _, address := range srv.Addresses {
+				if strings.TrimSpace(address) == "" {
+					return errors.New(kind + " " + srv.Name + " has an empty address")
+				}
+			}
+			if err := srv.Upstream.validate(); err != nil {
+				return errors.New(kind + " " + srv.Name + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+	if err := services("service", snap.Services); err != nil {
+		return err
+	}
+	if err := services("user script", snap.UserScripts); err != nil {
+		return err
+	}
+
+	// everything else is unique by its name
+	unique := func(kind string, n int, name func(i int) string, validate func(i int) error) error {
+		names := map[string]bool{}
+		for i := 0; i < n; i++ {
+			if err := validate(i); err != nil {
+				return fmt.Errorf("%s: %v", kind, err)
+			}
+			if names[name(i)] {
+				return errors.New("duplicate " + kind + " " + name(i))
+			}
+			names[name(i)] = true
+		}
+		return nil
+	}
+	checks := []error{
+		unique("ACL entry", len(snap.ACL), func(i int) string {
+			return snap.ACL[i].Service
+		}, func(i int) error {
+			if snap.ACL[i] == nil {
+				return errors.New("null")
+			}
+			return snap.ACL[i].validate()
+		}),
+		unique("role", len(snap.PermissionDefaults), func(i int) string {
+			return snap.PermissionDefaults[i].Role
+		}, func(i int) error {
+			if snap.PermissionDefaults[i] == nil || snap.PermissionDefaults[i].Role == "" {
+				return errors.New("missing role")
+			}
+			return nil
+		}),
+		unique("config key", len(snap.Config), func(i int) string {
+			return snap.Config[i].Key
+		}, func(i int) error {
+			if snap.Config[i].Key == "" {
+				return errors.New("missing key")
+			}
+			return nil
+		}),
+		unique("issuer", len(snap.Issuers), func(i int) string {
+			return snap.Issuers[i].Issuer
+		}, func(i int) error {
+			if snap.Issuers[i] == nil {
+				return errors.New("null")
+			}
+			return snap.Issuers[i].validate()
+		}),
+		unique("rate limit", len(snap.RateLimits), func(i int) string {
+			return snap.RateLimits[i].Key
+		}, func(i int) error {
+			if snap.RateLimits[i] == nil || snap.RateLimits[i].Key == "" {
+				return errors.New("missing key")
+			}
+			return snap.RateLimits[i].validate()
+		}),
+		unique("lockdown", len(snap.Lockdowns), func(i int) string {
+			return snap.Lockdowns[i].Service
+		}, func(i int) error {
+			if snap.Lockdowns[i] == nil {
+				return errors.New("null")
+			}
+			return snap.Lockdowns[i].validate()
+		}),
+	}
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotDiff lists what a snapshot changed
+type SnapshotDiff struct {
+	ServicesAdded   []string `json:"services_added,omitempty"`
+	ServicesRemoved []string `json:"services_removed,omitempty"`
+	ServicesChanged []string `json:"services_changed,omitempty"`
+	ScriptsAdded    []string `json:"scripts_added,omitempty"`
+	ScriptsRemoved  []string `json:"scripts_removed,omitempty"`
+	ScriptsChanged  []string `json:"scripts_changed,omitempty"`
+	ACLChanged      []string `json:"acl_changed,omitempty"` // services whose ACL entry was added, removed or changed
+	Changed         []string `json:"changed,omitempty"`     // other parts, eg. config
+}
+
+func (d *SnapshotDiff) Empty() bool {
+	return reflect.DeepEqual(d, &SnapshotDiff{})
+}
+
+func (d *SnapshotDiff) String() string {
+	data, _ := json.Marshal(d)
+	return string(data)
+}
+
+// diffByName compares two lists of named items
+func diffByName(before, after map[string]interface{}) (added, removed, changed []string) {
+	for name, item := range after {
+		old, ok := before[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case !reflect.DeepEqual(old, item):
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+func servicesByName(list []*Service) map[string]interface{} {
+	m := map[string]interface{}{}
+	for _, srv := range list {
+		m[srv.Name] = srv
+	}
+	return m
+}
+
+func diffSnapshots(before, after *Snapshot) *SnapshotDiff {
+	d := &SnapshotDiff{}
+	d.ServicesAdded, d.ServicesRemoved, d.ServicesChanged = diffByName(servicesByName(before.Services), servicesByName(after.Services))
+	d.ScriptsAdded, d.ScriptsRemoved, d.ScriptsChanged = diffByName(servicesByName(before.UserScripts), servicesByName(after.UserScripts))
+
+	acl := func(list []*ACLEntry) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, e := range list {
+			m[e.Service] = e
+		}
+		return m
+	}
+	added, removed, changed := diffByName(acl(before.ACL), acl(after.ACL))
+	d.ACLChanged = append(append(append(d.ACLChanged, added...), removed...), changed...)
+	sort.Strings(d.ACLChanged)
+
+	parts := []struct {
+		name          string
+		before, after interface{}
+	}{
+		{"roles", before.PermissionDefaults, after.PermissionDefaults},
+		{"config", before.Config, after.Config},
+		{"issuers", before.Issuers, after.Issuers},
+		{"rate_limits", before.RateLimits, after.RateLimits},
+		{"lockdowns", before.Lockdowns, after.Lockdowns},
+	}
+	for _, part := range parts {
+		if !equalLists(part.before, part.after) {
+			d.Changed = append(d.Changed, part.name)
+		}
+	}
+	return d
+}
+
+// equalLists treats nil and empty lists as equal
+func equalLists(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Len() == 0 && vb.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Snapshot returns the snapshot in use. Reads do not lock, and the snapshot must not be modified.
+func (s *State) Snapshot() *Snapshot {
+	return s.snap.Load().(*Snapshot)
+}
+
+// applySnapshot validates the snapshot and swaps it in at once. An invalid snapshot is rejected
+// and the current one is kept. While a version is pinned, a valid snapshot is held back until unpin.
+func (s *State) applySnapshot(source string, snap *Snapshot) (*SnapshotDiff, error) {
+	if err := snap.validate(); err != nil {
+		s.metrics.observeSnapshot(source, SnapshotRejected)
+		return nil, err
+	}
+	saved := snap.updated
+	snap = snap.copy()
+	snap.index()
+	if source == SnapshotSourceFile {
+		// keeps its age
+		snap.updated, snap.restored = saved, true
+	}
+
+	s.snapMu.Lock()
+	if s.history.pinned != "" {
+		current, pinned := s.Snapshot(), s.history.pinned
+		diff := diffSnapshots(current, snap)
+		s.history.held, s.history.heldSource = snap, source
+
+		// lockdowns are applied anyway, as they are needed during the incident a pin is for
+		var previous, locked *Snapshot
+		var lockdownDiff *SnapshotDiff
+		if !equalLists(current.Lockdowns, snap.Lockdowns) {
+			locked = current.copy()
+			locked.Lockdowns = snap.Lockdowns
+			locked.index()
+			previous, lockdownDiff = s.swapSnapshot(source, locked)
+		} else if current.restored && source != SnapshotSourceFile {
+			// discovery delivered, even though the pinned version is served
+			fresh := *current
+			fresh.restored = false
+			s.snap.Store(&fresh)
+		}
+		s.snapMu.Unlock()
+
+		s.metrics.observeSnapshot(source, SnapshotHeld)
+		log.Print(source + ": held back while version " + pinned + " is pinned " + diff.String())
+		if locked != nil {
+			s.snapshotApplied(source, previous, locked, lockdownDiff)
+		}
+		return diff, nil
+	}
+	previous, diff := s.swapSnapshot(source, snap)
+	s.snapMu.Unlock()
+
+	s.metrics.observeSnapshot(source, SnapshotApplied)
+	s.snapshotApplied(source, previous, snap, diff)
+	return diff, nil
+}
+
+// swapSnapshot makes an indexed snapshot the current one, and must be called while holding
+// snapMu. It is added to the history when it changes something.
+func (s *State) swapSnapshot(source string, snap *Snapshot) (previous *Snapshot, diff *SnapshotDiff) {
+	previous = s.Snapshot()
+	diff = diffSnapshots(previous, snap)
+	snap.version = previous.version
+	if snap.updated.IsZero() {
+		snap.updated = time.Now()
+	}
+	if !diff.Empty() {
+		snap.version = snap.contentVersion()
+		s.history.add(&HistoryEntry{Version: snap.version, Applied: snap.updated, Source: source, Diff: diff, snap: snap})
+	}
+	s.snap.Store(snap)
+	return previous, diff
+}
+
+// snapshotApplied updates everything that depends on the snapshot, once it was swapped in
+func (s *State) snapshotApplied(source string, previous, snap *Snapshot, diff *SnapshotDiff) {
+	if !diff.Empty() {
+		log.Print(source + ": applied version " + snap.version + " " + diff.String())
+	}
+
+	s.pruneJWKS()
+	s.pruneUpstreams()
+	s.revalidateStreams()
+	// lockdowns found on startup were recorded when they were activated
+	if previous.version != "" && source != SnapshotSourceFile {
+		s.auditLockdowns(previous.Lockdowns, snap.Lockdowns)
+	}
+	s.saveStateFile()
+}
+
+// snapshotUpdate is the body of POST /consul/services/change. Parts that are left out are
+// kept as they are.
+type snapshotUpdate struct {
+	Services           *[]*Service       `json:"services"`
+	ACL                *[]*ACLEntry      `json:"ACLEntries"`
+	UserScripts        *[]*Service       `json:"user_scripts"`
+	PermissionDefaults *[]*UserLevel     `json:"ACLRolesPermission"`
+	Config             *[]ACLConfigEntry `json:"config"`
+	Issuers            *[]*Issuer        `json:"issuers"`
+	RateLimits         *[]*RateLimit     `json:"rate_limits"`
+	Lockdowns          *[]*Lockdown      `json:"lockdowns"`
+}
+
+// decodeSnapshot builds a new snapshot from the current one and a pushed update
+func (s *State) decodeSnapshot(body []byte) (*Snapshot, error) {
+	update := &snapshotUpdate{}
+	if err := json.Unmarshal(body, update); err != nil {
+		return nil, err
+	}
+
+	snap := s.Snapshot().copy()
+	if update.Services != nil {
+		snap.Services = *update.Services
+	}
+	if update.ACL != nil {
+		snap.ACL = *update.ACL
+	}
+	if update.UserScripts != nil {
+		snap.UserScripts = *update.UserScripts
+	}
+	if update.PermissionDefaults != nil {
+		snap.PermissionDefaults = *update.PermissionDefaults
+	}
+	if update.Config != nil {
+		snap.Config = *update.Config
+	}
+	if update.Issuers != nil {
+		snap.Issuers = *update.Issuers
+	}
+	if update.RateLimits != nil {
+		snap.RateLimits = *update.RateLimits
+	}
+	if update.Lockdowns != nil {
+		snap.Lockdowns = *update.Lockdowns
+	}
+	return snap, nil
+}
@@ -0,0 +1,178 @@
+package aclsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestWatchAliveServicesHandler(t *testing.T) {
+	previous, set := os.LookupEnv("ACL_INTERNAL_TOKEN")
+	os.Setenv("ACL_INTERNAL_TOKEN", "secret")
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("ACL_INTERNAL_TOKEN", previous)
+		} else {
+			os.Unsetenv("ACL_INTERNAL_TOKEN")
+		}
+	})
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.ACL = []*ACLEntry{{Service: "users", MinimumPermission: PFlagUsersAll}}
+		snap.Config = []ACLConfigEntry{{Key: "jwt", Val: "true"}}
+	})
+	gateway := newTestGateway(t, state)
+
+	push := func(token, body string) (int, *JSend) {
+		t.Helper()
+		resp, err := http.Post(gateway.URL+"/consul/services/change?token="+token, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		response := &JSend{}
+		if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, response
+	}
+
+	if status, _ := push("", `{"services":[]}`); status != http.StatusForbidden {
+		t.Errorf("expected missing token to be refused. Got %d", status)
+	}
+
+	// parts left out are kept
+	status, response := push("secret", `{"services":[{"name":"users","addresses":["10.0.0.1:80"]}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected update to be applied. Got %d %+v", status, response)
+	}
+	diff := &SnapshotDiff{}
+	if err := json.Unmarshal(response.Data, diff); err != nil || len(diff.ServicesAdded) != 1 || len(diff.ACLChanged) != 0 {
+		t.Errorf("incorrect diff. Got %s", response.Data)
+	}
+	if state.Service("users") == nil || len(state.Snapshot().ACL) != 1 || state.lookupConfig("jwt") != "true" {
+		t.Error("expected services to be added to the ACL configuration")
+	}
+
+	invalid := map[string]string{
+		"malformed":          `{"services":[{"name":"docs"`,
+		"duplicate service":  `{"services":[{"name":"docs","addresses":["10.0.0.2:80"]},{"name":"docs","addresses":["10.0.0.3:80"]}]}`,
+		"empty addresses":    `{"services":[{"name":"docs","addresses":[]}]}`,
+		"invalid permission": `{"services":[{"name":"docs","addresses":["10.0.0.2:80"]}],"ACLEntries":[{"service":"docs","min_permission":"all"}]}`,
+	}
+	for name, body := range invalid {
+		if status, response = push("secret", body); status != http.StatusBadRequest || response.Status != JSendError {
+			t.Errorf("expected %s to be rejected. Got %d %+v", name, status, response)
+		}
+	}
+	if state.Service("users") == nil || state.Service("docs") != nil || len(state.Snapshot().ACL) != 1 {
+		t.Error("expected rejected updates to leave the state as it was")
+	}
+
+	var metrics bytes.Buffer
+	state.writeMetrics(&metrics)
+	for _, sample := range []string{
+		`acl_discovery_updates_total{source="push",result="applied"} 1`,
+		`acl_discovery_updates_total{source="push",result="rejected"} 4`,
+	} {
+		if !strings.Contains(metrics.String(), sample+"\n") {
+			t.Errorf("expected metric %s", sample)
+		}
+	}
+}
+
+func TestConsulDiscoveryKeepsValidSnapshot(t *testing.T) {
+	consul := newFakeConsul()
+	consul.setService("jolie--deployer", []string{TagPlatformEndpoint}, fakeConsulInstance{Address: "10.1.0.1", Port: 8000})
+	state, _ := startFakeConsulDiscovery(t, consul)
+	eventually(t, "service", func() bool {
+		return state.Service("jolie-deployer") != nil
+	})
+
+	// both are exposed as jolie-deployer
+	consul.setService("jolie-deployer", []string{TagPlatformEndpoint}, fakeConsulInstance{Address: "10.1.0.2", Port: 8000})
+	eventually(t, "rejected update", func() bool {
+		state.metrics.mu.Lock()
+		defer state.metrics.mu.Unlock()
+		return state.metrics.snapshots[snapshotLabels{source: SnapshotSourceConsul, result: "rejected"}] > 0
+	})
+	if srv := state.Service("jolie-deployer"); srv == nil || srv.Addresses[0] != "10.1.0.1:8000" {
+		t.Errorf("expected previous service to be kept. Got %+v", srv)
+	}
+}
+
+// benchmarkState holds 10k user scripts, and a service with an ACL entry per 10 scripts
+func benchmarkState(b *testing.B) (state *State, names []string) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	state = NewState()
+	setSnapshot(b, state, func(snap *Snapshot) {
+		for i := 0; i < 10000; i++ {
+			name := "script" + strconv.Itoa(i)
+			names = append(names, name)
+			snap.UserScripts = append(snap.UserScripts, &Service{Name: name, Addresses: []string{"10.0.0.1:8080"}})
+			if i%10 == 0 {
+				snap.Services = append(snap.Services, &Service{Name: name, Addresses: []string{"10.0.0.2:80"}})
+				snap.ACL = append(snap.ACL, &ACLEntry{Service: name, MinimumPermission: PermissionLvlUsr})
+			}
+		}
+		snap.Config = []ACLConfigEntry{{Key: "jwt", Val: "true"}}
+	})
+	return state, names
+}
+
+func BenchmarkLookup(b *testing.B) {
+	state, names := benchmarkState(b)
+	srv := &Service{Name: names[len(names)-10]}
+
+	b.Run("Service", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			state.Service(names[i%len(names)])
+		}
+	})
+	b.Run("UserScript", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			state.UserScript(names[i%len(names)])
+		}
+	})
+	b.Run("ServiceACL", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			state.ServiceACL(srv)
+		}
+	})
+	b.Run("Config", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			state.lookupConfig("jwt")
+		}
+	})
+	b.Run("UserScriptParallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				state.UserScript(names[i%len(names)])
+			}
+		})
+	})
+}
+
+func BenchmarkLookupConfiguration(b *testing.B) {
+	state, _ := benchmarkState(b)
+	router := httprouter.New()
+	SetupRoutes(router, state)
+	req := httptest.NewRequest(http.MethodGet, "/configuration", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
@@ -3,19 +3,18 @@ package aclsrv
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/julienschmidt/httprouter"
-	"github.com/lestrrat-go/jwx/jwk"
 )
 
 const (
@@ -23,10 +22,24 @@ const (
 )
 
 func NewState() *State {
-	return &State{
+	state := &State{
 		httpClient: http.DefaultClient,
-		jwks: &jwk.Set{},
-	}
+		jwks:       map[string]*jwksManager{},
+		jwksSaved:  map[string][]byte{},
+		upstreams:  map[string]*upstreamState{},
+		transports: map[transportKey]*http.Transport{},
+		limiter:    newMemoryStore(),
+		metrics:    newMetrics(),
+		wouldDeny:  newWouldDenyReport(),
+		history:    history{size: DefaultHistorySize},
+		logs: []*logOutput{
+			{LogOutput: LogOutput{Sink: NewLogShipper(DefaultLoggerURL), MinLevel: LogLvlINFO}},
+		},
+	}
+	snap := &Snapshot{}
+	snap.index()
+	state.snap.Store(snap)
+	return state
 }
 
 type ACLConfigEntry struct {
@@ -37,228 +50,253 @@ type ACLConfigEntry struct {
 type State struct {
 	sync.RWMutex
 
-	// updated through service discovery
-	// a service might exist here, while not in th ACL.
-	// That simply means the service has no ACL configuration and that everyone has access
-	Services []*Service `json:"services"`
+	// services, user scripts and the ACL configuration, a *Snapshot replaced as a whole by
+	// applySnapshot
+	snap    atomic.Value
+	snapMu  sync.Mutex // serialises applySnapshot, and guards history
+	history history
 
-	// ACL
-	ACL []*ACLEntry `json:"ACLEntries"`
+	httpClient *http.Client
 
-	UserScripts []*Service `json:"user_scripts"`
+	jwksMu    sync.RWMutex
+	jwks      map[string]*jwksManager // by jwks url
+	jwksSaved map[string][]byte       // JWKS documents restored from the state file, by jwks url
 
-	PermissionDefaults []*UserLevel `json:"ACLRolesPermission"`
+	// active WebSocket and Server-Sent Events connections
+	streams streamRegistry
 
-	Config []ACLConfigEntry `json:"config"`
+	upstreamsMu sync.Mutex
+	upstreams   map[string]*upstreamState // by upstreamKey
 
-	httpClient *http.Client
+	transportsMu sync.Mutex
+	transports   map[transportKey]*http.Transport
+
+	limiter RateLimitStore
+
+	metrics *metrics
+	logs    []*logOutput
+	audit   *AuditLog
+	store   configStore // where admin changes are written, eg. consul
 
-	jwksMu sync.RWMutex
-	jwks   *jwk.Set
+	liftedMu sync.Mutex
+	lifted   map[string]UserID // who lifted a lockdown through the admin API, until it is applied
+
+	stateFileMu sync.Mutex
+	stateFile   string // where the last known state is saved, see LoadStateFile
+
+	// requests ACL entries in report-only mode would deny
+	wouldDeny *wouldDenyReport
 }
 
 func (s *State) lookupConfig(key string) string {
-	s.RLock()
-	defer s.RUnlock()
+	return s.Snapshot().config[key]
+}
 
-	for i := range s.Config {
-		if s.Config[i].Key == key {
-			return fmt.Sprint(s.Config[i].Val)
-		}
-	}
+// issuer finds the trusted issuer of a "iss" claim
+func (s *State) issuer(iss string) *Issuer {
+	return s.Snapshot().issuers[iss]
+}
 
-	return ""
+func (s *State) getJWK(issuer *Issuer, kid string) (interface{}, error) {
+	return s.jwksManager(issuer.JWKSURL).key(kid)
 }
 
-func (s *State) getJWK(kid string) (interface{}, error) {
+// jwksManager returns the key manager of a JWKS url, and starts it if needed
+func (s *State) jwksManager(url string) *jwksManager {
 	s.jwksMu.RLock()
-	if key := s.jwks.LookupKeyID(kid); len(key) == 1 {
-		defer s.jwksMu.RUnlock()
-		return key[0].Materialize()
-	}
+	m, ok := s.jwks[url]
 	s.jwksMu.RUnlock()
-
-	// get fresh keys
-	set, err := jwk.FetchHTTP(jwksURL)
-	if err != nil {
-		return nil, err
+	if ok {
+		return m
 	}
 
-	// add keys to cache
 	s.jwksMu.Lock()
 	defer s.jwksMu.Unlock()
-	for i := range set.Keys {
-		k := set.Keys[i].KeyID()
-		if key := s.jwks.LookupKeyID(k); len(key) == 1 {
-			continue
+	if m, ok = s.jwks[url]; !ok {
+		m = newJWKSManager(s.httpClient, url)
+		m.onRefresh = s.saveStateFile
+		if data, ok := s.jwksSaved[url]; ok {
+			if err := m.restore(data); err != nil {
+				log.Print("jwks "+url+": ", err)
+			}
 		}
-
-		s.jwks.Keys = append(s.jwks.Keys, set.Keys[i])
-	}
-
-	if key := s.jwks.LookupKeyID(kid); len(key) == 1 {
-		return key[0].Materialize()
+		s.jwks[url] = m
+		go m.run()
 	}
-
-	return nil, errors.New("unable to find key")
+	return m
 }
 
-// Get service if it exists
-func (s *State) Service(name string) (srv *Service) {
-	s.RLock()
-	defer s.RUnlock()
+// pruneJWKS stops refreshing keys of issuers that are no longer trusted
+func (s *State) pruneJWKS() {
+	trusted := map[string]bool{}
+	for _, issuer := range s.Snapshot().issuers {
+		trusted[issuer.JWKSURL] = true
+	}
 
-	for _, srv = range s.Services {
-		if !srv.Empty() && name == srv.Name {
-			return
+	s.jwksMu.Lock()
+	defer s.jwksMu.Unlock()
+	for url, m := range s.jwks {
+		if !trusted[url] {
+			m.Stop()
+			delete(s.jwks, url)
+		}
+	}
+	for url := range s.jwksSaved {
+		if !trusted[url] {
+			delete(s.jwksSaved, url)
 		}
 	}
-
-	return nil
 }
 
-// Get user script if it exists
-func (s *State) UserScript(name string) (srv *Service) {
-	s.RLock()
-	defer s.RUnlock()
+// Health summarises the state for the /health endpoint
+func (s *State) Health() *Health {
+	health := &Health{
+		Status: HealthOK,
+	}
+	if snap := s.Snapshot(); snap.restored {
+		health.Status = HealthDegraded
+		health.Reason = "serving the state of " + snap.updated.UTC().Format(time.RFC3339) + " from the state file, until service discovery delivers data"
+	} else if snap.expired {
+		health.Status = HealthDegraded
+		health.Reason = "the state file got too old and was dropped, waiting for service discovery to deliver data"
+	}
 
-	for _, srv = range s.UserScripts {
-		if !srv.Empty() && name == srv.Name {
-			return
-		}
+	s.jwksMu.RLock()
+	for _, m := range s.jwks {
+		health.JWKS = append(health.JWKS, m.status())
 	}
+	s.jwksMu.RUnlock()
+	sort.Slice(health.JWKS, func(i, j int) bool {
+		return health.JWKS[i].URL < health.JWKS[j].URL
+	})
 
-	return nil
+	return health
 }
 
-func (s *State) ServiceACL(srv *Service) (entry *ACLEntry) {
-	s.RLock()
-	defer s.RUnlock()
+// Get service if it exists
+func (s *State) Service(name string) *Service {
+	return s.Snapshot().services[name]
+}
 
-	for _, entry = range s.ACL {
-		if !entry.Empty() && srv.Name == entry.Service {
-			return
-		}
-	}
+// Get user script if it exists
+func (s *State) UserScript(name string) *Service {
+	return s.Snapshot().scripts[name]
+}
 
-	return nil
+func (s *State) ServiceACL(srv *Service) *ACLEntry {
+	return s.Snapshot().acl[srv.Name]
 }
 
 func (s *State) APIHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	setupResponse(&w, r)
+	s.setupResponse(&w, r)
 
 	response := &JSend{
 		HTTPCode: http.StatusOK,
 	}
 	var addr string // proxied addr
 	var user *User
+	var streamed bool // response was streamed without JSend
+	started := time.Now()
+	labels := newRequestLabels(streamRouteAPI, r)
 	defer func(response *JSend) {
-		response.write(w)
+		if !streamed {
+			response.write(w)
+		}
+		s.metrics.observeRequest(labels, time.Since(started))
 
-		go logger(LogLvlINFO, &LEapi{
+		// requests the service could not answer are warnings
+		level := LogLvlINFO
+		if response.Status == JSendError || labels.decision == DecisionWouldDeny {
+			level = LogLvlWarn
+		}
+		s.log(level, &LEapi{
 			IP:          r.RemoteAddr,
 			User:        user,
 			OriginalURL: r.URL.String(),
 			ProxiedURL:  addr,
 			Err: response.Message,
+			Decision: labels.decision,
 		})
 	}(response)
 
-	path := ps.ByName(APIPathID)
-	srvName, err := getServiceName(path)
-	if err != nil {
-		response.Status = JSendFail
-		response.Message = "unable to get service name from your request. Error: " + err.Error()
-		return
-	}
-
-	// check if such a service exists
-	srv := s.Service(srvName)
-
-	// verify that this is a public route/service
-	if srv == nil {
-		response.Status = JSendFail
-		response.Message = "service was not found or does not exist as an endpoint yet"
-		response.HTTPCode = 404
-		return
-	}
-
 	// verify JWT signature and get user info
-	tokenStr := getJWT(r.Header)
-	if tokenStr == "" {
-		if s.lookupConfig("jwt") == "true" && srvName != "jolie-deployer" {
-			response.Status = JSendFail
-			response.Message = "Missing JWT in header. Supported fields: 'Authorization: Bearer <JWT>', 'jwt: <jwt>', 'JWT: <jwt>'"
-			return
-		} else {
-			tokenStr = "a.b.c"
-		}
-	}
-	user = &User{}
+	//
 	// so.. right now we haven't found a proper way to deal with jolie-deployer in regards to
 	// security. So I'm making the JWT token optional...
 	//
 	// This allows the ACL to check the actual permission of the jolie-deployer. Such that if those permissions are
 	// ever added. You must be authenticated. Right now, the jolie deployer is hardcoded into the if else
 	// to make it an exception. With this, at least we don't have to make every other service public as well.
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	user, authErr := s.authenticate(r.Header)
+	authenticated := authErr == nil
 
-		kid, ok := token.Header["kid"].(string)
-		if !ok {
-			return nil, errors.New("unable to convert kid to string")
+	// find the service and decide on access, the same way /explain does
+	api, err := s.decideAPI(user, authErr, r.Method, ps.ByName(APIPathID))
+	if err != nil {
+		labels.decision = DecisionNotFound
+		response.Status = JSendFail
+		response.Message = err.Error()
+		if err == errServiceNotFound {
+			response.HTTPCode = 404
+		} else if err == errDotSegment {
+			response.HTTPCode = 400
 		}
+		return
+	}
+	srv, srvName, srvPath, acl := api.Service, api.Service.Name, api.Path, api.ACL
+	labels.service = srv.Name
 
-		return s.getJWK(kid)
-	})
-
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		if usrname := claims["cognito:username"]; usrname != nil {
-			user.ID = usrname.(UserID)
-		}
-		if p := claims["cognito:groups"]; p != nil {
-			arr := p.([]string)
-			for i := range arr {
-				if arr[i][:2] == "p:" {
-					lvl, err := strconv.ParseUint(arr[i][2:], 10, 64)
-					if err != nil {
-						err = errors.New(err.Error() + " :::: Unable to extract permission level")
-					} else {
-						user.Permission = Permission(lvl)
-					}
-					break
-				}
-			}
-		}
+	if lockdown := s.lockdown(srvName, user, authenticated); lockdown != nil {
+		labels.decision = DecisionLockdown
+		lockdown.respond(w, response)
+		return
 	}
 
-	if (!token.Valid || err != nil) && s.lookupConfig("jwt") == "true" && srvName != "jolie-deployer" {
+	if !s.rateLimit(w, r, user, authenticated, streamRouteAPI, srvName, response) {
+		labels.decision = DecisionLimited
+		return
+	}
+	labels.decision = api.Decision
+	if !s.recordDecision(r, user, srv.Name, srvPath, api.Decision, api.Access.Rule, api.Access.Reason, response) {
+		return
+	}
+	switch api.Decision {
+	case DecisionNoJWT:
 		response.Status = JSendFail
-		response.Message = "issue with JWT. " + err.Error()
-
+		response.Message = authErr.Error()
+		return
+	case DecisionInvalidJWT:
+		response.Status = JSendFail
+		response.Message = "issue with JWT. " + authErr.Error()
 		if user.ID == "" {
 			response.Message += " ::: also missing username"
 		}
-
 		return
-	}
-
-	// verify permissions / ACL
-	// default: whitelist everyone if no ACL config is set for service
-	if acl := s.ServiceACL(srv); acl != nil && !acl.HasAccess(user) {
+	case DecisionDenied:
 		response.Status = JSendFail
-		response.Message = "You do not have access to this service. Error: " + err.Error()
+		response.Message = "You do not have access to this service"
+		return
+	case DecisionWouldDeny:
+		s.wouldDeny.add(srv.Name, user, r.Method, srvPath, api.Access)
+	}
+	if !s.quota(w, r, user, authenticated, acl, srvPath, response) {
+		labels.decision = DecisionLimited
 		return
 	}
 
 	// variable enforcement - see README.md
+	// bodies of stream mode services, such as file uploads, are buffered to be enforced whatever type is declared
+	longLived := isLongLived(r)
+	stream := srv.Proxy == ProxyModeStream || longLived
 	urlValues := r.URL.Query()
 	if s.lookupConfig("enforce") == "true" {
+		// by the proxy mode of the service, as the headers making a request long lived are up to the caller
+		enforceBody := enforceJSONBodyParams
+		if srv.Proxy == ProxyModeStream {
+			enforceBody = enforceStreamBodyParams
+		}
 		var l int64
-		r.Body, l, err = enforceJSONBodyParams(r.Body, user)
+		r.Body, l, err = enforceBody(r.Body, user)
 		if err != nil {
 			response.Status = JSendFail
 			response.Message = "Unable to handle the ACL enforced variables. Error: " + err.Error()
@@ -269,36 +307,67 @@ func (s *State) APIHandler(w http.ResponseWriter, r *http.Request, ps httprouter
 		enforceURLQueryParams(&urlValues, user) // TODO: review pointer
 	}
 
-	// recreate request
-	previous := "/" + srvName
-	addr = "http://" + srv.GetAddress() + path[len(previous):]
-	urlQuery := urlValues.Encode()
-	if urlQuery != "" {
-		addr += "?" + urlQuery
-	}
-	internalReq, err := http.NewRequest(r.Method, addr, r.Body)
-	if err != nil {
-		response.Status = JSendError
-		response.Message = err.Error()
+	if stream {
+		pick, err := s.pickStream(streamRouteAPI, srv)
+		if err != nil {
+			labels.upstream = upstreamStatusLabel(0, err)
+			response.upstreamError(err)
+			return
+		}
+		defer pick.done()
+
+		target := &url.URL{
+			Scheme:   "http",
+			Host:     pick.address(),
+			Path:     srvPath,
+			RawQuery: urlValues.Encode(),
+		}
+		addr = target.String()
+		streamed = true
+		var proxyErr error
+		onError := func(err error) {
+			proxyErr = err
+			response.Message = err.Error()
+		}
+		defer func() {
+			labels.upstream = upstreamStatusLabel(pick.status, proxyErr)
+		}()
+
+		if longLived {
+			s.proxySession(w, r, target, &streamSession{
+				route:   streamRouteAPI,
+				service: srv.Name,
+				user:    user,
+				authErr: authErr,
+				method:  r.Method,
+				path:    srvPath,
+			}, pick, &srv.Upstream, onError)
+		} else {
+			s.streamProxy(w, r, target, pick.transport(s.upstreamTransport(&srv.Upstream)), onError)
+		}
 		return
 	}
 
-	internalReq.Header = r.Header
-	internalReq.Header.Set("Accept", "application/json")
-	internalReq.Header.Del("Accept-Encoding")
-	resp, err := s.httpClient.Do(internalReq)
+	// the body is buffered, such that the request can be retried
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		response.Status = JSendError
 		response.Message = err.Error()
 		return
 	}
 
-	// handle response
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	header := r.Header.Clone()
+	header.Set("Accept", "application/json")
+	header.Del("Accept-Encoding")
+	resp, err := s.forward(r, streamRouteAPI, srv, srvPath, urlValues.Encode(), header, body)
+	var status int
+	if resp != nil {
+		addr = resp.URL
+		status = resp.StatusCode
+	}
+	labels.upstream = upstreamStatusLabel(status, err)
 	if err != nil {
-		response.Status = JSendError
-		response.Message = err.Error()
+		response.upstreamError(err)
 		return
 	}
 
@@ -306,18 +375,26 @@ func (s *State) APIHandler(w http.ResponseWriter, r *http.Request, ps httprouter
 	for k, v := range resp.Header {
 		w.Header().Set(k, v[0])
 	}
+	w.Header().Del("Content-Length") // the body is wrapped in JSend
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	response.Status = JSendSuccess
-	response.Data = body
+	response.Data = resp.Body
 	response.InternalHTTPCode = resp.StatusCode
 }
 
 func (s *State) ScriptHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	setupResponse(&w, r)
+	s.setupResponse(&w, r)
+
+	started := time.Now()
+	labels := newRequestLabels(streamRouteScript, r)
+	defer func() {
+		s.metrics.observeRequest(labels, time.Since(started))
+	}()
 
 	path := ps.ByName(APIPathID)
 	srvName, err := getServiceName(path)
 	if err != nil {
+		labels.decision = DecisionNotFound
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -325,18 +402,56 @@ func (s *State) ScriptHandler(w http.ResponseWriter, r *http.Request, ps httprou
 	// check if such a service exists
 	var srv *Service
 	if srv = s.UserScript(srvName); srv == nil {
+		labels.decision = DecisionNotFound
 		http.Error(w, "Unable to find user script for given token: "+srvName, http.StatusNotFound)
 		return
 	}
+	labels.service = srv.Name
 
-	// verify we have created an acceptable URL
-	addr := "http://" + srv.GetAddress() + path[len("/"+srvName):]
-	urlQuery := r.URL.Query().Encode()
-	if urlQuery != "" {
-		addr += "?" + urlQuery
+	// user scripts do not require a JWT, but authenticated users are rate limited by their role
+	user, authErr := s.authenticate(r.Header)
+	response := &JSend{}
+	if lockdown := s.lockdown("script:"+srvName, user, authErr == nil); lockdown != nil {
+		labels.decision = DecisionLockdown
+		lockdown.respond(w, response)
+		response.write(w)
+		return
 	}
-	if _, err = url.Parse(addr); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !s.rateLimit(w, r, user, authErr == nil, streamRouteScript, srvName, response) {
+		labels.decision = DecisionLimited
+		response.write(w)
+		return
+	}
+
+	// WebSocket and Server-Sent Events
+	if isLongLived(r) {
+		pick, err := s.pickStream(streamRouteScript, srv)
+		if err != nil {
+			labels.upstream = upstreamStatusLabel(0, err)
+			http.Error(w, err.Error(), scriptErrorStatus(err))
+			return
+		}
+		defer pick.done()
+
+		target := &url.URL{
+			Scheme:   "http",
+			Host:     pick.address(),
+			Path:     path[len("/"+srvName):],
+			RawQuery: r.URL.RawQuery,
+		}
+		s.proxySession(w, r, target, &streamSession{
+			route:   streamRouteScript,
+			service: srv.Name,
+			user:    user,
+			authErr: authErr,
+			method:  r.Method,
+			path:    target.Path,
+		}, pick, &srv.Upstream, func(err error) {
+			labels.upstream = upstreamStatusLabel(0, err)
+		})
+		if pick.status != 0 {
+			labels.upstream = upstreamStatusLabel(pick.status, nil)
+		}
 		return
 	}
 
@@ -350,32 +465,19 @@ func (s *State) ScriptHandler(w http.ResponseWriter, r *http.Request, ps httprou
 
 	// you can reassign the body if you need to parse it as multipart
 	r.Body = ioutil.NopCloser(bytes.NewReader(body))
-	proxyReq, err := http.NewRequest(r.Method, addr, bytes.NewReader(body))
+	resp, err := s.forward(r, streamRouteScript, srv, path[len("/"+srvName):], r.URL.Query().Encode(), r.Header, body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		labels.upstream = upstreamStatusLabel(0, err)
+		http.Error(w, err.Error(), scriptErrorStatus(err))
 		return
 	}
-	proxyReq.Header = r.Header
 
-	resp, err := s.httpClient.Do(proxyReq)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	w.WriteHeader(resp.StatusCode)
 	for k, v := range resp.Header {
 		w.Header().Set(k, v[0])
 	}
-
-	body, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
-	}
-
-	w.Write(body)
+	labels.upstream = upstreamStatusLabel(resp.StatusCode, nil)
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
 }
 
 func (s *State) WatchAliveServicesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -386,30 +488,35 @@ func (s *State) WatchAliveServicesHandler(w http.ResponseWriter, r *http.Request
 	}(response)
 
 	token := r.URL.Query().Get("token")
-	if token == "" {
-		panic("internal ACL token is empty!")
-	}
-	if token != os.Getenv("ACL_INTERNAL_TOKEN") {
+	if token == "" || token != os.Getenv("ACL_INTERNAL_TOKEN") {
 		response.Message = "Missing ACL token for updating services"
 		response.HTTPCode = 403
 		response.Status = JSendFail
 		return
 	}
 
+	// parts left out of the update are kept, the rest is replaced at once when valid
 	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Fatal(err)
-		return
+	var snap *Snapshot
+	if err == nil {
+		snap, err = s.decodeSnapshot(body)
+		if err != nil {
+			s.metrics.observeSnapshot(SnapshotSourcePush, SnapshotRejected)
+		}
+	}
+	var diff *SnapshotDiff
+	if err == nil {
+		diff, err = s.applySnapshot(SnapshotSourcePush, snap)
 	}
-
-	s.Lock()
-	defer s.Unlock()
-	err = json.Unmarshal(body, s)
 	if err != nil {
-		log.Fatal(err)
+		response.Message = "invalid update, the services were not changed. Error: " + err.Error()
+		response.HTTPCode = http.StatusBadRequest
+		response.Status = JSendError
 		return
 	}
 
-	// data, _ := json.Marshal(s)
-	// fmt.Println(string(data))
+	data, err := json.Marshal(diff)
+	if err == nil {
+		response.Data = data
+	}
 }
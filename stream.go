@@ -0,0 +1,198 @@
+package aclsrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// routes of a stream session
+const (
+	streamRouteAPI    = "api"
+	streamRouteScript = "script"
+)
+
+// isUpgradeRequest checks if the client asks for a protocol upgrade, such as WebSocket
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isEventStreamRequest checks if the client asks for Server-Sent Events
+func isEventStreamRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// isLongLived checks if a request should be handled as a long lived stream session
+func isLongLived(r *http.Request) bool {
+	return isUpgradeRequest(r) || isEventStreamRequest(r)
+}
+
+// streamSession is a long lived connection, such as a WebSocket or Server-Sent Events, proxied to a
+// service or user script. The session is closed when it has been idle for too long, exceeds its max
+// lifetime, or when the user loses access / the service address disappears from the catalog.
+type streamSession struct {
+	route   string // streamRouteAPI or streamRouteScript
+	service string
+	address string // <ip:port> of the service instance
+	user    *User
+	authErr error // of authenticating the user, see decideAPI
+	method  string
+	path    string // path after the service prefix
+	started time.Time
+
+	lastActive int64 // unix nano
+	cancel     context.CancelFunc
+}
+
+func (ss *streamSession) touch() {
+	atomic.StoreInt64(&ss.lastActive, time.Now().UnixNano())
+}
+
+func (ss *streamSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&ss.lastActive)))
+}
+
+// streamRegistry tracks every active stream session
+type streamRegistry struct {
+	sync.Mutex
+	sessions map[*streamSession]struct{}
+}
+
+func (reg *streamRegistry) add(ss *streamSession) {
+	reg.Lock()
+	defer reg.Unlock()
+	if reg.sessions == nil {
+		reg.sessions = map[*streamSession]struct{}{}
+	}
+	reg.sessions[ss] = struct{}{}
+}
+
+func (reg *streamRegistry) remove(ss *streamSession) {
+	reg.Lock()
+	defer reg.Unlock()
+	delete(reg.sessions, ss)
+}
+
+func (reg *streamRegistry) list() (sessions []*streamSession) {
+	reg.Lock()
+	defer reg.Unlock()
+	for ss := range reg.sessions {
+		sessions = append(sessions, ss)
+	}
+	return sessions
+}
+
+// activityConn marks the session as active on every read and write
+type activityConn struct {
+	net.Conn
+	session *streamSession
+}
+
+func (c *activityConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.session.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.session.touch()
+	}
+	return n, err
+}
+
+// proxySession streams a long lived connection to the target. The JWT and ACL checks must have been
+// done already, as they are only done once for the whole session. The session counts as an outstanding
+// request of the picked address until it is closed.
+func (s *State) proxySession(w http.ResponseWriter, r *http.Request, target *url.URL, ss *streamSession, pick *upstreamPick, upstream *Upstream, onError func(err error)) {
+	ctx, cancel := context.WithTimeout(r.Context(), upstream.maxLifetime())
+	defer cancel()
+
+	ss.address = target.Host
+	ss.started = time.Now()
+	ss.cancel = cancel
+	ss.touch()
+	s.streams.add(ss)
+	defer s.streams.remove(ss)
+
+	// close the session when idle
+	go func(idleTimeout time.Duration) {
+		ticker := time.NewTicker(idleTimeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if ss.idle() > idleTimeout {
+					cancel()
+					return
+				}
+			}
+		}
+	}(upstream.idleTimeout())
+
+	// a dedicated connection per session, such that the traffic can be tracked
+	dialer := &net.Dialer{
+		Timeout:   upstream.connectTimeout(),
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &activityConn{Conn: conn, session: ss}, nil
+		},
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: upstream.responseTimeout(),
+	}
+	defer transport.CloseIdleConnections()
+
+	s.streamProxy(w, r.WithContext(ctx), target, pick.transport(transport), onError)
+}
+
+// revalidateStreams closes every stream session whose service address has left the catalog, whose
+// user no longer has access to the service, or that is shut off by a lockdown. Access is decided
+// the same way as for a new request, so report-only and disabled ACL entries close no sessions.
+func (s *State) revalidateStreams() {
+	for _, ss := range s.streams.list() {
+		var srv *Service
+		lockdown := ss.service
+		if ss.route == streamRouteScript {
+			srv = s.UserScript(ss.service)
+			lockdown = "script:" + ss.service
+		} else {
+			srv = s.Service(ss.service)
+		}
+
+		valid := srv != nil && srv.hasAddress(ss.address) && s.lockdown(lockdown, ss.user, ss.authErr == nil) == nil
+		if valid && ss.route == streamRouteAPI {
+			api, err := s.decideAPI(ss.user, ss.authErr, ss.method, "/"+ss.service+ss.path)
+			valid = err == nil && (api.Decision == DecisionAllowed || api.Decision == DecisionWouldDeny)
+		}
+
+		if !valid {
+			ss.cancel()
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package aclsrv
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newEchoUpgradeBackend accepts any protocol upgrade and echoes everything back
+func newEchoUpgradeBackend(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			http.Error(w, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// dialUpgrade opens a raw connection to the gateway and completes the upgrade handshake
+func dialUpgrade(t *testing.T, gateway *httptest.Server, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", backendAddress(gateway))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	_, err = conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: acl\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected protocol switch. Got %s", resp.Status)
+	}
+	return conn, reader
+}
+
+func expectEcho(t *testing.T, conn net.Conn, reader *bufio.Reader, msg string) {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != msg+"\n" {
+		t.Errorf("incorrect echo. Got %q, wants %q", line, msg)
+	}
+}
+
+func expectClosed(t *testing.T, reader *bufio.Reader, conn net.Conn) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected connection to be closed. Got %v", err)
+	}
+}
+
+func TestAPIHandlerUpgrade(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{
+			{Name: "logs", Addresses: []string{backendAddress(backend)}},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	conn, reader := dialUpgrade(t, gateway, "/api/logs/live")
+	expectEcho(t, conn, reader, "hello")
+	expectEcho(t, conn, reader, "world")
+	if got := len(state.streams.list()); got != 1 {
+		t.Errorf("expected one active session. Got %d", got)
+	}
+
+	// report-only and disabled entries don't deny access
+	for _, mode := range []string{ACLModeReportOnly, ACLModeDisabled} {
+		setSnapshot(t, state, func(snap *Snapshot) {
+			snap.ACL = []*ACLEntry{{Service: "logs", Mode: mode, MinimumPermission: PermissionLvlAdm}}
+		})
+		expectEcho(t, conn, reader, mode)
+	}
+
+	// revoke access
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.ACL = []*ACLEntry{{Service: "logs", MinimumPermission: PermissionLvlAdm}}
+	})
+
+	expectClosed(t, reader, conn)
+	eventually(t, "session to be removed", func() bool {
+		return len(state.streams.list()) == 0
+	})
+
+	// lockdowns close sessions as well
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.ACL = nil
+	})
+	conn, reader = dialUpgrade(t, gateway, "/api/logs/live")
+	expectEcho(t, conn, reader, "hello")
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Lockdowns = []*Lockdown{{Service: "logs"}}
+	})
+	expectClosed(t, reader, conn)
+}
+
+func TestScriptHandlerUpgradeIdleTimeout(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.UserScripts = []*Service{
+			{
+				Name:      "abc",
+				Addresses: []string{backendAddress(backend)},
+				Upstream:  Upstream{IdleTimeout: Duration(200 * time.Millisecond)},
+			},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	conn, reader := dialUpgrade(t, gateway, "/script/abc/console")
+	for i := 0; i < 4; i++ {
+		// activity keeps the session open
+		time.Sleep(100 * time.Millisecond)
+		expectEcho(t, conn, reader, "ping")
+	}
+
+	expectClosed(t, reader, conn)
+}
+
+func TestAPIHandlerEventStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			if _, err := w.Write([]byte("data: tick\n\n")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}))
+	defer backend.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{
+			{Name: "logs", Addresses: []string{backendAddress(backend)}},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	req, _ := http.NewRequest(http.MethodGet, gateway.URL+"/api/logs/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "data: tick\n" {
+		t.Errorf("incorrect event. Got %q", line)
+	}
+
+	// the service leaves the catalog
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = nil
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, reader)
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected event stream to be closed")
+	}
+}
+
+func TestAPIHandlerEventStreamEnforcesBody(t *testing.T) {
+	bodies := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.Header().Set("Content-Type", "text/event-stream")
+	}))
+	defer backend.Close()
+
+	idp := newTestIssuer(t)
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Issuers = []*Issuer{idp.config()}
+		snap.Config = []ACLConfigEntry{{Key: "enforce", Val: "true"}}
+		snap.Services = []*Service{
+			{Name: "logs", Addresses: []string{backendAddress(backend)}},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	// asking for an event stream must not loosen the enforcement of the service
+	for body, wants := range map[string]string{
+		`{"acle_user_id":"admin"}`: `{"acle_user_id":"andersfylling"}`,
+		"acle_user_id=admin":       "",
+	} {
+		req, _ := http.NewRequest(http.MethodPost, gateway.URL+"/api/logs/events", strings.NewReader(body))
+		req.Header = authHeader(idp.sign(t, AlgRS256, nil))
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Content-Type", "text/plain")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		var got string
+		select {
+		case got = <-bodies:
+		default:
+		}
+		if got != wants {
+			t.Errorf("%s: incorrect body at the service. Got %q, wants %q", body, got, wants)
+		}
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if isUpgradeRequest(r) {
+		t.Error("plain request is not an upgrade")
+	}
+
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if !isUpgradeRequest(r) {
+		t.Error("expected upgrade request")
+	}
+
+	r.Header.Set("Connection", strings.ToLower("keep-alive"))
+	if isUpgradeRequest(r) {
+		t.Error("upgrade header without connection upgrade is not an upgrade")
+	}
+}
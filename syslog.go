@@ -0,0 +1,132 @@
+package aclsrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	syslogFacility = 16 // local0
+	syslogTimeout  = 2 * time.Second
+	syslogRedial   = 5 * time.Second // min time between connection attempts
+)
+
+var errSyslogUnavailable = errors.New("syslog server is unavailable")
+
+// SyslogSink sends every entry as an RFC 5424 message, with the json entry as message, over UDP or
+// TCP. TCP messages are framed by octet counting (RFC 6587). The connection is dialed on the first
+// entry and redialed when it breaks; entries are dropped while the server cannot be reached.
+type SyslogSink struct {
+	network  string
+	address  string
+	appName  string
+	hostname string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	nextDial time.Time
+	closed   bool
+}
+
+var _ LogSink = (*SyslogSink)(nil)
+
+func NewSyslogSink(network, address, appName string) (*SyslogSink, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, errors.New("unsupported syslog network: " + network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogSink{
+		network:  network,
+		address:  address,
+		appName:  appName,
+		hostname: hostname,
+	}, nil
+}
+
+// syslogSeverity maps a Java level to a syslog severity
+func syslogSeverity(level int) int {
+	switch {
+	case level >= LogLvlWarn:
+		return 4 // warning
+	case level >= LogLvlINFO:
+		return 6 // informational
+	}
+	return 7 // debug
+}
+
+// format encodes an entry as a syslog message, framed for the network
+func (s *SyslogSink) format(entry *ACLLogEntry, now time.Time) ([]byte, error) {
+	line, err := marshalLogLine(entry, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("<" + strconv.Itoa(syslogFacility*8+syslogSeverity(entry.Level)) + ">1 ")
+	msg.WriteString(now.UTC().Format("2006-01-02T15:04:05.000000Z07:00") + " ")
+	msg.WriteString(s.hostname + " " + s.appName + " " + strconv.Itoa(os.Getpid()) + " - - ")
+	msg.Write(bytes.TrimSuffix(line, []byte("\n")))
+
+	if s.network == "tcp" {
+		return append([]byte(strconv.Itoa(msg.Len())+" "), msg.Bytes()...), nil
+	}
+	return msg.Bytes(), nil
+}
+
+func (s *SyslogSink) Write(entry *ACLLogEntry) error {
+	now := time.Now()
+	msg, err := s.format(entry, now)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errLogSinkClosed
+	}
+	if s.conn == nil {
+		if now.Before(s.nextDial) {
+			return errSyslogUnavailable
+		}
+		if s.conn, err = net.DialTimeout(s.network, s.address, syslogTimeout); err != nil {
+			s.nextDial = now.Add(syslogRedial)
+			return err
+		}
+	}
+
+	if err = s.conn.SetWriteDeadline(now.Add(syslogTimeout)); err == nil {
+		_, err = s.conn.Write(msg)
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *SyslogSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *SyslogSink) String() string {
+	return "syslog+" + s.network + "://" + s.address
+}
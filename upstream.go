@@ -0,0 +1,291 @@
+package aclsrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var errNoAddress = errors.New("no address available for service")
+
+// upstreamState is the runtime state of a service or user script, which outlives changes to the catalog
+type upstreamState struct {
+	balancer *balancer
+	breaker  *breaker
+}
+
+// upstreamKey identifies the runtime state of a service or user script
+func upstreamKey(route, name string) string {
+	return route + "/" + name
+}
+
+// upstream returns the runtime state of a service on the given route (streamRouteAPI or streamRouteScript)
+func (s *State) upstream(route, name string) *upstreamState {
+	key := upstreamKey(route, name)
+
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+	up, ok := s.upstreams[key]
+	if !ok {
+		up = &upstreamState{
+			balancer: newBalancer(),
+			breaker:  newBreaker(),
+		}
+		s.upstreams[key] = up
+	}
+	return up
+}
+
+// pruneUpstreams drops the runtime state of services and user scripts that left the catalog
+func (s *State) pruneUpstreams() {
+	known := map[string]bool{}
+	snap := s.Snapshot()
+	for _, srv := range snap.Services {
+		known[upstreamKey(streamRouteAPI, srv.Name)] = true
+	}
+	for _, srv := range snap.UserScripts {
+		known[upstreamKey(streamRouteScript, srv.Name)] = true
+	}
+
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+	for key := range s.upstreams {
+		if !known[key] {
+			delete(s.upstreams, key)
+		}
+	}
+}
+
+// pick selects an address of the service for a request on the given route, skipping the
+// addresses in exclude
+func (s *State) pick(route string, srv *Service, exclude map[string]bool) *upstreamPick {
+	b := s.upstream(route, srv.Name).balancer
+	e := b.pick(srv.Addresses, srv.Upstream.balancer(), exclude)
+	if e == nil {
+		return nil
+	}
+	return &upstreamPick{balancer: b, endpoint: e, started: time.Now()}
+}
+
+// pickStream checks the circuit breaker of the service and picks an address for a streamed
+// request. The outcome is reported to the breaker when the pick is done.
+func (s *State) pickStream(route string, srv *Service) (*upstreamPick, error) {
+	up := s.upstream(route, srv.Name)
+	probe, ok := up.breaker.allow(&srv.Upstream.Breaker)
+	if !ok {
+		return nil, errCircuitOpen
+	}
+
+	pick := s.pick(route, srv, nil)
+	if pick == nil {
+		up.breaker.release(probe)
+		return nil, errNoAddress
+	}
+	pick.breaker = up.breaker
+	pick.breakerCfg = &srv.Upstream.Breaker
+	pick.probe = probe
+	return pick, nil
+}
+
+// UpstreamStatus is the runtime state of a service or user script, as shown at /admin/upstreams
+type UpstreamStatus struct {
+	Route     string            `json:"route"`
+	Service   string            `json:"service"`
+	Balancer  string            `json:"balancer"`
+	Breaker   *BreakerStatus    `json:"breaker"`
+	Endpoints []*EndpointStatus `json:"endpoints"`
+}
+
+func (s *State) upstreamStatus() (upstreams []*UpstreamStatus) {
+	add := func(route string, services []*Service) {
+		for _, srv := range services {
+			up := s.upstream(route, srv.Name)
+			upstreams = append(upstreams, &UpstreamStatus{
+				Route:     route,
+				Service:   srv.Name,
+				Balancer:  srv.Upstream.balancer(),
+				Breaker:   up.breaker.status(),
+				Endpoints: up.balancer.status(srv.Addresses),
+			})
+		}
+	}
+
+	snap := s.Snapshot()
+	add(streamRouteAPI, snap.Services)
+	add(streamRouteScript, snap.UserScripts)
+	return upstreams
+}
+
+// transportKey identifies the transport settings of an upstream
+type transportKey struct {
+	connectTimeout  time.Duration
+	responseTimeout time.Duration
+}
+
+// upstreamTransport returns a shared transport with the connect and response timeouts of the upstream
+func (s *State) upstreamTransport(u *Upstream) http.RoundTripper {
+	key := transportKey{
+		connectTimeout:  u.connectTimeout(),
+		responseTimeout: u.responseTimeout(),
+	}
+
+	s.transportsMu.Lock()
+	defer s.transportsMu.Unlock()
+	if transport, ok := s.transports[key]; ok {
+		return transport
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   key.connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ResponseHeaderTimeout: key.responseTimeout,
+	}
+	s.transports[key] = transport
+	return transport
+}
+
+// isIdempotent checks if a request with the method can safely be sent more than once
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isTimeout checks if the service failed to respond in time
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// upstreamError fills the response with the error of a service that could not be reached
+func (j *JSend) upstreamError(err error) {
+	j.Status = JSendError
+	j.Message = err.Error()
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		j.ErrorCode = ErrCodeCircuitOpen
+		j.HTTPCode = http.StatusServiceUnavailable
+	case isTimeout(err):
+		j.ErrorCode = ErrCodeUpstreamTimeout
+		j.HTTPCode = http.StatusGatewayTimeout
+	default:
+		j.ErrorCode = ErrCodeUpstreamUnavailable
+		j.HTTPCode = http.StatusBadGateway
+	}
+}
+
+// scriptErrorStatus is the http status of a user script that could not be reached
+func scriptErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable
+	case isTimeout(err):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// upstreamResponse is a buffered response of a service
+type upstreamResponse struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// forward sends a buffered request to the service, and reads the whole response within the total
+// timeout of the service. Idempotent requests are retried on another address when the service could
+// not be reached or answered 502, 503 or 504, as long as the retry budget allows. When every attempt
+// fails, the last response or error is returned. The request fails fast while the circuit breaker of
+// the service is open.
+func (s *State) forward(r *http.Request, route string, srv *Service, path, rawQuery string, header http.Header, body []byte) (*upstreamResponse, error) {
+	breaker := s.upstream(route, srv.Name).breaker
+	probe, ok := breaker.allow(&srv.Upstream.Breaker)
+	if !ok {
+		return nil, errCircuitOpen
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), srv.Upstream.timeout())
+	defer cancel()
+
+	client := &http.Client{
+		Transport: s.upstreamTransport(&srv.Upstream),
+	}
+
+	attempts := 1
+	if isIdempotent(r.Method) {
+		attempts += srv.Upstream.Retries
+	}
+
+	var res *upstreamResponse
+	err := errNoAddress
+	tried := map[string]bool{}
+	for attempt := 0; attempt < attempts && ctx.Err() == nil; attempt++ {
+		pick := s.pick(route, srv, tried)
+		if pick == nil {
+			break // no other address to retry on
+		}
+		tried[pick.address()] = true
+
+		target := &url.URL{
+			Scheme:   "http",
+			Host:     pick.address(),
+			Path:     path,
+			RawQuery: rawQuery,
+		}
+		res, err = s.roundTrip(ctx, client, pick, r.Method, target.String(), header, body)
+		pick.done()
+		if err == nil && !failedStatus(res.StatusCode) {
+			break
+		}
+	}
+
+	if err != nil && r.Context().Err() == context.Canceled {
+		breaker.release(probe)
+	} else {
+		breaker.record(&srv.Upstream.Breaker, probe, err != nil || failedStatus(res.StatusCode))
+	}
+	return res, err
+}
+
+func (s *State) roundTrip(ctx context.Context, client *http.Client, pick *upstreamPick, method, addr string, header http.Header, body []byte) (*upstreamResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, addr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		pick.observe(req, nil, err)
+		return &upstreamResponse{URL: addr}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	pick.observe(req, resp, err)
+	if err != nil {
+		return &upstreamResponse{URL: addr}, err
+	}
+
+	return &upstreamResponse{
+		URL:        addr,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       data,
+	}, nil
+}
@@ -0,0 +1,127 @@
+package aclsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getJSend sends a request through the gateway and decodes the JSend response
+func getJSend(t *testing.T, method, url, body string) (*http.Response, *JSend) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	response := &JSend{}
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+	return resp, response
+}
+
+func TestAPIHandlerRetries(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{
+			{
+				Name:      "users",
+				Addresses: []string{backendAddress(dead), backendAddress(backend)},
+				Upstream:  Upstream{Retries: 1},
+			},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	for i := 0; i < 4; i++ {
+		_, response := getJSend(t, http.MethodPut, gateway.URL+"/api/users/me", `{"name":"anders"}`)
+		if response.Status != JSendSuccess {
+			t.Fatalf("expected idempotent request to be retried. Got %+v", response)
+		}
+		if string(response.Data) != `{"name":"anders"}` {
+			t.Errorf("body was not replayed. Got %s", string(response.Data))
+		}
+	}
+
+	// POST is not retried
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{{Name: "users", Addresses: []string{backendAddress(dead)}, Upstream: Upstream{Retries: 1}}}
+	})
+	resp, response := getJSend(t, http.MethodPost, gateway.URL+"/api/users/me", `{}`)
+	if resp.StatusCode != http.StatusBadGateway || response.ErrorCode != ErrCodeUpstreamUnavailable {
+		t.Errorf("expected unavailable error. Got %s %+v", resp.Status, response)
+	}
+}
+
+func TestAPIHandlerTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	state := NewState()
+	setSnapshot(t, state, func(snap *Snapshot) {
+		snap.Services = []*Service{
+			{
+				Name:      "users",
+				Addresses: []string{backendAddress(backend)},
+				Upstream: Upstream{
+					ResponseTimeout: Duration(100 * time.Millisecond),
+					Timeout:         Duration(300 * time.Millisecond),
+				},
+			},
+		}
+		snap.UserScripts = []*Service{
+			{Name: "abc", Addresses: snap.Services[0].Addresses, Upstream: snap.Services[0].Upstream},
+		}
+	})
+	gateway := newTestGateway(t, state)
+
+	for _, path := range []string{"/slow-headers", "/slow-body"} {
+		started := time.Now()
+		resp, response := getJSend(t, http.MethodGet, gateway.URL+"/api/users"+path, "")
+		if resp.StatusCode != http.StatusGatewayTimeout || response.ErrorCode != ErrCodeUpstreamTimeout {
+			t.Errorf("%s: expected timeout error. Got %s %+v", path, resp.Status, response)
+		}
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Errorf("%s: timeout took %s", path, elapsed)
+		}
+	}
+
+	resp, err := http.Get(gateway.URL + "/script/abc/slow-headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected user script timeout. Got %s", resp.Status)
+	}
+}
@@ -1,11 +1,80 @@
 package aclsrv
 
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+)
+
 type UserID string // some type of token
 func (uid UserID) Str() string {
 	return string(uid)
 }
 
 type User struct {
-	ID         UserID `json:"uid,omitempty"`
+	ID         UserID     `json:"uid,omitempty"`
 	Permission Permission `json:"p"`
 }
+
+// UserIDSet is a set of user IDs with O(1) lookups. It is encoded as a sorted json list.
+type UserIDSet map[UserID]struct{}
+
+func NewUserIDSet(ids ...UserID) UserIDSet {
+	set := make(UserIDSet, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			set[id] = struct{}{}
+		}
+	}
+	return set
+}
+
+func (s UserIDSet) Contains(id UserID) bool {
+	_, ok := s[id]
+	return ok
+}
+
+func (s UserIDSet) List() []UserID {
+	ids := make([]UserID, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func (s UserIDSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.List())
+}
+
+func (s *UserIDSet) UnmarshalJSON(data []byte) error {
+	var ids []UserID
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+
+	*s = NewUserIDSet(ids...)
+	return nil
+}
+
+// parseUserIDs accepts either a json list of user IDs or user IDs separated by commas,
+// spaces or new lines.
+func parseUserIDs(value string) (UserIDSet, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		var set UserIDSet
+		err := json.Unmarshal([]byte(value), &set)
+		return set, err
+	}
+
+	var ids []UserID
+	for _, id := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		ids = append(ids, UserID(id))
+	}
+	return NewUserIDSet(ids...), nil
+}